@@ -0,0 +1,394 @@
+package route
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/libp2p/go-libp2p-core/routing"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	record "github.com/libp2p/go-libp2p-record"
+	"github.com/lp2p/p2pvpn/common/utils"
+	"github.com/lp2p/p2pvpn/constant"
+	"github.com/lp2p/p2pvpn/log"
+	"github.com/lp2p/p2pvpn/server"
+	"go.uber.org/multierr"
+)
+
+const (
+	// fingerprintNamespace is the DHT namespace of fingerprint records.
+	fingerprintNamespace = "p2pvpn-fingerprint"
+	// membersInterval is how often the members of the DHT are learned
+	// from the server.
+	membersInterval = time.Minute
+	// dhtTimeout bounds the DHT queries of fallbacks and publications.
+	dhtTimeout = 10 * time.Second
+	// dhtPeers is the size of the routing table members are connected to
+	// until it is reached, that of a bucket.
+	dhtPeers = 20
+)
+
+// Composite routes through the servers first and falls back to a private
+// Kademlia DHT formed by the peers of the network when no server answers.
+// The peers publish their signed fingerprint records in it, so
+// fingerprints still resolve during server outages. Any member can sign a
+// record for any fingerprint, so the fallbacks only answer with the
+// bindings the server verified last.
+type Composite struct {
+	*Route
+
+	mx  sync.RWMutex
+	dht *dht.IpfsDHT
+	// members are the peers of the network as last listed by the server,
+	// only they join the DHT.
+	members map[peer.ID]bool
+	// verified are the peer IDs of fingerprints as last answered by the
+	// server.
+	verified map[string]peer.ID
+	cancel   context.CancelFunc
+	// lan are the fingerprints advertised on the LAN, see AddLANPeer.
+	lan map[string]lanPeer
+}
+
+// lanPeer is a peer found on the LAN, until expires.
+type lanPeer struct {
+	id      peer.ID
+	expires time.Time
+}
+
+// NewComposite creates a composite routing of r, without DHT until
+// EnableDHT is called.
+func NewComposite(r *Route) *Composite {
+	return &Composite{
+		Route:    r,
+		members:  make(map[peer.ID]bool),
+		verified: make(map[string]peer.ID),
+		lan:      make(map[string]lanPeer),
+	}
+}
+
+// AddLANPeer records that id advertised fingerprint on the LAN, lookups
+// of fingerprint no server answers are answered with id for ttl if the
+// server answered id before.
+func (c *Composite) AddLANPeer(fingerprint string, id peer.ID, ttl time.Duration) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.lan[fingerprint] = lanPeer{id: id, expires: time.Now().Add(ttl)}
+}
+
+func (c *Composite) lanPeer(fingerprint string) (peer.ID, bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	p, ok := c.lan[fingerprint]
+	if ok && time.Now().After(p.expires) {
+		delete(c.lan, fingerprint)
+		return "", false
+	}
+	return p.id, ok
+}
+
+// EnableDHT joins the DHT of network, its records expire after ttl unless
+// republished by Provide. The members are learned from the server until
+// Close, the DHT neither queries nor answers other peers.
+func (c *Composite) EnableDHT(network string, ttl time.Duration) error {
+	prefix := "/p2pvpn"
+	if network != server.DefaultNetwork {
+		prefix += "/" + network
+	}
+	validator := fingerprintValidator{verified: c.verifiedPeer}
+	ctx, cancel := context.WithCancel(context.Background())
+	d, err := dht.New(ctx, memberHost{Host: c.h, member: c.member},
+		dht.Mode(dht.ModeServer),
+		dht.ProtocolPrefix(protocol.ID(prefix)),
+		dht.Validator(record.NamespacedValidator{fingerprintNamespace: validator}),
+		dht.MaxRecordAge(ttl),
+		dht.QueryFilter(func(_ interface{}, pi peer.AddrInfo) bool {
+			return c.member(pi.ID)
+		}),
+		dht.RoutingTableFilter(func(_ interface{}, id peer.ID) bool {
+			return c.member(id)
+		}),
+	)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	c.mx.Lock()
+	c.dht = d
+	c.cancel = cancel
+	c.mx.Unlock()
+
+	go c.learnMembers(ctx)
+	log.Infof("Joined the DHT of network %q", network)
+	return nil
+}
+
+// Close leaves the DHT.
+func (c *Composite) Close() error {
+	c.mx.Lock()
+	d, cancel := c.dht, c.cancel
+	c.dht, c.cancel = nil, nil
+	c.mx.Unlock()
+	if d == nil {
+		return nil
+	}
+	cancel()
+	return d.Close()
+}
+
+func (c *Composite) getDHT() *dht.IpfsDHT {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+	return c.dht
+}
+
+func (c *Composite) member(id peer.ID) bool {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+	return c.members[id]
+}
+
+// verify records the answer of the server for fingerprint.
+func (c *Composite) verify(fingerprint string, id peer.ID) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if id == "" {
+		delete(c.verified, fingerprint)
+		return
+	}
+	c.verified[fingerprint] = id
+}
+
+// verifiedPeer returns the peer ID of fingerprint last answered by the
+// server, empty if none.
+func (c *Composite) verifiedPeer(fingerprint string) peer.ID {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+	return c.verified[fingerprint]
+}
+
+// memberHost resets the streams of the peers that are not members before
+// the DHT handles them, so they can neither query nor store records.
+type memberHost struct {
+	host.Host
+	member func(peer.ID) bool
+}
+
+func (h memberHost) SetStreamHandler(pid protocol.ID, handler network.StreamHandler) {
+	h.Host.SetStreamHandler(pid, func(s network.Stream) {
+		if !h.member(s.Conn().RemotePeer()) {
+			_ = s.Reset()
+			return
+		}
+		handler(s)
+	})
+}
+
+// learnMembers lists the peers of the network from the server, and
+// connects to them while the routing table is not full.
+func (c *Composite) learnMembers(ctx context.Context) {
+	ticker := time.NewTicker(membersInterval)
+	defer ticker.Stop()
+	key := utils.StrToCid(constant.PeerRendezvous)
+	for {
+		peers, err := c.Route.findProviders(ctx, key, 0)
+		if err != nil {
+			log.Debugf("Failed to list DHT members: %v", err)
+		} else {
+			members := make(map[peer.ID]bool, len(peers))
+			for _, pi := range peers {
+				members[pi.ID] = true
+			}
+			c.mx.Lock()
+			c.members = members
+			d := c.dht
+			c.mx.Unlock()
+
+			for _, pi := range peers {
+				if d == nil || d.RoutingTable().Size() >= dhtPeers {
+					break
+				}
+				if pi.ID == c.h.ID() || d.RoutingTable().Find(pi.ID) != "" {
+					continue
+				}
+				cctx, cancel := context.WithTimeout(ctx, dhtTimeout)
+				if err := c.h.Connect(cctx, pi); err != nil {
+					log.Debugf("Failed to connect DHT member %s: %v", pi.ID, err)
+				}
+				cancel()
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// FindPeer implements routing.PeerRouting.
+func (c *Composite) FindPeer(ctx context.Context, id peer.ID) (peer.AddrInfo, error) {
+	pi, err := c.Route.FindPeer(ctx, id)
+	d := c.getDHT()
+	if err == nil || d == nil {
+		return pi, err
+	}
+	log.Debugf("Server lookup of %s failed, trying the DHT: %v", id, err)
+	ctx, cancel := context.WithTimeout(ctx, dhtTimeout)
+	defer cancel()
+	return d.FindPeer(ctx, id)
+}
+
+// Provide implements routing.ContentRouting. The registration is
+// published in the DHT too, unless the server refused it.
+func (c *Composite) Provide(ctx context.Context, key cid.Cid, bcast bool) error {
+	err := c.Route.Provide(ctx, key, bcast)
+	if err == nil && bcast && c.fingerprint != "" {
+		c.verify(c.fingerprint, c.h.ID())
+	}
+	d := c.getDHT()
+	if !bcast || d == nil || errors.Is(err, server.ErrFingerprintOwned) {
+		return err
+	}
+
+	dctx, cancel := context.WithTimeout(ctx, dhtTimeout)
+	defer cancel()
+	if perr := d.Provide(dctx, key, true); perr != nil {
+		log.Debugf("Failed to provide %s in the DHT: %v", key, perr)
+	}
+	if c.fingerprint != "" {
+		rec, serr := c.sealFingerprint(c.fingerprint)
+		if serr != nil {
+			return multierr.Append(err, serr)
+		}
+		if perr := d.PutValue(dctx, fingerprintKey(c.fingerprint), rec); perr != nil {
+			log.Debugf("Failed to publish fingerprint %s in the DHT: %v", c.fingerprint, perr)
+		}
+	}
+	return err
+}
+
+// FindProvidersAsync implements routing.ContentRouting.
+func (c *Composite) FindProvidersAsync(ctx context.Context, key cid.Cid, limit int) <-chan peer.AddrInfo {
+	ch := make(chan peer.AddrInfo)
+	go func() {
+		defer close(ch)
+		peers, err := c.Route.findProviders(ctx, key, limit)
+		if d := c.getDHT(); err != nil && d != nil {
+			log.Debugf("Server lookup of providers of %s failed, trying the DHT: %v", key, err)
+			peers = nil
+			for pi := range d.FindProvidersAsync(ctx, key, limit) {
+				peers = append(peers, pi)
+			}
+		} else if err != nil {
+			log.Errorf("%v", err)
+		}
+
+		for _, pi := range peers {
+			select {
+			case ch <- pi:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// FindPeerID finds peer id by fingerprint. If no server answers, the
+// peers advertising it on the LAN and then the DHT records are asked, they
+// are only trusted with the peer ID the server answered last. See
+// Route.FindPeerID.
+func (c *Composite) FindPeerID(fingerprint string) (peer.ID, error) {
+	id, err := c.Route.FindPeerID(fingerprint)
+	if err == nil {
+		c.verify(fingerprint, id)
+		return id, nil
+	}
+	if id, ok := c.lanPeer(fingerprint); ok && id == c.verifiedPeer(fingerprint) {
+		log.Debugf("Server lookup of fingerprint %s failed, found it on the LAN: %v", fingerprint, err)
+		return id, nil
+	}
+	d := c.getDHT()
+	if d == nil {
+		return "", err
+	}
+	log.Debugf("Server lookup of fingerprint %s failed, trying the DHT: %v", fingerprint, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dhtTimeout)
+	defer cancel()
+	value, derr := d.GetValue(ctx, fingerprintKey(fingerprint))
+	if errors.Is(derr, routing.ErrNotFound) {
+		return "", nil
+	}
+	if derr != nil {
+		return "", fmt.Errorf("%w, DHT: %v", err, derr)
+	}
+	rec, derr := server.OpenFingerprint(value, fingerprint)
+	if derr != nil {
+		return "", derr
+	}
+	if verified := c.verifiedPeer(fingerprint); rec.PeerID != verified {
+		return "", fmt.Errorf("%w, DHT: record of %s is for %s, not the verified %q",
+			err, fingerprint, rec.PeerID, verified)
+	}
+	return rec.PeerID, nil
+}
+
+func fingerprintKey(fingerprint string) string {
+	return "/" + fingerprintNamespace + "/" + fingerprint
+}
+
+// fingerprintValidator accepts the fingerprint records signed by the peer
+// they name. The records of the peer the server verified win, then the
+// newest one.
+type fingerprintValidator struct {
+	verified func(fingerprint string) peer.ID
+}
+
+func (fingerprintValidator) Validate(key string, value []byte) error {
+	ns, fingerprint, err := record.SplitKey(key)
+	if err != nil {
+		return err
+	}
+	if ns != fingerprintNamespace {
+		return record.ErrInvalidRecordType
+	}
+	_, err = server.OpenFingerprint(value, fingerprint)
+	return err
+}
+
+func (v fingerprintValidator) Select(key string, values [][]byte) (int, error) {
+	best, seq, trusted := -1, uint64(0), false
+	_, fingerprint, err := record.SplitKey(key)
+	if err != nil {
+		return 0, err
+	}
+	var verified peer.ID
+	if v.verified != nil {
+		verified = v.verified(fingerprint)
+	}
+	for i, value := range values {
+		rec, err := server.OpenFingerprint(value, fingerprint)
+		if err != nil {
+			continue
+		}
+		isTrusted := verified != "" && rec.PeerID == verified
+		if best < 0 || isTrusted && !trusted || isTrusted == trusted && rec.Seq > seq {
+			best, seq, trusted = i, rec.Seq, isTrusted
+		}
+	}
+	if best < 0 {
+		return 0, errors.New("no valid fingerprint record")
+	}
+	return best, nil
+}
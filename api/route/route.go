@@ -1,73 +1,178 @@
 package route
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/lp2p/p2pvpn/server"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
 	"github.com/libp2p/go-libp2p-core/routing"
 	"github.com/libp2p/go-libp2p/p2p/host/relay"
+	"github.com/lp2p/p2pvpn/common/auth"
 	"github.com/lp2p/p2pvpn/common/utils"
 	"github.com/lp2p/p2pvpn/constant"
 	"github.com/lp2p/p2pvpn/log"
+	"github.com/lp2p/p2pvpn/server"
+	"github.com/lp2p/p2pvpn/transport/streamnet"
+	ma "github.com/multiformats/go-multiaddr"
 )
 
-// httpClient uses to do send requests.
-var httpClient = &http.Client{}
+// httpClient uses to do send requests. Its timeouts let requests fail
+// over from servers that are down without bounding watch streams.
+var httpClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 5 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+		MaxIdleConnsPerHost:   4,
+		IdleConnTimeout:       90 * time.Second,
+	},
+}
+
+const (
+	// p2pScheme is the scheme of the urls of server hosts.
+	p2pScheme = "libp2p"
+	// p2pHost is the host of the urls of requests sent over libp2p.
+	p2pHost = "http://rendezvous"
+)
+
+// newP2PClient returns a client sending requests over the
+// constant.RendezvousProtocol streams of h to the server host id, whatever
+// the host of their url.
+func newP2PClient(h host.Host, id peer.ID) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+				defer cancel()
+				return streamnet.Dial(ctx, h, id, constant.RendezvousProtocol)
+			},
+			ResponseHeaderTimeout: 10 * time.Second,
+			MaxIdleConnsPerHost:   4,
+			IdleConnTimeout:       90 * time.Second,
+		},
+	}
+}
+
+// Server is a rendezvous server and the credential to sign requests to
+// it with.
+type Server struct {
+	URL        string
+	Credential auth.Credential
+	// Network is the network joined on the server, the default one if
+	// empty.
+	Network string
+	// Peer is the libp2p host of the server, requests are sent over
+	// constant.RendezvousProtocol to it instead of to URL when set.
+	Peer peer.AddrInfo
+}
+
+// ParseServer parses a server url, with a credential as in auth.ParseURL.
+// The url is either the HTTP one of the api, or the multiaddr of the
+// server host as libp2p://[id:secret@]/ip4/1.2.3.4/tcp/4001/p2p/<peer id>,
+// or that multiaddr alone to use defaultSecret.
+func ParseServer(raw, defaultSecret string) (Server, error) {
+	if strings.HasPrefix(raw, "/") {
+		raw = p2pScheme + "://" + raw
+	}
+	if !strings.HasPrefix(raw, p2pScheme+"://") {
+		serverUrl, credential, err := auth.ParseURL(raw, defaultSecret)
+		if err != nil {
+			return Server{}, err
+		}
+		return Server{URL: serverUrl, Credential: credential}, nil
+	}
+
+	// The multiaddr is not a valid url path, only the credential is
+	// parsed as url.
+	rest := strings.TrimPrefix(raw, p2pScheme+"://")
+	i := strings.Index(rest, "/")
+	if i < 0 {
+		return Server{}, fmt.Errorf("server url %q: no multiaddr", raw)
+	}
+	_, credential, err := auth.ParseURL(p2pScheme+"://"+rest[:i], defaultSecret)
+	if err != nil {
+		return Server{}, err
+	}
+	addr, err := ma.NewMultiaddr(rest[i:])
+	if err != nil {
+		return Server{}, fmt.Errorf("server url %q: %w", raw, err)
+	}
+	pi, err := peer.AddrInfoFromP2pAddr(addr)
+	if err != nil {
+		return Server{}, fmt.Errorf("server url %q: %w", raw, err)
+	}
+	return Server{URL: p2pScheme + "://" + pi.ID.Pretty(), Credential: credential, Peer: *pi}, nil
+}
 
 // Route is a implement of PeerRouting and ContentRouting.
 type Route struct {
 	h           host.Host
 	fingerprint string
-	serverUrl   string
-	secret      string
+	// servers are replicas of the same table, requests go to current and
+	// fail over to the next when it is unreachable.
+	servers []Server
+	// clients are the clients of servers, by index.
+	clients []*http.Client
+	mx      sync.Mutex
+	current int
+	// ttl is the lease asked for by Provide, the server default if zero.
+	ttl time.Duration
+	// observed is the address the server last saw us at.
+	observed string
 }
 
 var (
-	_router *Route
+	_router *Composite
 )
 
-func Router() *Route {
+// Router returns the routing of the host created with MakeRouting.
+func Router() *Composite {
 	return _router
 }
 
-// NewRoute creates a new remote routing for client to use.
-func NewRoute(h host.Host, serverUrl, fingerprint, secret string) *Route {
+// NewRoute creates a new remote routing for client to use, registrations
+// are leased for ttl and have to be renewed by calling Provide again.
+// servers must be replicas of each other, they are tried in order.
+func NewRoute(h host.Host, servers []Server, fingerprint string, ttl time.Duration) *Route {
+	clients := make([]*http.Client, len(servers))
+	for i, s := range servers {
+		clients[i] = httpClient
+		if s.Peer.ID != "" {
+			h.Peerstore().AddAddrs(s.Peer.ID, s.Peer.Addrs, peerstore.PermanentAddrTTL)
+			clients[i] = newP2PClient(h, s.Peer.ID)
+		}
+	}
 	return &Route{
 		h:           h,
-		serverUrl:   serverUrl,
+		servers:     servers,
+		clients:     clients,
 		fingerprint: fingerprint,
-		secret:      secret,
+		ttl:         ttl,
 	}
 }
 
 // FindPeer implements routing.PeerRouting.
 func (r *Route) FindPeer(ctx context.Context, p peer.ID) (peer.AddrInfo, error) {
-	resp, err := r.getWithContext(ctx, r.serverUrl+constant.RoutingUrl+p.Pretty())
-	if err != nil {
-		return peer.AddrInfo{}, err
-	}
-
-	res, err := io.ReadAll(resp.Body)
-	var respPtr server.PeerResp
-	err = json.Unmarshal(res, &respPtr)
-	if err != nil {
-		return peer.AddrInfo{}, err
-	}
-
-	if respPtr.Status {
-		return respPtr.AddrInfo, nil
-	} else {
+	var resp server.PeerResponse
+	err := r.do(ctx, http.MethodGet, constant.V2PeersUrl+p.Pretty(), nil, &resp)
+	if errors.Is(err, server.ErrNotFound) {
 		return peer.AddrInfo{}, nil
 	}
+	return resp.Peer, err
 }
 
 // Provide implements routing.ContentRouting.
@@ -75,37 +180,48 @@ func (r *Route) Provide(ctx context.Context, cid cid.Cid, bcast bool) error {
 	if !bcast {
 		return nil
 	}
-	var addrs string
+
+	req := server.RegisterRequest{
+		PeerID:      r.h.ID(),
+		Fingerprint: r.fingerprint,
+		TTL:         int(r.ttl / time.Second),
+	}
 	for _, addr := range r.h.Addrs() {
-		addrs += addr.String() + ","
+		req.Addrs = append(req.Addrs, addr.String())
 	}
-
-	resp, err := r.postForm(ctx, r.serverUrl+constant.RoutingUrl+cid.String(),
-		url.Values{
-			"id":          {r.h.ID().String()},
-			"addrs":       {addrs},
-			"fingerprint": {r.fingerprint},
-		})
-	if err != nil {
-		return err
+	if r.fingerprint != "" {
+		record, err := r.sealFingerprint(r.fingerprint)
+		if err != nil {
+			return err
+		}
+		req.Record = record
 	}
 
-	res, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return err
+	var resp server.RegisterResponse
+	err := r.do(ctx, http.MethodPost, constant.V2ProvidersUrl+cid.String(), req, &resp)
+	if errors.Is(err, server.ErrFingerprintOwned) {
+		return fmt.Errorf("%w: %s", server.ErrFingerprintOwned, r.fingerprint)
 	}
-
-	var respPtr server.StatusResp
-	err = json.Unmarshal(res, &respPtr)
 	if err != nil {
 		return err
 	}
 
-	if respPtr.Status {
-		return nil
-	} else {
-		return fmt.Errorf("something wrong")
+	r.mx.Lock()
+	changed := resp.Observed != r.observed
+	r.observed = resp.Observed
+	r.mx.Unlock()
+	if changed && resp.Observed != "" {
+		log.Infof("Server observed us at %s", resp.Observed)
 	}
+	return nil
+}
+
+// ObservedAddr returns the address the server last saw us at, like
+// /ip4/1.2.3.4, empty before the first registration.
+func (r *Route) ObservedAddr() string {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.observed
 }
 
 // FindProvidersAsync implements routing.ContentRouting.
@@ -113,25 +229,15 @@ func (r *Route) FindProvidersAsync(ctx context.Context, cid cid.Cid, limit int)
 	ch := make(chan peer.AddrInfo)
 	go func() {
 		defer close(ch)
-		resp, err := r.getWithContext(ctx, r.serverUrl+constant.RoutingProviderUrl+cid.String())
-		if err != nil {
-			log.Errorf("%v", err)
-		}
-
-		res, err := io.ReadAll(resp.Body)
-		if err != nil {
-			log.Errorf("%v", err)
-		}
-
-		var respPtr server.ProvidersResp
-		err = json.Unmarshal(res, &respPtr)
+		peers, err := r.findProviders(ctx, cid, limit)
 		if err != nil {
 			log.Errorf("%v", err)
+			return
 		}
 
-		for _, pi := range respPtr.AddrInfos {
+		for _, p := range peers {
 			select {
-			case ch <- pi:
+			case ch <- p:
 			case <-ctx.Done():
 				return
 			}
@@ -140,83 +246,93 @@ func (r *Route) FindProvidersAsync(ctx context.Context, cid cid.Cid, limit int)
 	return ch
 }
 
-// FindPeerID finds peer id by fingerprint.
-func (r *Route) FindPeerID(fingerprint string) (peer.ID, error) {
-	resp, err := r.get(r.serverUrl + constant.FingerprintsUrl + fingerprint)
+// findProviders returns up to limit providers of cid, all if limit is 0.
+func (r *Route) findProviders(ctx context.Context, cid cid.Cid, limit int) ([]peer.AddrInfo, error) {
+	var resp server.ProvidersResponse
+	err := r.do(ctx, http.MethodGet, constant.V2ProvidersUrl+cid.String(), nil, &resp)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-
-	res, err := io.ReadAll(resp.Body)
-	var respPtr server.IDResp
-	err = json.Unmarshal(res, &respPtr)
-	if err != nil {
-		return "", err
+	var peers []peer.AddrInfo
+	for i, p := range resp.Peers {
+		if limit > 0 && i >= limit {
+			break
+		}
+		peers = append(peers, p.Peer)
 	}
-	return respPtr.PeerID, nil
+	return peers, nil
 }
 
-func (r *Route) Logout(fingerprint string) error {
-	resp, err := r.delete(r.serverUrl + constant.FingerprintsUrl + fingerprint)
+// FindPeerID finds peer id by fingerprint, and checks the peer signed the
+// record binding the fingerprint to it. It returns an empty id for unknown
+// fingerprints.
+func (r *Route) FindPeerID(fingerprint string) (peer.ID, error) {
+	var resp server.FingerprintResponse
+	err := r.do(context.Background(), http.MethodGet, constant.V2FingerprintsUrl+fingerprint, nil, &resp)
+	if errors.Is(err, server.ErrNotFound) {
+		return "", nil
+	}
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	res, err := io.ReadAll(resp.Body)
-	var respPtr server.StatusResp
-	err = json.Unmarshal(res, &respPtr)
+	rec, err := server.OpenFingerprint(resp.Record, fingerprint)
 	if err != nil {
-		return err
+		return "", err
 	}
-	if !respPtr.Status {
-		return fmt.Errorf("Fail to logout")
+	if rec.PeerID != resp.PeerID {
+		return "", fmt.Errorf("%w: record is for %s, not %s", server.ErrInvalidRecord, rec.PeerID, resp.PeerID)
 	}
-	log.Infof("Logout successfully!")
-	return nil
+	return resp.PeerID, nil
 }
 
-func (r *Route) SetServerID() error {
-	resp, err := r.post(r.serverUrl+constant.ServerIDUrl+r.h.ID().String(), "", nil)
-	if err != nil {
-		return err
+// sealFingerprint returns the record claiming fingerprint for the host.
+func (r *Route) sealFingerprint(fingerprint string) ([]byte, error) {
+	priv := r.h.Peerstore().PrivKey(r.h.ID())
+	if priv == nil {
+		return nil, fmt.Errorf("no private key for %s", r.h.ID())
 	}
-	res, err := io.ReadAll(resp.Body)
-	var respPtr server.StatusResp
-	err = json.Unmarshal(res, &respPtr)
+	return server.SealFingerprint(fingerprint, priv)
+}
+
+func (r *Route) Logout(fingerprint string) error {
+	record, err := r.sealFingerprint(fingerprint)
 	if err != nil {
 		return err
 	}
-	if !respPtr.Status {
-		return fmt.Errorf("failed to register server id")
+	req := server.UnregisterRequest{Record: record}
+	err = r.do(context.Background(), http.MethodDelete, constant.V2FingerprintsUrl+fingerprint, req, nil)
+	if err != nil {
+		return fmt.Errorf("logout: %w", err)
 	}
+	log.Infof("Logout successfully!")
 	return nil
 }
 
+// GetServerID returns the peer ID of the server host, known without
+// asking from the multiaddr of libp2p servers.
 func (r *Route) GetServerID() (peer.ID, error) {
-	resp, err := r.get(r.serverUrl + constant.ServerIDUrl)
-	if err != nil {
-		return "", err
+	r.mx.Lock()
+	var id peer.ID
+	if len(r.servers) > 0 {
+		id = r.servers[r.current].Peer.ID
 	}
-
-	res, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
+	r.mx.Unlock()
+	if id != "" {
+		return id, nil
 	}
 
-	var respPtr server.IDResp
-	err = json.Unmarshal(res, &respPtr)
-	if err != nil {
-		return "", err
-	}
-	return respPtr.PeerID, nil
+	var resp server.ServerIDResponse
+	err := r.do(context.Background(), http.MethodGet, constant.V2ServerIDUrl, nil, &resp)
+	return resp.PeerID, err
 }
 
 // MakeRouting returns function for libp2p.Routing, it will register node itself
 // when create a new node.
-func MakeRouting(serverUrl, ns, fingerprint, secret string) func(h host.Host) (routing.PeerRouting, error) {
+func MakeRouting(servers []Server, ns, fingerprint string, ttl time.Duration) func(h host.Host) (routing.PeerRouting, error) {
 	var router routing.PeerRouting
 	return func(h host.Host) (routing.PeerRouting, error) {
-		_router = NewRoute(h, serverUrl, fingerprint, secret)
+		_router = NewComposite(NewRoute(h, servers, fingerprint, ttl))
 		router = _router
 		var err error
 		// Only register ourself when namespace is not relay.RelayRendezvous
@@ -229,63 +345,105 @@ func MakeRouting(serverUrl, ns, fingerprint, secret string) func(h host.Host) (r
 	}
 }
 
-// get sends get request with auth header.
-func (r *Route) get(url string) (resp *http.Response, err error) {
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+// do sends a signed request of the v2 API to path with the JSON encoding
+// of body, if not nil, and decodes the response into v, if not nil. Error
+// responses are returned as *server.APIError.
+func (r *Route) do(ctx context.Context, method, path string, body, v interface{}) error {
+	resp, err := r.send(ctx, method, path, body)
 	if err != nil {
-		return
+		return err
 	}
-	r.setAuthHeader(req)
-	return httpClient.Do(req)
-}
+	defer resp.Body.Close()
 
-func (r *Route) delete(url string) (resp *http.Response, err error) {
-	req, err := http.NewRequest(http.MethodDelete, url, nil)
-	if err != nil {
-		return
+	if resp.StatusCode >= 300 {
+		var errResp server.ErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Error == nil {
+			return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+		}
+		return errResp.Error
 	}
-	r.setAuthHeader(req)
-	return httpClient.Do(req)
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
 }
 
-// getWithContext sends get request with auth header and context.
-func (r *Route) getWithContext(ctx context.Context, url string) (resp *http.Response, err error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	if err != nil {
-		return
+// send sends a signed request of the v2 API, the caller closes the body of
+// the response. Servers that can not be reached or are unavailable are
+// failed over from.
+func (r *Route) send(ctx context.Context, method, path string, body interface{}) (*http.Response, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	if len(r.servers) == 0 {
+		return nil, errors.New("no server")
 	}
-	r.setAuthHeader(req)
-	return httpClient.Do(req)
-}
 
-// post sends post request with auth header.
-func (r *Route) post(url, contentType string, body io.Reader) (resp *http.Response, err error) {
-	req, err := http.NewRequest(http.MethodPost, url, body)
-	if err != nil {
-		return
+	r.mx.Lock()
+	start := r.current
+	r.mx.Unlock()
+
+	var err error
+	for i := range r.servers {
+		n := (start + i) % len(r.servers)
+		var resp *http.Response
+		resp, err = r.sendTo(ctx, n, method, path, data)
+		if err == nil && !unavailable(resp.StatusCode) {
+			if n != start {
+				r.mx.Lock()
+				r.current = n
+				r.mx.Unlock()
+				log.Warnf("Failed over to server %s", r.servers[n].URL)
+			}
+			return resp, nil
+		}
+		if err == nil {
+			_ = resp.Body.Close()
+			err = fmt.Errorf("%s: %s", r.servers[n].URL, resp.Status)
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		log.Debugf("Server %s failed: %v", r.servers[n].URL, err)
 	}
-	r.setAuthHeader(req)
-	req.Header.Set("Content-Type", contentType)
-	return httpClient.Do(req)
+	return nil, err
 }
 
-// postWithContext sends post request with context.
-func (r *Route) postWithContext(ctx context.Context, url, contentType string, body io.Reader) (resp *http.Response, err error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+// sendTo sends a signed request to the server n.
+func (r *Route) sendTo(ctx context.Context, n int, method, path string, data []byte) (*http.Response, error) {
+	var reader io.Reader
+	if data != nil {
+		reader = bytes.NewReader(data)
+	}
+	s := r.servers[n]
+	target := s.URL + path
+	if s.Peer.ID != "" {
+		target = p2pHost + path
+	}
+	if s.Network != server.DefaultNetwork {
+		target += "?" + server.NetworkParam + "=" + url.QueryEscape(s.Network)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
 	if err != nil {
-		return
+		return nil, err
 	}
-	r.setAuthHeader(req)
-	req.Header.Set("Content-Type", contentType)
-	return httpClient.Do(req)
-}
-
-// postForm sends form request with auth header and context.
-func (r *Route) postForm(ctx context.Context, url string, data url.Values) (resp *http.Response, err error) {
-	return r.postWithContext(ctx, url, "application/x-www-form-urlencoded", strings.NewReader(data.Encode()))
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if err := auth.Sign(req, s.Credential); err != nil {
+		return nil, err
+	}
+	return r.clients[n].Do(req)
 }
 
-func (r *Route) setAuthHeader(req *http.Request) {
-	secret := utils.Md5(r.secret)
-	req.Header.Set("auth", secret)
+// unavailable reports whether status means the server can not serve the
+// request now, but a replica may.
+func unavailable(status int) bool {
+	return status == http.StatusBadGateway ||
+		status == http.StatusServiceUnavailable ||
+		status == http.StatusGatewayTimeout
 }
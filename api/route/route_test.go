@@ -2,6 +2,10 @@ package route
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
@@ -10,11 +14,15 @@ import (
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/libp2p/go-libp2p"
 	circuit "github.com/libp2p/go-libp2p-circuit"
+	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/event"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p/p2p/host/relay"
+	"github.com/lp2p/p2pvpn/common/auth"
+	"github.com/lp2p/p2pvpn/common/utils"
+	"github.com/lp2p/p2pvpn/constant"
 	"github.com/lp2p/p2pvpn/log"
 	"github.com/lp2p/p2pvpn/server"
 	ma "github.com/multiformats/go-multiaddr"
@@ -56,7 +64,7 @@ func TestRouteRelay(t *testing.T) {
 
 	_, err = libp2p.New(ctx,
 		libp2p.EnableRelay(circuit.OptHop),
-		libp2p.Routing(MakeRouting(serverUrl, relay.RelayRendezvous, "", "test")),
+		libp2p.Routing(MakeRouting([]Server{{URL: serverUrl, Credential: auth.Credential{Secret: "test"}}}, relay.RelayRendezvous, "", 0)),
 		libp2p.EnableAutoRelay(),
 		libp2p.AddrsFactory(func(addresses []ma.Multiaddr) []ma.Multiaddr {
 			for i, addr := range addresses {
@@ -76,7 +84,7 @@ func TestRouteRelay(t *testing.T) {
 	h3, err := libp2p.New(ctx,
 		libp2p.EnableRelay(),
 		libp2p.EnableAutoRelay(),
-		libp2p.Routing(MakeRouting(serverUrl, "clients", "", "test")))
+		libp2p.Routing(MakeRouting([]Server{{URL: serverUrl, Credential: auth.Credential{Secret: "test"}}}, "clients", "", 0)))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -161,14 +169,14 @@ func TestConnectByID(t *testing.T) {
 	serverUrl := "http://127.0.0.1:8001"
 
 	h1, err := libp2p.New(ctx,
-		libp2p.Routing(MakeRouting(serverUrl, "client", "", "test")),
+		libp2p.Routing(MakeRouting([]Server{{URL: serverUrl, Credential: auth.Credential{Secret: "test"}}}, "client", "", 0)),
 	)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	h2, err := libp2p.New(ctx,
-		libp2p.Routing(MakeRouting(serverUrl, "client", "", "test")))
+		libp2p.Routing(MakeRouting([]Server{{URL: serverUrl, Credential: auth.Credential{Secret: "test"}}}, "client", "", 0)))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -182,3 +190,241 @@ func TestConnectByID(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestFailover(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	initApiServer(":8002")
+	// Nothing listens on :8003, requests fail over to the second server.
+	servers := []Server{
+		{URL: "http://127.0.0.1:8003", Credential: auth.Credential{Secret: "test"}},
+		{URL: "http://127.0.0.1:8002", Credential: auth.Credential{Secret: "test"}},
+	}
+
+	h, err := libp2p.New(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRoute(h, servers, "", 0)
+	time.Sleep(100 * time.Millisecond)
+
+	id, err := r.FindPeerID("nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "" {
+		t.Fatalf("peer id = %s, want none", id)
+	}
+	if r.current != 1 {
+		t.Fatalf("current server = %d, want 1", r.current)
+	}
+}
+
+func TestParseServer(t *testing.T) {
+	id := "QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN"
+	for _, tt := range []struct {
+		raw, url, credentialID, secret, peer string
+	}{
+		{"http://s3@127.0.0.1:8000", "http://127.0.0.1:8000", "", "s3", ""},
+		{"/ip4/127.0.0.1/tcp/4001/p2p/" + id, "libp2p://" + id, "", "default", id},
+		{"libp2p://laptop:s3@/ip4/127.0.0.1/tcp/4001/p2p/" + id, "libp2p://" + id, "laptop", "s3", id},
+	} {
+		s, err := ParseServer(tt.raw, "default")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.raw, err)
+		}
+		if s.URL != tt.url || s.Credential.ID != tt.credentialID || s.Credential.Secret != tt.secret || s.Peer.ID.Pretty() != tt.peer {
+			t.Fatalf("%s: got %+v", tt.raw, s)
+		}
+	}
+
+	for _, raw := range []string{"libp2p://s3@", "/ip4/127.0.0.1/tcp/4001"} {
+		if _, err := ParseServer(raw, "default"); err == nil {
+			t.Fatalf("%s: no error", raw)
+		}
+	}
+}
+
+func TestP2PServer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serverHost, err := libp2p.New(ctx, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// No HTTP listener, the api is only served over libp2p.
+	api := server.NewAPIService(gin.New(), server.NewRouteTable(), "", "test")
+	go func() { _ = api.ServeP2P(serverHost) }()
+
+	s, err := ParseServer(fmt.Sprintf("libp2p://test@%s/p2p/%s", serverHost.Addrs()[0], serverHost.ID()), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := libp2p.New(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRoute(h, []Server{s}, "laptop", 0)
+	if err := r.Provide(ctx, utils.StrToCid("p2pvpn"), true); err != nil {
+		t.Fatal(err)
+	}
+	id, err := r.FindPeerID("laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != h.ID() {
+		t.Fatalf("peer id = %s, want %s", id, h.ID())
+	}
+	if id, err := r.GetServerID(); err != nil || id != serverHost.ID() {
+		t.Fatalf("server id = %s, %v", id, err)
+	}
+}
+
+func TestCompositeFallback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serverHost, err := libp2p.New(ctx, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := server.NewAPIService(gin.New(), server.NewRouteTable(), "", "test")
+	go func() { _ = api.ServeP2P(serverHost) }()
+	s, err := ParseServer(fmt.Sprintf("libp2p://test@%s/p2p/%s", serverHost.Addrs()[0], serverHost.ID()), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var routers []*Composite
+	for _, fingerprint := range []string{"laptop", "desktop"} {
+		h, err := libp2p.New(ctx, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := NewComposite(NewRoute(h, []Server{s}, fingerprint, time.Minute))
+		if err := c.Provide(ctx, utils.StrToCid(constant.PeerRendezvous), true); err != nil {
+			t.Fatal(err)
+		}
+		routers = append(routers, c)
+	}
+	for _, c := range routers {
+		if err := c.EnableDHT("", time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+	laptop, desktop := routers[0], routers[1]
+
+	// Publish once the members see each other in their routing tables.
+	deadline := time.Now().Add(10 * time.Second)
+	for laptop.getDHT().RoutingTable().Size() == 0 || desktop.getDHT().RoutingTable().Size() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("members did not join the DHT")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	for _, c := range routers {
+		if err := c.Provide(ctx, utils.StrToCid(constant.PeerRendezvous), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := desktop.FindPeerID("laptop"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The desktop tries to take over the fingerprint of the laptop.
+	rec, err := desktop.sealFingerprint("laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = desktop.getDHT().PutValue(ctx, fingerprintKey("laptop"), rec)
+
+	_ = serverHost.Close()
+	id, err := desktop.FindPeerID("laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != laptop.h.ID() {
+		t.Fatalf("peer id = %s, want %s", id, laptop.h.ID())
+	}
+	if id, err := desktop.FindPeerID("nobody"); err != nil || id != "" {
+		t.Fatalf("peer id of nobody = %q, %v", id, err)
+	}
+	// The laptop never verified the fingerprint of the desktop.
+	if id, err := laptop.FindPeerID("desktop"); err == nil {
+		t.Fatalf("unverified peer id of desktop = %s", id)
+	}
+}
+
+func TestFingerprintValidator(t *testing.T) {
+	priv, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	older, _ := server.SealFingerprint("laptop", priv)
+	newer, _ := server.SealFingerprint("laptop", priv)
+
+	v := fingerprintValidator{}
+	if err := v.Validate(fingerprintKey("laptop"), older); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Validate(fingerprintKey("desktop"), older); err == nil {
+		t.Fatal("record of laptop valid for desktop")
+	}
+	if i, err := v.Select(fingerprintKey("laptop"), [][]byte{newer, []byte("junk"), older}); err != nil || i != 0 {
+		t.Fatalf("selected %d, %v", i, err)
+	}
+
+	// A newer record of another peer loses to the verified one.
+	id, _ := peer.IDFromPrivateKey(priv)
+	other, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hijack, _ := server.SealFingerprint("laptop", other)
+	v = fingerprintValidator{verified: func(string) peer.ID { return id }}
+	if i, err := v.Select(fingerprintKey("laptop"), [][]byte{hijack, older}); err != nil || i != 1 {
+		t.Fatalf("selected %d, %v", i, err)
+	}
+}
+
+func TestWatchIdle(t *testing.T) {
+	defer func(d time.Duration) { watchIdleTimeout = d }(watchIdleTimeout)
+	watchIdleTimeout = 200 * time.Millisecond
+
+	id, err := peer.Decode("QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The server sends one event and then nothing, like a dead connection.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		data, _ := json.Marshal(server.Event{Type: server.EventRegister, Peer: peer.AddrInfo{ID: id}, Fingerprint: "laptop"})
+		fmt.Fprintf(w, "event: register\ndata: %s\n\n", data)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	s, err := ParseServer("http://test@"+srv.Listener.Addr().String(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := NewRoute(nil, []Server{s}, "desktop", 0).Watch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := <-events; e.Fingerprint != "laptop" {
+		t.Fatalf("event = %+v", e)
+	}
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Fatal("unexpected event")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle watch not closed")
+	}
+}
@@ -0,0 +1,83 @@
+package route
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lp2p/p2pvpn/constant"
+	"github.com/lp2p/p2pvpn/log"
+	"github.com/lp2p/p2pvpn/server"
+)
+
+// ErrWatchUnsupported is returned by Watch for servers without watch API.
+var ErrWatchUnsupported = errors.New("server does not support watch")
+
+// watchIdleTimeout is how long Watch waits for a line before it takes the
+// connection for lost, the server sends keep-alives more often.
+var watchIdleTimeout = 3 * server.WatchKeepAlive
+
+// Watch subscribes to the registrations, updates, expiries and logouts of
+// the server. The channel is closed when ctx is done or the connection is
+// lost, or silent for longer than the keep-alives allow. Callers watching
+// for long should call Watch again then.
+func (r *Route) Watch(ctx context.Context) (<-chan server.Event, error) {
+	resp, err := r.send(ctx, http.MethodGet, constant.V2WatchUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		_ = resp.Body.Close()
+		return nil, ErrWatchUnsupported
+	default:
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("watch: %s", resp.Status)
+	}
+
+	ch := make(chan server.Event)
+	go func() {
+		defer close(ch)
+		defer resp.Body.Close()
+
+		// A dead connection is closed once no line came for a while.
+		idle := time.AfterFunc(watchIdleTimeout, func() { _ = resp.Body.Close() })
+		defer idle.Stop()
+
+		// Events are "event:" and "data:" lines ended by a blank line,
+		// lines starting with ":" are keep-alives.
+		var data strings.Builder
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			idle.Reset(watchIdleTimeout)
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "data:"):
+				data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+				continue
+			case line != "" || data.Len() == 0:
+				continue
+			}
+
+			var e server.Event
+			err := json.Unmarshal([]byte(data.String()), &e)
+			data.Reset()
+			if err != nil {
+				log.Warnf("Invalid watch event: %v", err)
+				continue
+			}
+			select {
+			case ch <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
@@ -2,24 +2,257 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
+	"sort"
+	"strings"
 	"syscall"
 
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/lp2p/p2pvpn/config"
 	"github.com/lp2p/p2pvpn/engine"
+	"github.com/lp2p/p2pvpn/identity"
 	"github.com/lp2p/p2pvpn/log"
+	"github.com/lp2p/p2pvpn/policy"
+	"github.com/lp2p/p2pvpn/transport/socks5"
 )
 
-var key = new(engine.Key)
+var (
+	cfg = config.DefaultClient()
+	key = &cfg.Key
+
+	configPath  string
+	checkConfig bool
+	exportKey   string
+	importKey   string
+
+	forwards = &forwardsFlag{forwards: &key.Forwards}
+)
+
+// listFlag parses comma separated values, it may be repeated. Values set
+// on the command line replace those of the config file.
+type listFlag struct {
+	values *[]string
+	set    bool
+}
+
+func (f *listFlag) String() string {
+	if f.values == nil {
+		return ""
+	}
+	return strings.Join(*f.values, ",")
+}
+
+func (f *listFlag) Set(s string) error {
+	if !f.set {
+		*f.values, f.set = nil, true
+	}
+	*f.values = append(*f.values, strings.Split(s, ",")...)
+	return nil
+}
+
+// serverUrlsFlag sets Key.ServerUrl to the first value and Key.ServerUrls
+// to the others, it may be repeated.
+type serverUrlsFlag struct {
+	key *engine.Key
+	set bool
+}
+
+func (f *serverUrlsFlag) String() string {
+	if f.key == nil {
+		return ""
+	}
+	return strings.Join(append([]string{f.key.ServerUrl}, f.key.ServerUrls...), ",")
+}
+
+func (f *serverUrlsFlag) Set(s string) error {
+	if !f.set {
+		f.key.ServerUrl, f.key.ServerUrls, f.set = s, nil, true
+		return nil
+	}
+	f.key.ServerUrls = append(f.key.ServerUrls, s)
+	return nil
+}
+
+// groupsFlag parses name=member,member groups, it may be repeated.
+type groupsFlag struct {
+	groups map[string][]string
+	set    bool
+}
+
+func (f *groupsFlag) String() string {
+	names := make([]string, 0, len(f.groups))
+	for name := range f.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func (f *groupsFlag) Set(s string) error {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 {
+		return fmt.Errorf("invalid group %q, want name=member,member", s)
+	}
+	if !f.set {
+		for name := range f.groups {
+			delete(f.groups, name)
+		}
+		f.set = true
+	}
+	f.groups[s[:i]] = append(f.groups[s[:i]], strings.Split(s[i+1:], ",")...)
+	return nil
+}
+
+// policyFlag parses a policy rule, it may be repeated.
+type policyFlag struct {
+	rules *[]policy.Rule
+	set   bool
+}
+
+func (f *policyFlag) String() string {
+	if f.rules == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d rules", len(*f.rules))
+}
+
+func (f *policyFlag) Set(s string) error {
+	r, err := policy.ParseRule(s)
+	if err != nil {
+		return err
+	}
+	if !f.set {
+		*f.rules, f.set = nil, true
+	}
+	*f.rules = append(*f.rules, r)
+	return nil
+}
+
+// forwardsFlag parses listen=fingerprint:port forwards, it may be repeated.
+type forwardsFlag struct {
+	forwards *[]engine.Forward
+	set      bool
+}
+
+func (f *forwardsFlag) String() string {
+	if f.forwards == nil {
+		return ""
+	}
+	forwards := make([]string, 0, len(*f.forwards))
+	for _, fw := range *f.forwards {
+		forwards = append(forwards, fw.Listen+"="+fw.Target)
+	}
+	return strings.Join(forwards, ",")
+}
+
+func (f *forwardsFlag) Set(s string) error {
+	fw, err := engine.ParseForward(s)
+	if err != nil {
+		return err
+	}
+	if !f.set {
+		*f.forwards, f.set = nil, true
+	}
+	*f.forwards = append(*f.forwards, fw)
+	return nil
+}
+
+// usersFlag parses comma separated user:pass pairs.
+type usersFlag struct {
+	users *[]socks5.User
+	set   bool
+}
+
+func (f *usersFlag) String() string {
+	if f.users == nil {
+		return ""
+	}
+	users := make([]string, 0, len(*f.users))
+	for _, u := range *f.users {
+		users = append(users, u.Username+":***")
+	}
+	return strings.Join(users, ",")
+}
+
+func (f *usersFlag) Set(s string) error {
+	if !f.set {
+		*f.users, f.set = nil, true
+	}
+	for _, pair := range strings.Split(s, ",") {
+		i := strings.IndexByte(pair, ':')
+		if i <= 0 {
+			return fmt.Errorf("invalid user %q, want user:pass", pair)
+		}
+		*f.users = append(*f.users, socks5.User{Username: pair[:i], Password: pair[i+1:]})
+	}
+	return nil
+}
 
 func init() {
-	flag.StringVar(&key.SocksAddr, "socks-addr", ":1081", "socks addr to bind")
-	flag.StringVar(&key.ServerUrl, "server-url", "", "server url to complete handshake")
-	flag.StringVar(&key.Fingerprint, "fingerprint", "", "fingerprint to register")
+	// The config file provides the defaults of the flags below.
+	if path := config.PathFromArgs(os.Args[1:]); path != "" {
+		if err := config.Load(path, cfg); err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+	}
+	if key.Groups == nil {
+		key.Groups = make(map[string][]string)
+	}
+
+	flag.StringVar(&configPath, "config", "", "yaml config file, flags override its values")
+	flag.BoolVar(&checkConfig, "check-config", false, "validate the config and exit")
+	flag.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "log level: debug, info, warn or error")
+	flag.StringVar(&key.SocksAddr, "socks-addr", key.SocksAddr, "socks addr to bind")
+	flag.StringVar(&key.HTTPAddr, "http-addr", key.HTTPAddr, "http proxy addr to bind, disabled if empty")
+	flag.Var(&serverUrlsFlag{key: key}, "server-url", "server url, http:// or the server multiaddr as libp2p://, may be repeated with the servers of its cluster to fail over to")
+	flag.StringVar(&key.Fingerprint, "fingerprint", key.Fingerprint, "fingerprint to register")
+	flag.StringVar(&key.Network, "network", key.Network, "network to join on the server, the default one if empty")
+	flag.StringVar(&key.KeyFile, "key-file", key.KeyFile, "identity key file, generated if missing")
+	flag.StringVar(&exportKey, "export-key", "", "write the identity key to this file (- for stdout) and exit")
+	flag.StringVar(&importKey, "import-key", "", "store the identity key read from this file (- for stdin) and exit")
+	flag.Var(&listFlag{values: &key.ListenAddrs}, "listen-addr", "libp2p listen multiaddrs, may be repeated")
+	flag.BoolVar(&key.NoRelay, "no-relay", key.NoRelay, "disable circuit relay")
+	flag.BoolVar(&key.MDNS, "mdns", key.MDNS, "find the peers of the network on the LAN over mDNS")
+	flag.BoolVar(&key.NoDHT, "no-dht", key.NoDHT, "do not join the DHT that lookups fall back to when no server answers")
+	flag.Var(forwards, "forward", "port forward like 127.0.0.1:5432=db-box:5432, may be repeated")
+	flag.DurationVar(&key.DrainTimeout, "drain-timeout", key.DrainTimeout, "how long to wait for connections on shutdown, 10s if zero")
+	flag.DurationVar(&key.LeaseTTL, "lease-ttl", key.LeaseTTL, "registration lease renewed by heartbeats, 90s if zero")
+	flag.StringVar(&key.TunName, "tun", key.TunName, "tun device name, enables TUN mode")
+	flag.IntVar(&key.TunMTU, "tun-mtu", key.TunMTU, "tun device mtu")
+	flag.StringVar(&key.DNSAddr, "dns-addr", key.DNSAddr, "dns server address resolving <fingerprint>.<dns-suffix> to fake ips, disabled if empty")
+	flag.StringVar(&key.DNSSuffix, "dns-suffix", key.DNSSuffix, "domain of the fingerprints served by the dns server, p2p if empty")
+	flag.StringVar(&key.FakeIPRange, "fake-ip-range", key.FakeIPRange, "ipv4 range of the fake ips, 198.18.0.0/15 if empty")
+	flag.Var(&usersFlag{users: &key.Users}, "auth", "user:pass pairs required by local proxies, separated by comma")
+	flag.Var(&groupsFlag{groups: key.Groups}, "group", "peer group like team-ops=fingerprint,peer-id, may be repeated")
+	flag.Var(&listFlag{values: &key.AllowPeers}, "allow-peer", "peer id, fingerprint or group:<name> allowed to open streams, all if unset")
+	flag.Var(&policyFlag{rules: &key.Policy}, "policy", `exit policy rule like "allow cidr=127.0.0.1/32 port=22", may be repeated`)
 	flag.Parse()
 }
 
 func main() {
+	if ok, id, err := identity.Run(key.KeyFile, exportKey, importKey); ok {
+		if err != nil {
+			log.Fatalf("Failed to transfer key: %v", err)
+		}
+		if id != "" {
+			fmt.Fprintf(os.Stderr, "Imported key of peer %s to %s\n", id, key.KeyFile)
+		}
+		return
+	}
+
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+	if checkConfig {
+		fmt.Println("config ok")
+		return
+	}
+
+	level, _ := logging.LevelFromString(cfg.LogLevel)
+	log.SetAllLoggers(level)
+
 	engine.Insert(key)
 
 	checkErr := func(msg string, f func() error) {
@@ -32,6 +265,44 @@ func main() {
 	defer checkErr("stop engine", engine.Stop)
 
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	<-sigCh
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigCh {
+		if sig != syscall.SIGHUP {
+			return
+		}
+		if err := reloadForwards(); err != nil {
+			log.Errorf("Failed to reload forwards: %v", err)
+		}
+	}
+}
+
+// reloadForwards applies the forwards of the config file to the running
+// engine, unless flags override them.
+func reloadForwards() error {
+	if configPath == "" || forwards.set {
+		return nil
+	}
+	reloaded := config.DefaultClient()
+	if err := config.Load(configPath, reloaded); err != nil {
+		return err
+	}
+
+	want := make(map[engine.Forward]bool)
+	for _, f := range reloaded.Forwards {
+		want[f] = true
+	}
+	for _, f := range engine.Forwards() {
+		if !want[f] {
+			if err := engine.RemoveForward(f.Listen); err != nil {
+				return err
+			}
+		}
+		delete(want, f)
+	}
+	for f := range want {
+		if err := engine.AddForward(f); err != nil {
+			return err
+		}
+	}
+	return nil
 }
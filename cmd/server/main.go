@@ -1,39 +1,383 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p/p2p/host/relay"
+	"github.com/lp2p/p2pvpn/config"
 	"github.com/lp2p/p2pvpn/constant"
 	"github.com/lp2p/p2pvpn/core"
+	"github.com/lp2p/p2pvpn/identity"
 	"github.com/lp2p/p2pvpn/log"
 	"github.com/lp2p/p2pvpn/server"
+	"gopkg.in/yaml.v2"
 )
 
+const (
+	// janitorInterval is how often expired leases are removed.
+	janitorInterval = 10 * time.Second
+	// clusterInterval is how often the route table is synced with the
+	// cluster peers.
+	clusterInterval = 5 * time.Second
+)
+
+var (
+	cfg = config.DefaultServer()
+
+	configPath  string
+	checkConfig bool
+	exportKey   string
+	importKey   string
+	backupTo    string
+	restoreFrom string
+	issueToken  string
+	approve     string
+	release     string
+	network     string
+)
+
+// listFlag parses comma separated values, it may be repeated. Values set
+// on the command line replace those of the config file.
+type listFlag struct {
+	values *[]string
+	set    bool
+}
+
+func (f *listFlag) String() string {
+	if f.values == nil {
+		return ""
+	}
+	return strings.Join(*f.values, ",")
+}
+
+func (f *listFlag) Set(s string) error {
+	if !f.set {
+		*f.values, f.set = nil, true
+	}
+	*f.values = append(*f.values, strings.Split(s, ",")...)
+	return nil
+}
+
 func init() {
 	// Reset delay, so we can advertise ourselves immediately
 	relay.BootDelay = 1 * time.Second
 	relay.AdvertiseBootDelay = 100 * time.Millisecond
+
+	// The config file provides the defaults of the flags below.
+	if path := config.PathFromArgs(os.Args[1:]); path != "" {
+		if err := config.Load(path, cfg); err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+	}
+
+	flag.StringVar(&configPath, "config", "", "yaml config file, flags override its values")
+	flag.BoolVar(&checkConfig, "check-config", false, "validate the config and exit")
+	flag.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "log level: debug, info, warn or error")
+	flag.IntVar(&cfg.APIPort, "api-port", cfg.APIPort, "HTTP api service port, 0 to serve the api over libp2p only")
+	flag.StringVar(&cfg.Secret, "secret", cfg.Secret, "api auth secret")
+	flag.StringVar(&cfg.KeyFile, "key-file", cfg.KeyFile, "identity key file, generated if missing")
+	flag.StringVar(&exportKey, "export-key", "", "write the identity key to this file (- for stdout) and exit")
+	flag.StringVar(&importKey, "import-key", "", "store the identity key read from this file (- for stdin) and exit")
+	flag.Var(&listFlag{values: &cfg.ListenAddrs}, "listen-addr", "libp2p listen multiaddrs, may be repeated")
+	flag.StringVar(&cfg.Store, "store", cfg.Store, "route table database file, in memory if empty")
+	flag.StringVar(&cfg.Tokens, "tokens", cfg.Tokens, "client tokens file, reloaded on SIGHUP")
+	flag.StringVar(&cfg.AdminTokens, "admin-tokens", cfg.AdminTokens, "admin tokens file, reloaded on SIGHUP")
+	flag.Var(&listFlag{values: &cfg.ClusterPeers}, "cluster-peer", "api url of another server of the cluster, may be repeated")
+	flag.StringVar(&cfg.ClusterSecret, "cluster-secret", cfg.ClusterSecret, "secret shared by the servers of the cluster")
+	flag.Var(&listFlag{values: &cfg.TrustedProxies}, "trusted-proxy", "reverse proxy ip or cidr trusted to forward client addresses, may be repeated")
+	flag.StringVar(&issueToken, "issue-token", "", "print a new token with this id for the tokens file and exit")
+	flag.StringVar(&backupTo, "backup", "", "write a backup of the store to this file (- for stdout) and exit")
+	flag.StringVar(&restoreFrom, "restore", "", "replace the store by a backup read from this file (- for stdin) and exit")
+	flag.StringVar(&approve, "approve-rebind", "", "let peer take fingerprint over from its owner, as fingerprint=peerid, and exit")
+	flag.StringVar(&release, "release-fingerprint", "", "forget the owner of this fingerprint and exit")
+	flag.StringVar(&network, "network", server.DefaultNetwork, "network of -issue-token, -approve-rebind and -release-fingerprint, the default one if empty")
+	flag.Parse()
 }
 
 func main() {
-	log.SetAllLoggers(logging.LevelWarn)
+	if flag.Arg(0) == "admin" {
+		if err := runAdmin(flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	apiPort := flag.Int("api-port", 8000, "api service port")
-	secret := flag.String("secret", constant.DefaultSecret, "api auth secret")
-	flag.Parse()
+	if ok, id, err := identity.Run(cfg.KeyFile, exportKey, importKey); ok {
+		if err != nil {
+			log.Fatalf("Failed to transfer key: %v", err)
+		}
+		if id != "" {
+			fmt.Fprintf(os.Stderr, "Imported key of peer %s to %s\n", id, cfg.KeyFile)
+		}
+		return
+	}
+
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+	if checkConfig {
+		fmt.Println("config ok")
+		return
+	}
+
+	if issueToken != "" {
+		if err := printToken(issueToken); err != nil {
+			log.Fatalf("Failed to issue token: %v", err)
+		}
+		return
+	}
+
+	if backupTo != "" || restoreFrom != "" {
+		if err := runBackup(); err != nil {
+			log.Fatalf("Failed to back up or restore the store: %v", err)
+		}
+		return
+	}
+
+	if approve != "" || release != "" {
+		if err := runBinding(); err != nil {
+			log.Fatalf("Failed to change fingerprint owner: %v", err)
+		}
+		return
+	}
+
+	level, _ := logging.LevelFromString(cfg.LogLevel)
+	log.SetAllLoggers(level)
+
+	priv, created, err := identity.LoadOrGenerate(cfg.KeyFile)
+	if err != nil {
+		log.Fatalf("Failed to load identity: %v", err)
+	}
+	if created {
+		log.Infof("Generated new identity at: %s", cfg.KeyFile)
+	}
+
+	tabs, err := openTables()
+	if err != nil {
+		log.Fatalf("Failed to open store: %v", err)
+	}
+	tab := tabs[server.DefaultNetwork]
+	// Closing the default table closes the store shared by all.
+	defer tab.Close()
 
-	api := server.NewDefaultAPIService(fmt.Sprintf(":%d", *apiPort), *secret)
-	go api.Run()
-	go core.NewServerHost(*apiPort, *secret)
+	stop := make(chan struct{})
+	defer close(stop)
+	for _, t := range tabs {
+		go t.RunJanitor(janitorInterval, stop)
+	}
+
+	// With a tokens file every client signs with its own token, the shared
+	// secrets, the default one is public, are no longer accepted.
+	secret := cfg.Secret
+	if cfg.Tokens != "" {
+		if secret != "" && secret != constant.DefaultSecret {
+			log.Warnf("Shared secret ignored, clients must use a token of %s", cfg.Tokens)
+		}
+		secret = ""
+	}
+	api := server.NewDefaultAPIService(tab, fmt.Sprintf(":%d", cfg.APIPort), secret)
+	if err := api.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatalf("Failed to set trusted proxies: %v", err)
+	}
+	for _, n := range cfg.Networks {
+		if cfg.Tokens != "" {
+			n.Secret = ""
+		}
+		if err := api.AddNetwork(n, tabs[n.Name]); err != nil {
+			log.Fatalf("Failed to add network: %v", err)
+		}
+	}
+	loadTokens := func() error {
+		var tokens []server.Token
+		if cfg.Tokens != "" {
+			var err error
+			if tokens, err = server.LoadTokens(cfg.Tokens); err != nil {
+				return err
+			}
+		}
+		api.SetTokens(tokens)
+
+		var adminTokens []server.Token
+		if cfg.AdminTokens != "" {
+			var err error
+			if adminTokens, err = server.LoadTokens(cfg.AdminTokens); err != nil {
+				return err
+			}
+		}
+		api.SetAdminTokens(adminTokens)
+		return nil
+	}
+	if err := loadTokens(); err != nil {
+		log.Fatalf("Failed to load tokens: %v", err)
+	}
+
+	api.SetClusterSecret(cfg.ClusterSecret)
+	if len(cfg.ClusterPeers) > 0 {
+		for name, t := range tabs {
+			go server.NewCluster(name, t, cfg.ClusterPeers, cfg.ClusterSecret).Run(clusterInterval, stop)
+		}
+	}
+
+	serverID, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		log.Fatalf("Failed to get server ID: %v", err)
+	}
+	api.SetServerID(serverID)
+
+	// The api is served over the libp2p host, the HTTP one is optional.
+	if cfg.APIPort != 0 {
+		go api.Run()
+	}
+	go core.NewServerHost(api, tab, priv, cfg.ListenAddrs)
 
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	<-sigCh
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigCh {
+		if sig != syscall.SIGHUP {
+			return
+		}
+		// Revoked or removed tokens, admin ones too, are refused from now
+		// on.
+		if err := loadTokens(); err != nil {
+			log.Errorf("Failed to reload tokens: %v", err)
+		} else {
+			log.Warnf("Reloaded tokens from %s", cfg.Tokens)
+		}
+	}
+}
+
+// printToken prints a new token as an entry of the tokens file, with the
+// server url clients use it in.
+func printToken(id string) error {
+	t, err := server.NewToken(id)
+	if err != nil {
+		return err
+	}
+	t.Network = network
+	out, err := yaml.Marshal([]server.Token{t})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("# Add to the tokens file, clients use -server-url http://%s:%s@<server>:%d or libp2p://%[1]s:%[2]s@<server multiaddr>", t.ID, t.Secret, cfg.APIPort)
+	if network != server.DefaultNetwork {
+		fmt.Printf(" -network %s", network)
+	}
+	fmt.Printf("\n%s", out)
+	return nil
+}
+
+// openTables opens the route tables of the default network and of
+// cfg.Networks, by name, from cfg.Store. Closing the default table closes
+// the store.
+func openTables() (map[string]*server.Table, error) {
+	var storage server.Storage = server.NewMemoryStorage()
+	if cfg.Store != "" {
+		var err error
+		if storage, err = server.OpenBoltStorage(cfg.Store); err != nil {
+			return nil, err
+		}
+	}
+
+	names := append([]string{server.DefaultNetwork}, networkNames()...)
+	tabs := make(map[string]*server.Table, len(names))
+	for _, name := range names {
+		tab, err := server.NewTable(server.NetworkStorage(storage, name))
+		if err != nil {
+			_ = storage.Close()
+			return nil, fmt.Errorf("network %q: %w", name, err)
+		}
+		tabs[name] = tab
+	}
+	return tabs, nil
+}
+
+// networkNames returns the names of cfg.Networks.
+func networkNames() []string {
+	var names []string
+	for _, n := range cfg.Networks {
+		names = append(names, n.Name)
+	}
+	return names
+}
+
+// runBackup backs up or restores cfg.Store, the server must not be running.
+func runBackup() error {
+	if cfg.Store == "" {
+		return errors.New("no store configured")
+	}
+	if backupTo != "" && restoreFrom != "" {
+		return errors.New("backup and restore are exclusive")
+	}
+
+	storage, err := server.OpenBoltStorage(cfg.Store)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	if backupTo != "" {
+		w := io.Writer(os.Stdout)
+		if backupTo != "-" {
+			f, err := os.OpenFile(backupTo, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		return server.Backup(storage, w, networkNames()...)
+	}
+
+	r := io.Reader(os.Stdin)
+	if restoreFrom != "-" {
+		f, err := os.Open(restoreFrom)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	return server.Restore(storage, r, networkNames()...)
+}
+
+// runBinding approves a rebind or releases a fingerprint in cfg.Store, the
+// server must not be running.
+func runBinding() error {
+	if cfg.Store == "" {
+		return errors.New("no store configured")
+	}
+	tabs, err := openTables()
+	if err != nil {
+		return err
+	}
+	defer tabs[server.DefaultNetwork].Close()
+
+	tab, ok := tabs[network]
+	if !ok {
+		return fmt.Errorf("unknown network %q", network)
+	}
+
+	if release != "" {
+		return tab.Release(release)
+	}
+	i := strings.IndexByte(approve, '=')
+	if i < 0 {
+		return fmt.Errorf("invalid rebind %q, want fingerprint=peerid", approve)
+	}
+	id, err := peer.Decode(approve[i+1:])
+	if err != nil {
+		return err
+	}
+	return tab.ApproveRebind(approve[:i], id)
 }
@@ -0,0 +1,254 @@
+// Package auth signs API requests with per-client credentials and verifies
+// them. A signature covers the method, the URI, a timestamp, a nonce and the
+// body, so a captured request can neither be altered nor replayed to the
+// same Verifier. Verifiers do not share their nonces: a request captured
+// on its way to one server of a cluster can be replayed to another one
+// within MaxSkew.
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Headers of a signed request.
+const (
+	HeaderCredential = "X-P2pvpn-Credential"
+	HeaderTimestamp  = "X-P2pvpn-Timestamp"
+	HeaderNonce      = "X-P2pvpn-Nonce"
+	HeaderSignature  = "X-P2pvpn-Signature"
+)
+
+// MaxSkew is how far the timestamp of a request may be from the clock of
+// the server, nonces are remembered for twice as long.
+const MaxSkew = 5 * time.Minute
+
+// maxNonces bounds the nonces remembered, requests beyond it are refused
+// until old nonces expire.
+const maxNonces = 1 << 20
+
+// DefaultMaxBodyLen is the largest body a Verifier reads, see
+// SetMaxBodyLen.
+const DefaultMaxBodyLen = 1 << 20
+
+var (
+	ErrUnsigned         = errors.New("auth: request is not signed")
+	ErrUnknown          = errors.New("auth: unknown or revoked credential")
+	ErrExpired          = errors.New("auth: timestamp out of range")
+	ErrReplayed         = errors.New("auth: nonce already used")
+	ErrInvalidSignature = errors.New("auth: invalid signature")
+	ErrTooLarge         = errors.New("auth: body too large")
+)
+
+// Credential is an ID and the secret it signs with. The empty ID stands
+// for the shared secret of the server.
+type Credential struct {
+	ID     string
+	Secret string
+}
+
+// NewSecret returns a random secret for a new credential.
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// ParseURL splits a server url into its base, scheme and host, and the
+// credential in its user info: "id:secret" is a token, a user name alone is
+// the shared secret, and defaultSecret is used when there is none.
+func ParseURL(raw, defaultSecret string) (string, Credential, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", Credential{}, err
+	}
+
+	c := Credential{Secret: defaultSecret}
+	if secret, ok := u.User.Password(); ok {
+		c = Credential{ID: u.User.Username(), Secret: secret}
+	} else if u.User.Username() != "" {
+		c = Credential{Secret: u.User.Username()}
+	}
+	return fmt.Sprintf("%s://%s", u.Scheme, u.Host), c, nil
+}
+
+// Sign signs req with c, the body is read and replaced.
+func Sign(req *http.Request, c Credential) error {
+	body, err := readBody(req, 0)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	nonceHex := hex.EncodeToString(nonce)
+
+	req.Header.Set(HeaderCredential, c.ID)
+	req.Header.Set(HeaderTimestamp, ts)
+	req.Header.Set(HeaderNonce, nonceHex)
+	req.Header.Set(HeaderSignature, signature(c.Secret, req, ts, nonceHex, body))
+	return nil
+}
+
+func signature(secret string, req *http.Request, ts, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%x", req.Method, req.URL.RequestURI(), ts, nonce, bodyHash)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// readBody reads and replaces the body of req, of at most max bytes
+// unless max is zero.
+func readBody(req *http.Request, max int64) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	r := req.Body
+	if max > 0 {
+		r = http.MaxBytesReader(nil, r, max)
+	}
+	body, err := io.ReadAll(r)
+	_ = req.Body.Close()
+	if max > 0 && int64(len(body)) == max && err != nil {
+		return nil, ErrTooLarge
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return body, nil
+}
+
+// Verifier checks signed requests against a set of credentials and
+// remembers nonces to refuse replays.
+type Verifier struct {
+	mx        sync.Mutex
+	secrets   map[string]string
+	nonces    map[string]time.Time
+	lastPrune time.Time
+	maxBody   int64
+	now       func() time.Time
+}
+
+// NewVerifier creates a Verifier accepting credentials.
+func NewVerifier(credentials []Credential) *Verifier {
+	v := &Verifier{
+		nonces:  make(map[string]time.Time),
+		maxBody: DefaultMaxBodyLen,
+		now:     time.Now,
+	}
+	v.SetCredentials(credentials)
+	return v
+}
+
+// SetMaxBodyLen sets the largest body read to check a signature, requests
+// with larger ones are refused with ErrTooLarge.
+func (v *Verifier) SetMaxBodyLen(n int64) {
+	v.mx.Lock()
+	v.maxBody = n
+	v.mx.Unlock()
+}
+
+// SetCredentials replaces the accepted credentials, requests signed by
+// other ones are refused from now on.
+func (v *Verifier) SetCredentials(credentials []Credential) {
+	secrets := make(map[string]string, len(credentials))
+	for _, c := range credentials {
+		secrets[c.ID] = c.Secret
+	}
+
+	v.mx.Lock()
+	v.secrets = secrets
+	v.mx.Unlock()
+}
+
+// Verify checks the signature of req and returns the ID of its credential.
+// The body is read and replaced.
+func (v *Verifier) Verify(req *http.Request) (string, error) {
+	id := req.Header.Get(HeaderCredential)
+	ts := req.Header.Get(HeaderTimestamp)
+	nonce := req.Header.Get(HeaderNonce)
+	sig := req.Header.Get(HeaderSignature)
+	if ts == "" || nonce == "" || sig == "" {
+		return "", ErrUnsigned
+	}
+
+	v.mx.Lock()
+	secret, ok := v.secrets[id]
+	maxBody := v.maxBody
+	v.mx.Unlock()
+	if !ok {
+		return "", ErrUnknown
+	}
+
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "", ErrExpired
+	}
+	now := v.now()
+	t := time.Unix(unix, 0)
+	if t.Before(now.Add(-MaxSkew)) || t.After(now.Add(MaxSkew)) {
+		return "", ErrExpired
+	}
+
+	body, err := readBody(req, maxBody)
+	if err != nil {
+		return "", err
+	}
+	want := signature(secret, req, ts, nonce, body)
+	if !hmac.Equal([]byte(sig), []byte(want)) {
+		return "", ErrInvalidSignature
+	}
+
+	// Only valid signatures reach the nonce cache, so it can not be
+	// filled by unauthenticated clients.
+	if err := v.useNonce(id+"/"+nonce, now); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (v *Verifier) useNonce(key string, now time.Time) error {
+	v.mx.Lock()
+	defer v.mx.Unlock()
+
+	if now.Sub(v.lastPrune) > MaxSkew || len(v.nonces) >= maxNonces {
+		v.lastPrune = now
+		for k, expires := range v.nonces {
+			if now.After(expires) {
+				delete(v.nonces, k)
+			}
+		}
+	}
+
+	if _, ok := v.nonces[key]; ok {
+		return ErrReplayed
+	}
+	if len(v.nonces) >= maxNonces {
+		return ErrReplayed
+	}
+	// A request signed now is valid until MaxSkew after its timestamp,
+	// which is at most MaxSkew from now.
+	v.nonces[key] = now.Add(2 * MaxSkew)
+	return nil
+}
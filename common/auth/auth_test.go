@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRequest(t *testing.T, c Credential, body string) *http.Request {
+	req, err := http.NewRequest(http.MethodPost, "http://server/routing/cid?x=1", strings.NewReader(body))
+	require.NoError(t, err)
+	require.NoError(t, Sign(req, c))
+	return req
+}
+
+func TestVerify(t *testing.T) {
+	laptop := Credential{ID: "laptop", Secret: "s3cret"}
+	v := NewVerifier([]Credential{laptop, {Secret: "shared"}})
+
+	req := newRequest(t, laptop, "id=1")
+	id, err := v.Verify(req)
+	require.NoError(t, err)
+	assert.Equal(t, "laptop", id)
+
+	// The same request can not be used twice.
+	req.Body, _ = req.GetBody()
+	_, err = v.Verify(req)
+	assert.ErrorIs(t, err, ErrReplayed)
+
+	id, err = v.Verify(newRequest(t, Credential{Secret: "shared"}, ""))
+	require.NoError(t, err)
+	assert.Equal(t, "", id)
+
+	_, err = v.Verify(newRequest(t, Credential{ID: "laptop", Secret: "wrong"}, ""))
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+
+	_, err = v.Verify(newRequest(t, Credential{ID: "desktop", Secret: "s3cret"}, ""))
+	assert.ErrorIs(t, err, ErrUnknown)
+
+	unsigned, _ := http.NewRequest(http.MethodGet, "http://server/", nil)
+	_, err = v.Verify(unsigned)
+	assert.ErrorIs(t, err, ErrUnsigned)
+}
+
+func TestVerifyTampered(t *testing.T) {
+	laptop := Credential{ID: "laptop", Secret: "s3cret"}
+	v := NewVerifier([]Credential{laptop})
+
+	req := newRequest(t, laptop, "id=1")
+	req.Body = http.NoBody
+	_, err := v.Verify(req)
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+
+	req = newRequest(t, laptop, "")
+	req.URL.Path = "/fingerprints/other"
+	_, err = v.Verify(req)
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+}
+
+func TestVerifyExpiredAndRevoked(t *testing.T) {
+	laptop := Credential{ID: "laptop", Secret: "s3cret"}
+	v := NewVerifier([]Credential{laptop})
+
+	req := newRequest(t, laptop, "")
+	v.now = func() time.Time { return time.Now().Add(MaxSkew + time.Minute) }
+	_, err := v.Verify(req)
+	assert.ErrorIs(t, err, ErrExpired)
+
+	v.now = time.Now
+	v.SetCredentials(nil)
+	_, err = v.Verify(newRequest(t, laptop, ""))
+	assert.ErrorIs(t, err, ErrUnknown)
+}
+
+func TestVerifyTooLarge(t *testing.T) {
+	laptop := Credential{ID: "laptop", Secret: "s3cret"}
+	v := NewVerifier([]Credential{laptop})
+	v.SetMaxBodyLen(8)
+
+	_, err := v.Verify(newRequest(t, laptop, "id=12345"))
+	require.NoError(t, err)
+	_, err = v.Verify(newRequest(t, laptop, "id=123456"))
+	assert.ErrorIs(t, err, ErrTooLarge)
+}
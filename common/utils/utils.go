@@ -1,8 +1,6 @@
 package utils
 
 import (
-	"crypto/md5"
-	"encoding/hex"
 	"io"
 	"net/http"
 	"strings"
@@ -41,9 +39,3 @@ func GetPublicIP() string {
 	ip = strings.TrimRight(ip, "\n")
 	return ip
 }
-
-func Md5(secret string) string {
-	hash := md5.New()
-	hash.Write([]byte(secret))
-	return hex.EncodeToString(hash.Sum(nil))
-}
@@ -0,0 +1,246 @@
+// Package config loads the YAML config files of p2pvpn-client and
+// p2pvpn-server.
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/lp2p/p2pvpn/api/route"
+	"github.com/lp2p/p2pvpn/constant"
+	"github.com/lp2p/p2pvpn/engine"
+	"github.com/lp2p/p2pvpn/identity"
+	"github.com/lp2p/p2pvpn/policy"
+	"github.com/lp2p/p2pvpn/server"
+	ma "github.com/multiformats/go-multiaddr"
+	"gopkg.in/yaml.v2"
+)
+
+// Client is the config of p2pvpn-client.
+type Client struct {
+	engine.Key `yaml:",inline"`
+
+	// LogLevel is one of debug, info, warn, error.
+	LogLevel string `yaml:"log_level"`
+}
+
+// Server is the config of p2pvpn-server.
+type Server struct {
+	APIPort     int      `yaml:"api_port"`
+	Secret      string   `yaml:"secret"`
+	KeyFile     string   `yaml:"key_file"`
+	ListenAddrs []string `yaml:"listen_addrs"`
+	LogLevel    string   `yaml:"log_level"`
+
+	// Store is the database file of the route table, empty keeps the
+	// table in memory only.
+	Store string `yaml:"store,omitempty"`
+
+	// Tokens is the file of the tokens issued to clients. An empty Secret
+	// then only accepts tokens.
+	Tokens string `yaml:"tokens,omitempty"`
+
+	// AdminTokens is the file of the tokens of the admin API, in the
+	// format of Tokens. Without it the admin API refuses every request.
+	AdminTokens string `yaml:"admin_tokens,omitempty"`
+
+	// ClusterPeers are the urls of the other servers the route table is
+	// replicated with, they all share ClusterSecret.
+	ClusterPeers  []string `yaml:"cluster_peers,omitempty"`
+	ClusterSecret string   `yaml:"cluster_secret,omitempty"`
+
+	// TrustedProxies are the reverse proxies, as IPs or CIDRs, whose
+	// X-Forwarded-For and X-Real-Ip headers tell the address of clients.
+	TrustedProxies []string `yaml:"trusted_proxies,omitempty"`
+
+	// Networks are the virtual networks served besides the default one,
+	// each with its peers, fingerprints and credentials.
+	Networks []server.Network `yaml:"networks,omitempty"`
+}
+
+// DefaultClient returns the client config used without a file.
+func DefaultClient() *Client {
+	return &Client{
+		Key: engine.Key{
+			SocksAddr:   ":1081",
+			KeyFile:     identity.DefaultPath("client.key"),
+			ListenAddrs: engine.DefaultListenAddrs,
+			TunMTU:      1500,
+		},
+		LogLevel: "info",
+	}
+}
+
+// DefaultServer returns the server config used without a file.
+func DefaultServer() *Server {
+	return &Server{
+		APIPort:     8000,
+		Secret:      constant.DefaultSecret,
+		KeyFile:     identity.DefaultPath("server.key"),
+		ListenAddrs: []string{"/ip4/0.0.0.0/tcp/0"},
+		LogLevel:    "warn",
+	}
+}
+
+// Load decodes the file at path over v, keys it does not know are errors.
+func Load(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := yaml.UnmarshalStrict(data, v); err != nil {
+		return fmt.Errorf("config: %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate checks c the way the engine would on start, without starting.
+func (c *Client) Validate() error {
+	if c.ServerUrl == "" {
+		return fmt.Errorf("config: server_url is required")
+	}
+	for _, u := range append([]string{c.ServerUrl}, c.ServerUrls...) {
+		if _, err := route.ParseServer(u, ""); err != nil {
+			return fmt.Errorf("config: server_url: %w", err)
+		}
+	}
+	if c.Fingerprint == "" {
+		return fmt.Errorf("config: fingerprint is required")
+	}
+	if c.Network != server.DefaultNetwork {
+		if err := server.ValidateNetwork(c.Network); err != nil {
+			return fmt.Errorf("config: %w", err)
+		}
+	}
+	if err := validateListenAddrs(c.ListenAddrs); err != nil {
+		return err
+	}
+	if err := validateLogLevel(c.LogLevel); err != nil {
+		return err
+	}
+	for _, f := range c.Forwards {
+		if err := f.Validate(); err != nil {
+			return fmt.Errorf("config: %w", err)
+		}
+	}
+	if c.FakeIPRange != "" {
+		if _, n, err := net.ParseCIDR(c.FakeIPRange); err != nil || n.IP.To4() == nil {
+			return fmt.Errorf("config: invalid fake_ip_range %q", c.FakeIPRange)
+		}
+	}
+	if c.DNSAddr != "" {
+		if _, _, err := net.SplitHostPort(c.DNSAddr); err != nil {
+			return fmt.Errorf("config: dns_addr: %w", err)
+		}
+	}
+	for _, u := range c.Users {
+		if u.Username == "" {
+			return fmt.Errorf("config: user with empty username")
+		}
+	}
+
+	peers, err := policy.NewMatcher(c.Groups, nil)
+	if err != nil {
+		return fmt.Errorf("config: groups: %w", err)
+	}
+	if err := peers.Validate(c.AllowPeers); err != nil {
+		return fmt.Errorf("config: allow_peers: %w", err)
+	}
+	if _, err := policy.New(c.Policy, peers); err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	return nil
+}
+
+// Validate checks c the way the server would on start, without starting.
+func (s *Server) Validate() error {
+	if s.APIPort < 0 || s.APIPort > 65535 {
+		return fmt.Errorf("config: invalid api_port %d", s.APIPort)
+	}
+	if err := validateListenAddrs(s.ListenAddrs); err != nil {
+		return err
+	}
+	if len(s.ClusterPeers) > 0 && s.ClusterSecret == "" {
+		return fmt.Errorf("config: cluster_peers need a cluster_secret")
+	}
+	if len(s.ClusterPeers) > 0 && s.APIPort == 0 {
+		return fmt.Errorf("config: cluster_peers need an api_port")
+	}
+	for _, peer := range s.ClusterPeers {
+		if u, err := url.Parse(peer); err != nil || u.Host == "" {
+			return fmt.Errorf("config: invalid cluster peer %q", peer)
+		}
+	}
+	if _, err := server.ParseTrustedProxies(s.TrustedProxies); err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	networks := map[string]bool{server.DefaultNetwork: true}
+	for _, n := range s.Networks {
+		if err := server.ValidateNetwork(n.Name); err != nil {
+			return fmt.Errorf("config: %w", err)
+		}
+		if networks[n.Name] {
+			return fmt.Errorf("config: duplicate network %q", n.Name)
+		}
+		networks[n.Name] = true
+	}
+	if s.Tokens != "" {
+		tokens, err := server.LoadTokens(s.Tokens)
+		if err != nil {
+			return fmt.Errorf("config: %w", err)
+		}
+		for _, t := range tokens {
+			if !networks[t.Network] {
+				return fmt.Errorf("config: token %s is of unknown network %q", t.ID, t.Network)
+			}
+		}
+	}
+	if s.AdminTokens != "" {
+		if _, err := server.LoadTokens(s.AdminTokens); err != nil {
+			return fmt.Errorf("config: %w", err)
+		}
+	}
+	return validateLogLevel(s.LogLevel)
+}
+
+func validateListenAddrs(addrs []string) error {
+	for _, s := range addrs {
+		if _, err := ma.NewMultiaddr(s); err != nil {
+			return fmt.Errorf("config: listen_addrs: %q: %w", s, err)
+		}
+	}
+	return nil
+}
+
+func validateLogLevel(level string) error {
+	if _, err := logging.LevelFromString(level); err != nil {
+		return fmt.Errorf("config: log_level: %w", err)
+	}
+	return nil
+}
+
+// PathFromArgs finds the value of the -config flag in args before the flags
+// are parsed, so the file can provide the flag defaults.
+func PathFromArgs(args []string) string {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name := strings.TrimLeft(arg, "-")
+		if strings.HasPrefix(name, "config=") {
+			return strings.TrimPrefix(name, "config=")
+		}
+		if name == "config" && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lp2p/p2pvpn/policy"
+	"github.com/lp2p/p2pvpn/transport/socks5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadClient(t *testing.T) {
+	path := writeFile(t, `
+server_url: http://secret@server:8000
+fingerprint: laptop
+http_addr: 127.0.0.1:8080
+listen_addrs: [/ip4/0.0.0.0/tcp/4001]
+users:
+  - username: alice
+    password: secret
+groups:
+  ops: [desktop]
+allow_peers: [group:ops]
+policy:
+  - action: allow
+    cidrs: [127.0.0.1/32]
+    ports: ["22"]
+    peers: [group:ops]
+log_level: error
+`)
+	c := DefaultClient()
+	require.NoError(t, Load(path, c))
+	require.NoError(t, c.Validate())
+
+	assert.Equal(t, ":1081", c.SocksAddr, "defaults are kept")
+	assert.Equal(t, "laptop", c.Fingerprint)
+	assert.Equal(t, []string{"/ip4/0.0.0.0/tcp/4001"}, c.ListenAddrs)
+	assert.Equal(t, []socks5.User{{Username: "alice", Password: "secret"}}, c.Users)
+	assert.Equal(t, policy.Allow, c.Policy[0].Action)
+	assert.Equal(t, "error", c.LogLevel)
+	assert.Equal(t, "info", DefaultClient().LogLevel)
+}
+
+func TestInvalidClient(t *testing.T) {
+	for _, content := range []string{
+		"fingerprint: laptop\nunknown_key: 1\n",
+		"server_url: http://server\n",
+		"server_url: http://server\nfingerprint: a\nallow_peers: [group:ops]\n",
+		"server_url: http://server\nfingerprint: a\npolicy: [{action: permit}]\n",
+		"server_url: http://server\nfingerprint: a\nlisten_addrs: [0.0.0.0:4001]\n",
+		"server_url: http://server\nfingerprint: a\nlog_level: loud\n",
+	} {
+		c := DefaultClient()
+		err := Load(writeFile(t, content), c)
+		if err == nil {
+			err = c.Validate()
+		}
+		assert.Error(t, err, content)
+	}
+}
+
+func TestLoadServer(t *testing.T) {
+	s := DefaultServer()
+	require.NoError(t, Load(writeFile(t, "api_port: 9000\nsecret: s3\n"), s))
+	require.NoError(t, s.Validate())
+	assert.Equal(t, 9000, s.APIPort)
+	assert.Equal(t, "warn", s.LogLevel)
+}
+
+func TestPathFromArgs(t *testing.T) {
+	assert.Equal(t, "a.yaml", PathFromArgs([]string{"-fingerprint", "x", "-config", "a.yaml"}))
+	assert.Equal(t, "b.yaml", PathFromArgs([]string{"--config=b.yaml"}))
+	assert.Equal(t, "", PathFromArgs([]string{"--", "-config", "c.yaml"}))
+}
@@ -5,3 +5,11 @@ package constant
 // this service. Streams are multiplexed and their protocol tag helps
 // libp2p handle them to the right handler functions.
 const Protocol = "/proxy/a8096acd-f0a2-c467-5701-161f6803735e"
+
+// UDPProtocol tags the streams carrying framed UDP datagrams of a SOCKS
+// UDP association.
+const UDPProtocol = "/proxy-udp/a8096acd-f0a2-c467-5701-161f6803735e"
+
+// RendezvousProtocol tags the streams of the server host carrying the HTTP
+// API, so clients reach the server by its multiaddr alone.
+const RendezvousProtocol = "/p2pvpn/rendezvous/1.0.0"
@@ -4,3 +4,16 @@ const RoutingUrl = "/routing/"
 const RoutingProviderUrl = "/routing_provider/"
 const FingerprintsUrl = "/fingerprints/"
 const ServerIDUrl = "/server_id/"
+const WatchUrl = "/watch"
+const AdminUrl = "/admin/"
+const ClusterSyncUrl = "/cluster/sync"
+
+// V1Url prefixes the urls above too, for clients naming the version.
+const V1Url = "/v1"
+
+// The v2 API takes and returns JSON bodies, errors carry a code.
+const V2PeersUrl = "/v2/peers/"
+const V2ProvidersUrl = "/v2/providers/"
+const V2FingerprintsUrl = "/v2/fingerprints/"
+const V2ServerIDUrl = "/v2/server_id"
+const V2WatchUrl = "/v2/watch"
@@ -20,3 +20,10 @@ type ConnContext struct {
 	Addr Addr
 	Conn Conn
 }
+
+// PacketConnContext carries UDP datagrams framed on Conn, Resolve maps the
+// requested destination of each datagram to the address to send it to.
+type PacketConnContext struct {
+	Conn    Conn
+	Resolve func(host, port string) (*net.UDPAddr, error)
+}
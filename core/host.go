@@ -2,36 +2,31 @@ package core
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
 	"strings"
 
 	"github.com/libp2p/go-libp2p"
 	circuit "github.com/libp2p/go-libp2p-circuit"
+	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/host"
-	"github.com/libp2p/go-libp2p-core/peer"
-	"github.com/libp2p/go-libp2p/p2p/host/relay"
-	"github.com/lp2p/p2pvpn/api/route"
 	"github.com/lp2p/p2pvpn/common/utils"
-	"github.com/lp2p/p2pvpn/constant"
 	"github.com/lp2p/p2pvpn/log"
 	"github.com/lp2p/p2pvpn/server"
 	ma "github.com/multiformats/go-multiaddr"
 	manet "github.com/multiformats/go-multiaddr/net"
 )
 
-// NewServerHost creates a libp2p host as relay.
-func NewServerHost(apiPort int, secret string) host.Host {
-	serverUrl := fmt.Sprintf("http://127.0.0.1:%d", apiPort)
-
+// NewServerHost creates a libp2p host as relay with identity priv,
+// listening on listenAddrs. It registers itself as relay in tab directly
+// and serves the api of its server over constant.RendezvousProtocol.
+func NewServerHost(api *server.APIService, tab *server.Table, priv crypto.PrivKey, listenAddrs []string) host.Host {
 	publicIP := utils.GetPublicIP()
 
 	h, err := libp2p.New(context.Background(),
-		libp2p.ListenAddrStrings("/ip4/0.0.0.0/tcp/0"),
+		libp2p.Identity(priv),
+		libp2p.ListenAddrStrings(listenAddrs...),
 		libp2p.EnableRelay(circuit.OptHop),
-		libp2p.Routing(route.MakeRouting(serverUrl, relay.RelayRendezvous, "", secret)),
+		libp2p.Routing(makeTableRouting(tab)),
 		libp2p.EnableAutoRelay(),
 		libp2p.EnableNATService(),
 		libp2p.AddrsFactory(func(addrs []ma.Multiaddr) []ma.Multiaddr {
@@ -58,29 +53,17 @@ func NewServerHost(apiPort int, secret string) host.Host {
 	)
 	if err != nil {
 		log.Errorf("%v", err)
+		return nil
 	}
 
-	err = route.Router().SetServerID()
-	if err != nil {
-		log.Errorf("%v", err)
+	go func() {
+		if err := api.ServeP2P(h); err != nil {
+			log.Errorf("Rendezvous protocol stopped: %v", err)
+		}
+	}()
+	for _, addr := range h.Addrs() {
+		log.Infof("Rendezvous server address: %s/p2p/%s", addr, h.ID())
 	}
 
 	return h
 }
-
-func registerServerID(serverUrl string, id peer.ID) error {
-	resp, err := http.Post(serverUrl+constant.ServerIDUrl+id.String(), "", nil)
-	if err != nil {
-		return err
-	}
-	res, err := io.ReadAll(resp.Body)
-	var respPtr server.StatusResp
-	err = json.Unmarshal(res, &respPtr)
-	if err != nil {
-		return err
-	}
-	if !respPtr.Status {
-		return fmt.Errorf("failed to register server id")
-	}
-	return nil
-}
@@ -0,0 +1,57 @@
+package core
+
+import (
+	"context"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/routing"
+	"github.com/lp2p/p2pvpn/server"
+)
+
+// tableRouting routes the server host with the route table of its own
+// server, it registers as relay without going through the API.
+type tableRouting struct {
+	h   host.Host
+	tab *server.Table
+}
+
+// makeTableRouting returns a function for libp2p.Routing using tab.
+func makeTableRouting(tab *server.Table) func(h host.Host) (routing.PeerRouting, error) {
+	return func(h host.Host) (routing.PeerRouting, error) {
+		return &tableRouting{h: h, tab: tab}, nil
+	}
+}
+
+// FindPeer implements routing.PeerRouting.
+func (r *tableRouting) FindPeer(_ context.Context, id peer.ID) (peer.AddrInfo, error) {
+	pi, err := r.tab.Find(id)
+	if err != nil {
+		return peer.AddrInfo{}, routing.ErrNotFound
+	}
+	return pi, nil
+}
+
+// Provide implements routing.ContentRouting.
+func (r *tableRouting) Provide(_ context.Context, c cid.Cid, bcast bool) error {
+	if !bcast {
+		return nil
+	}
+	pi := peer.AddrInfo{ID: r.h.ID(), Addrs: r.h.Addrs()}
+	return r.tab.Provide(c.String(), pi, "", nil, server.MaxLeaseTTL)
+}
+
+// FindProvidersAsync implements routing.ContentRouting.
+func (r *tableRouting) FindProvidersAsync(ctx context.Context, c cid.Cid, limit int) <-chan peer.AddrInfo {
+	pmap, _ := r.tab.FindProvider(c.String())
+	ch := make(chan peer.AddrInfo, len(pmap))
+	for _, pi := range pmap {
+		if limit > 0 && len(ch) >= limit {
+			break
+		}
+		ch <- pi
+	}
+	close(ch)
+	return ch
+}
@@ -0,0 +1,15 @@
+// Package device defines the packet devices used by the TUN mode.
+package device
+
+import "io"
+
+// Device reads and writes raw IP packets, one packet per call.
+type Device interface {
+	io.ReadWriteCloser
+
+	// Name returns the interface name of the device.
+	Name() string
+
+	// MTU returns the maximum packet size of the device.
+	MTU() int
+}
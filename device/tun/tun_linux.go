@@ -0,0 +1,112 @@
+// Package tun provides TUN devices.
+package tun
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/lp2p/p2pvpn/device"
+)
+
+const (
+	cloneDevice = "/dev/net/tun"
+	ifNameSize  = 16
+	ifReqSize   = 40
+)
+
+type tun struct {
+	*os.File
+
+	name string
+	mtu  int
+}
+
+var _ device.Device = (*tun)(nil)
+
+// Open creates or attaches to the TUN interface name and brings it up.
+// Addresses and routes of the interface are left to the system.
+func Open(name string, mtu int) (device.Device, error) {
+	fd, err := syscall.Open(cloneDevice, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", cloneDevice, err)
+	}
+
+	var ifr [ifReqSize]byte
+	copy(ifr[:ifNameSize-1], name)
+	*(*uint16)(unsafe.Pointer(&ifr[ifNameSize])) = syscall.IFF_TUN | syscall.IFF_NO_PI
+	if err := ioctl(fd, syscall.TUNSETIFF, &ifr); err != nil {
+		_ = syscall.Close(fd)
+		return nil, fmt.Errorf("create tun %s: %w", name, err)
+	}
+	name = cString(ifr[:ifNameSize])
+
+	if err := setLink(name, mtu); err != nil {
+		_ = syscall.Close(fd)
+		return nil, err
+	}
+
+	// A non-blocking file goes through the runtime poller, so Close
+	// interrupts pending reads.
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		_ = syscall.Close(fd)
+		return nil, err
+	}
+
+	return &tun{
+		File: os.NewFile(uintptr(fd), cloneDevice),
+		name: name,
+		mtu:  mtu,
+	}, nil
+}
+
+func (t *tun) Name() string {
+	return t.name
+}
+
+func (t *tun) MTU() int {
+	return t.mtu
+}
+
+// setLink sets the MTU of the interface and marks it up.
+func setLink(name string, mtu int) error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	var ifr [ifReqSize]byte
+	copy(ifr[:ifNameSize-1], name)
+	*(*int32)(unsafe.Pointer(&ifr[ifNameSize])) = int32(mtu)
+	if err := ioctl(fd, syscall.SIOCSIFMTU, &ifr); err != nil {
+		return fmt.Errorf("set mtu of %s: %w", name, err)
+	}
+
+	if err := ioctl(fd, syscall.SIOCGIFFLAGS, &ifr); err != nil {
+		return fmt.Errorf("get flags of %s: %w", name, err)
+	}
+	*(*uint16)(unsafe.Pointer(&ifr[ifNameSize])) |= syscall.IFF_UP | syscall.IFF_RUNNING
+	if err := ioctl(fd, syscall.SIOCSIFFLAGS, &ifr); err != nil {
+		return fmt.Errorf("set %s up: %w", name, err)
+	}
+	return nil
+}
+
+func ioctl(fd int, req uintptr, ifr *[ifReqSize]byte) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(unsafe.Pointer(&ifr[0])))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
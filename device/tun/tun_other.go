@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+// Package tun provides TUN devices.
+package tun
+
+import (
+	"errors"
+
+	"github.com/lp2p/p2pvpn/device"
+)
+
+// Open is only supported on Linux.
+func Open(name string, mtu int) (device.Device, error) {
+	return nil, errors.New("tun: not supported on this platform")
+}
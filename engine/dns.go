@@ -0,0 +1,157 @@
+package engine
+
+import (
+	"net"
+	"strings"
+
+	"github.com/lp2p/p2pvpn/log"
+	"github.com/lp2p/p2pvpn/transport/socks5"
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultDNSSuffix is the domain fingerprints are resolved under.
+	DefaultDNSSuffix = "p2p"
+	// dnsTTL is the TTL of the answers, fake IPs stay valid while in use
+	// so it only bounds how long a removed peer still resolves.
+	dnsTTL = 60
+)
+
+// initDNS serves DNS on DNSAddr, over UDP and TCP. It answers A queries of
+// <fingerprint>.<DNSSuffix> with fake IPs, connections to them are relayed
+// to the peer of the fingerprint. Other names are refused.
+func (e *engine) initDNS() error {
+	if e.DNSAddr == "" {
+		return nil
+	}
+
+	fakeRange := e.FakeIPRange
+	if fakeRange == "" {
+		fakeRange = DefaultFakeIPRange
+	}
+	pool, err := newFakeIPPool(fakeRange)
+	if err != nil {
+		return err
+	}
+
+	pc, err := net.ListenPacket("udp", e.DNSAddr)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		_ = pc.Close()
+		return err
+	}
+	e.mx.Lock()
+	e.fakeIPs = pool
+	e.mx.Unlock()
+	e.addCloser(pc)
+	e.addCloser(l)
+
+	// The handler keeps its pool, shutdown resets e.fakeIPs while queries
+	// may still be served.
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		e.serveDNS(w, req, pool)
+	})
+	for _, srv := range []*dns.Server{
+		{PacketConn: pc, Handler: handler},
+		{Listener: l, Handler: handler},
+	} {
+		go func(srv *dns.Server) {
+			if err := srv.ActivateAndServe(); err != nil {
+				log.Debugf("DNS server stopped: %v", err)
+			}
+		}(srv)
+	}
+
+	log.Infof("DNS server listening at: %s, for *.%s in %s", e.DNSAddr, e.dnsSuffix(), fakeRange)
+	return nil
+}
+
+func (e *engine) serveDNS(w dns.ResponseWriter, req *dns.Msg, pool *fakeIPPool) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+
+	if len(req.Question) != 1 {
+		m.Rcode = dns.RcodeFormatError
+		_ = w.WriteMsg(m)
+		return
+	}
+	q := req.Question[0]
+
+	fingerprint, ok := e.fingerprintOfName(q.Name)
+	if !ok {
+		m.Authoritative = false
+		m.Rcode = dns.RcodeRefused
+		_ = w.WriteMsg(m)
+		return
+	}
+	id, err := e.findPeerID(fingerprint)
+	switch {
+	case err != nil:
+		log.Warnf("DNS lookup of %s failed: %v", fingerprint, err)
+		m.Rcode = dns.RcodeServerFailure
+	case id == "":
+		m.Rcode = dns.RcodeNameError
+	case q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY:
+		ip := pool.IP(fingerprint)
+		if ip == nil {
+			log.Warnf("No fake IP left for %s", fingerprint)
+			m.Rcode = dns.RcodeServerFailure
+			break
+		}
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: dnsTTL},
+			A:   ip,
+		})
+	}
+	// Other types of known names are answered without records.
+	_ = w.WriteMsg(m)
+}
+
+func (e *engine) dnsSuffix() string {
+	if e.DNSSuffix == "" {
+		return DefaultDNSSuffix
+	}
+	return strings.Trim(e.DNSSuffix, ".")
+}
+
+// fingerprintOfName returns the fingerprint of a name under the DNS suffix,
+// like laptop.p2p, with or without the final dot.
+func (e *engine) fingerprintOfName(name string) (string, bool) {
+	name = strings.TrimSuffix(name, ".")
+	suffix := "." + e.dnsSuffix()
+	if len(name) <= len(suffix) || !strings.EqualFold(name[len(name)-len(suffix):], suffix) {
+		return "", false
+	}
+	return name[:len(name)-len(suffix)], true
+}
+
+// peerTarget returns the fingerprint of the peer to relay target to, and
+// the target to send that peer. Fake IPs and names under the DNS suffix
+// are replaced by their fingerprint, other targets name it already.
+func (e *engine) peerTarget(target socks5.Addr) (string, socks5.Addr) {
+	host, port := target.ToHostPort()
+	fingerprint := host
+	if ip := net.ParseIP(host); ip != nil {
+		e.mx.Lock()
+		pool := e.fakeIPs
+		e.mx.Unlock()
+		if pool != nil {
+			if fp, ok := pool.Fingerprint(ip); ok {
+				fingerprint = fp
+			}
+		}
+	} else if fp, ok := e.fingerprintOfName(host); ok {
+		fingerprint = fp
+	}
+	if fingerprint == host {
+		return host, target
+	}
+	if mapped := socks5.ParseAddr(net.JoinHostPort(fingerprint, port)); mapped != nil {
+		return fingerprint, mapped
+	}
+	return host, target
+}
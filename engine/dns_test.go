@@ -0,0 +1,65 @@
+package engine
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lp2p/p2pvpn/transport/socks5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeIPPool(t *testing.T) {
+	_, err := newFakeIPPool("2001:db8::/64")
+	assert.Error(t, err)
+
+	// 10.0.0.1 and 10.0.0.2 are the only fake IPs of the range.
+	p, err := newFakeIPPool("10.0.0.0/30")
+	require.NoError(t, err)
+	now := time.Now()
+	p.now = func() time.Time { return now }
+
+	laptop := p.IP("laptop")
+	assert.Equal(t, "10.0.0.1", laptop.String())
+	assert.Equal(t, laptop, p.IP("laptop"))
+	assert.Equal(t, "10.0.0.2", p.IP("desktop").String())
+
+	fp, ok := p.Fingerprint(laptop)
+	assert.True(t, ok)
+	assert.Equal(t, "laptop", fp)
+
+	// The range is used up, the least recently used desktop is reused once
+	// resolvers no longer cache it.
+	assert.Nil(t, p.IP("exitbox"))
+	now = now.Add(dnsTTL * time.Second)
+	assert.Equal(t, "10.0.0.2", p.IP("exitbox").String())
+	_, ok = p.Fingerprint(net.ParseIP("10.0.0.3"))
+	assert.False(t, ok)
+	fp, _ = p.Fingerprint(net.ParseIP("10.0.0.2"))
+	assert.Equal(t, "exitbox", fp)
+}
+
+func TestPeerTarget(t *testing.T) {
+	pool, err := newFakeIPPool(DefaultFakeIPRange)
+	require.NoError(t, err)
+	e := &engine{Key: &Key{}, fakeIPs: pool}
+	ip := pool.IP("laptop")
+
+	for _, tt := range []struct {
+		target, fingerprint, sent string
+	}{
+		{net.JoinHostPort(ip.String(), "22"), "laptop", "laptop:22"},
+		{"laptop.p2p:22", "laptop", "laptop:22"},
+		{"LAPTOP.P2P.:22", "LAPTOP", "LAPTOP:22"},
+		{"laptop:22", "laptop", "laptop:22"},
+		{"10.0.0.5:22", "10.0.0.5", "10.0.0.5:22"},
+	} {
+		fingerprint, sent := e.peerTarget(socks5.ParseAddr(tt.target))
+		assert.Equal(t, tt.fingerprint, fingerprint, tt.target)
+		assert.Equal(t, tt.sent, sent.String(), tt.target)
+	}
+
+	_, ok := e.fingerprintOfName("p2p.")
+	assert.False(t, ok)
+}
@@ -6,21 +6,31 @@ import (
 	"fmt"
 	"github.com/libp2p/go-libp2p-core/event"
 	"github.com/lp2p/p2pvpn/common/utils"
+	"io"
 	"net"
-	"net/url"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
 	"github.com/lp2p/p2pvpn/api/route"
 	"github.com/lp2p/p2pvpn/common/pool"
 	"github.com/lp2p/p2pvpn/constant"
 	"github.com/lp2p/p2pvpn/context"
+	"github.com/lp2p/p2pvpn/device"
+	"github.com/lp2p/p2pvpn/device/tun"
+	"github.com/lp2p/p2pvpn/identity"
 	"github.com/lp2p/p2pvpn/log"
+	"github.com/lp2p/p2pvpn/policy"
+	"github.com/lp2p/p2pvpn/server"
+	"github.com/lp2p/p2pvpn/stack"
 	"github.com/lp2p/p2pvpn/transport/socks5"
 	"github.com/lp2p/p2pvpn/tunnel"
+	"go.uber.org/multierr"
 )
 
 var _engine = &engine{}
@@ -30,7 +40,7 @@ func Start() error {
 	return _engine.start()
 }
 
-// Stop shuts the default engine down.
+// Stop shuts the default engine down, it may be started again afterwards.
 func Stop() error {
 	return _engine.stop()
 }
@@ -40,18 +50,122 @@ func Insert(k *Key) {
 	_engine.insert(k)
 }
 
-type Key struct {
-	SocksAddr   string
-	ServerUrl   string
-	Fingerprint string
+const (
+	defaultTunMTU = 1500
+
+	// defaultDrainTimeout is used when Key.DrainTimeout is zero.
+	defaultDrainTimeout = 10 * time.Second
+
+	// defaultLeaseTTL is used when Key.LeaseTTL is zero.
+	defaultLeaseTTL = 90 * time.Second
+)
+
+// DefaultListenAddrs are used when Key.ListenAddrs is empty.
+var DefaultListenAddrs = []string{"/ip4/0.0.0.0/tcp/0"}
 
-	secret string
+type Key struct {
+	SocksAddr   string `yaml:"socks_addr"`
+	HTTPAddr    string `yaml:"http_addr,omitempty"`
+	ServerUrl   string `yaml:"server_url"`
+	Fingerprint string `yaml:"fingerprint"`
+
+	// ServerUrls are more servers of the cluster of ServerUrl, requests
+	// fail over to them in order.
+	ServerUrls []string `yaml:"server_urls,omitempty"`
+
+	// Network is the virtual network joined on the servers, the default one
+	// if empty. Fingerprints only resolve to peers of the same network.
+	Network string `yaml:"network,omitempty"`
+
+	// KeyFile holds the libp2p identity, it is generated on first start so
+	// the peer ID is stable. Empty uses a new identity on every start.
+	KeyFile string `yaml:"key_file"`
+
+	// ListenAddrs are the libp2p listen multiaddrs.
+	ListenAddrs []string `yaml:"listen_addrs"`
+
+	// NoRelay disables circuit relay, peers behind NAT are then only
+	// reachable if hole punching works.
+	NoRelay bool `yaml:"no_relay,omitempty"`
+
+	// NoDHT keeps us out of the DHT of the network, fingerprints are then
+	// not found while no server answers.
+	NoDHT bool `yaml:"no_dht,omitempty"`
+
+	// MDNS advertises us on the LAN and finds the peers of the network
+	// there, they are then connected directly.
+	MDNS bool `yaml:"mdns,omitempty"`
+
+	// Forwards are static port forwards to peers, more can be added with
+	// AddForward at runtime.
+	Forwards []Forward `yaml:"forwards,omitempty"`
+
+	// TunName enables TUN mode when set, TCP flows to an address
+	// registered as fingerprint are relayed to its peer.
+	TunName string `yaml:"tun,omitempty"`
+	TunMTU  int    `yaml:"tun_mtu,omitempty"`
+
+	// Users are the credentials required by the local proxy listeners,
+	// no user means no authentication.
+	Users []socks5.User `yaml:"users,omitempty"`
+
+	// Policy restricts the destinations remote peers may reach through us,
+	// private addresses are denied unless a rule allows them. Our own
+	// fingerprint reaches the local host unless a rule denies it.
+	Policy []policy.Rule `yaml:"policy,omitempty"`
+
+	// Groups name sets of peer IDs or fingerprints, they are referred to
+	// as "group:<name>" by AllowPeers and policy rules.
+	Groups map[string][]string `yaml:"groups,omitempty"`
+
+	// AllowPeers are the peers, fingerprints or groups whose streams
+	// we accept, empty accepts every peer.
+	AllowPeers []string `yaml:"allow_peers,omitempty"`
+
+	// DrainTimeout is how long Stop waits for relayed connections to
+	// finish before closing them.
+	DrainTimeout time.Duration `yaml:"drain_timeout,omitempty"`
+
+	// LeaseTTL is how long the server keeps our registration without a
+	// heartbeat, heartbeats are sent every third of it.
+	LeaseTTL time.Duration `yaml:"lease_ttl,omitempty"`
+
+	// DNSAddr enables the DNS server, it resolves <fingerprint>.<DNSSuffix>
+	// to fake IPs of FakeIPRange, connections to them reach the peer.
+	DNSAddr     string `yaml:"dns_addr,omitempty"`
+	DNSSuffix   string `yaml:"dns_suffix,omitempty"`
+	FakeIPRange string `yaml:"fake_ip_range,omitempty"`
 }
 
 type engine struct {
 	*Key
 
-	host host.Host
+	// servers are split from Key.ServerUrl and Key.ServerUrls.
+	servers []route.Server
+
+	host   host.Host
+	auth   socks5.Authenticator
+	peers  *policy.Matcher
+	policy *policy.Policy
+	tun    device.Device
+	stack  *stack.Stack
+	// fakeIPs are the addresses the DNS server answers with, nil without
+	// DNS server.
+	fakeIPs *fakeIPPool
+	// peerCache resolves fingerprints, it is created by initPeerCache.
+	peerCache *peerCache
+
+	forwardMx sync.Mutex
+	forwards  map[string]*forwarder
+
+	// mx guards the fields below.
+	mx      sync.Mutex
+	running bool
+	closing bool
+	closers []interface{ Close() error }
+	conns   map[io.Closer]struct{}
+	active  sync.WaitGroup
+	done    chan struct{}
 }
 
 func (e *engine) start() error {
@@ -59,61 +173,250 @@ func (e *engine) start() error {
 		return errors.New("empty key")
 	}
 
+	e.mx.Lock()
+	if e.running {
+		e.mx.Unlock()
+		return errors.New("engine is already running")
+	}
+	e.running = true
+	e.done = make(chan struct{})
+	e.mx.Unlock()
+
+	e.auth = socks5.NewAuthenticator(e.Users)
+
 	for _, f := range []func() error{
+		e.initPolicy,
 		e.initServerUrl,
 		e.initHost,
+		e.initDHT,
+		e.initPeerCache,
 		e.initAutoNAT,
 		e.initSocks,
+		e.initHTTP,
+		e.initForwards,
+		e.initDNS,
+		e.initTun,
 		e.initP2PHost,
+		e.initHeartbeat,
+		e.initWatch,
 	} {
 		if err := f(); err != nil {
-			return err
+			// Release what was started, so start can be retried.
+			return multierr.Append(err, e.shutdown(false))
 		}
 	}
 	return nil
 }
 
+// stop stops accepting connections, unregisters from the server, drains
+// the relayed connections and closes the host.
 func (e *engine) stop() error {
-	err := route.Router().Logout(e.Fingerprint)
-	if err != nil {
-		return err
+	e.mx.Lock()
+	running := e.running
+	e.mx.Unlock()
+	if !running {
+		return errors.New("engine is not running")
 	}
-	return nil
+	return e.shutdown(true)
+}
+
+// shutdown releases what start started. Only the first of concurrent calls
+// does, the others fail.
+func (e *engine) shutdown(logout bool) error {
+	e.mx.Lock()
+	if e.closing {
+		e.mx.Unlock()
+		return errors.New("engine is already stopping")
+	}
+	e.closing = true
+	closers := e.closers
+	e.closers = nil
+	close(e.done)
+	e.mx.Unlock()
+
+	var err error
+	for _, c := range closers {
+		err = multierr.Append(err, c.Close())
+	}
+	for _, f := range e.listForwards() {
+		err = multierr.Append(err, e.removeForward(f.Listen))
+	}
+	// Unregister while the host is open, libp2p servers are reached
+	// through it.
+	if logout {
+		err = multierr.Append(err, route.Router().Logout(e.Fingerprint))
+	}
+
+	timeout := e.DrainTimeout
+	if timeout <= 0 {
+		timeout = defaultDrainTimeout
+	}
+	if n := e.drain(timeout); n > 0 {
+		log.Warnf("Closed %d connections still active after %v", n, timeout)
+	}
+
+	if e.stack != nil {
+		err = multierr.Append(err, e.stack.Close())
+	}
+	if e.tun != nil {
+		err = multierr.Append(err, e.tun.Close())
+	}
+	if e.host != nil {
+		err = multierr.Append(err, e.host.Close())
+	}
+
+	e.mx.Lock()
+	e.host, e.stack, e.tun, e.fakeIPs = nil, nil, nil, nil
+	e.running, e.closing = false, false
+	e.mx.Unlock()
+	return err
 }
 
 func (e *engine) insert(k *Key) {
 	e.Key = k
 }
 
-// initServerUrl gets secret from server url.
+// initServerUrl gets the credential from server url, see auth.ParseURL.
 func (e *engine) initServerUrl() error {
-	serverUrl, err := url.Parse(e.ServerUrl)
+	e.servers = nil
+	for _, raw := range append([]string{e.ServerUrl}, e.ServerUrls...) {
+		s, err := route.ParseServer(raw, constant.DefaultSecret)
+		if err != nil {
+			return err
+		}
+		s.Network = e.Network
+		e.servers = append(e.servers, s)
+	}
+	return nil
+}
+
+// initPolicy compiles the peer allowlist and the exit policy, fingerprints
+// are resolved through the server.
+func (e *engine) initPolicy() error {
+	peers, err := policy.NewMatcher(e.Groups, e.findPeerID)
 	if err != nil {
 		return err
 	}
-
-	e.secret = serverUrl.User.Username()
-	if e.secret == "" {
-		e.secret = constant.DefaultSecret
+	if err := peers.Validate(e.AllowPeers); err != nil {
+		return fmt.Errorf("allow peers: %w", err)
 	}
-	e.ServerUrl = fmt.Sprintf("%s://%s", serverUrl.Scheme, serverUrl.Host)
 
+	p, err := policy.New(e.Policy, peers)
+	if err != nil {
+		return err
+	}
+	e.peers = peers
+	e.policy = p
 	return nil
 }
 
-// initHost creates a libp2p host with a generated identity.
+// initHost creates a libp2p host with the identity of KeyFile.
 func (e *engine) initHost() error {
-	h, err := libp2p.New(gocontext.Background(),
-		libp2p.ListenAddrStrings("/ip4/0.0.0.0/tcp/0"),
-		libp2p.EnableRelay(),
-		libp2p.EnableAutoRelay(),
-		libp2p.Routing(route.MakeRouting(e.ServerUrl, constant.PeerRendezvous, e.Fingerprint, e.secret)),
-	)
+	listenAddrs := e.ListenAddrs
+	if len(listenAddrs) == 0 {
+		listenAddrs = DefaultListenAddrs
+	}
+	opts := []libp2p.Option{
+		libp2p.ListenAddrStrings(listenAddrs...),
+		libp2p.Routing(route.MakeRouting(e.servers, constant.PeerRendezvous, e.Fingerprint, e.leaseTTL())),
+	}
+	if e.NoRelay {
+		opts = append(opts, libp2p.DisableRelay())
+	} else {
+		opts = append(opts, libp2p.EnableRelay(), libp2p.EnableAutoRelay())
+	}
+	if e.KeyFile != "" {
+		priv, created, err := identity.LoadOrGenerate(e.KeyFile)
+		if err != nil {
+			return fmt.Errorf("load identity: %w", err)
+		}
+		if created {
+			log.Infof("Generated new identity at: %s", e.KeyFile)
+		}
+		opts = append(opts, libp2p.Identity(priv))
+	}
+
+	h, err := libp2p.New(gocontext.Background(), opts...)
 	if err != nil {
 		return err
 	}
+	log.Infof("Peer ID: %s", h.ID())
 
 	e.host = h
+	if e.MDNS {
+		// Not being on a LAN is no reason to fail.
+		if err := e.initMDNS(); err != nil {
+			log.Warnf("LAN discovery disabled: %v", err)
+		}
+	}
+	return nil
+}
+
+// initDHT joins the DHT of the network, lookups fall back to it when no
+// server answers. Our records in it expire with our lease.
+func (e *engine) initDHT() error {
+	if e.NoDHT {
+		return nil
+	}
+	if err := route.Router().EnableDHT(e.Network, e.leaseTTL()); err != nil {
+		return fmt.Errorf("dht: %w", err)
+	}
+	e.addCloser(route.Router())
+	return nil
+}
+
+// initPeerCache caches fingerprint lookups and keeps the connections to
+// the peers used the most open.
+func (e *engine) initPeerCache() error {
+	e.peerCache = newPeerCache(func(fingerprint string) (peer.ID, error) {
+		return route.Router().FindPeerID(fingerprint)
+	})
+	go e.peerCache.keepWarm(e.host, e.done)
+	return nil
+}
+
+// findPeerID resolves fingerprint through the cache once it is created.
+func (e *engine) findPeerID(fingerprint string) (peer.ID, error) {
+	if e.peerCache == nil {
+		return route.Router().FindPeerID(fingerprint)
+	}
+	return e.peerCache.Resolve(fingerprint)
+}
+
+func (e *engine) leaseTTL() time.Duration {
+	if e.LeaseTTL > 0 {
+		return e.LeaseTTL
+	}
+	return defaultLeaseTTL
+}
+
+// initHeartbeat renews our registration until the engine stops, so the
+// server forgets us soon after a crash.
+func (e *engine) initHeartbeat() error {
+	interval := e.leaseTTL() / 3
+	done := e.done
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		cid := utils.StrToCid(constant.PeerRendezvous)
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			ctx, cancel := gocontext.WithTimeout(gocontext.Background(), interval)
+			err := route.Router().Provide(ctx, cid, true)
+			cancel()
+			if err != nil {
+				log.Warnf("Heartbeat failed: %v", err)
+			}
+		}
+	}()
+
 	return nil
 }
 
@@ -144,42 +447,76 @@ func (e *engine) initSocks() error {
 		return err
 	}
 
+	// UDP associations are served on the same address as the listener,
+	// which is the address ServerHandshake replies with.
+	pc, err := net.ListenPacket("udp", l.Addr().String())
+	if err != nil {
+		_ = l.Close()
+		return err
+	}
+
+	e.addCloser(l)
+	e.addCloser(pc)
+
 	log.Infof("SOCKS proxy listening at: %s", e.SocksAddr)
 
-	go func() {
-		for {
-			conn, err := l.Accept()
-			if err != nil {
-				log.Debugf("SOCKS accept error: %v", err)
-				continue
+	relay := newUDPRelay(e, pc)
+	go relay.serve()
+	go e.serve("SOCKS", l, func(conn net.Conn) {
+		target, command, err := socks5.ServerHandshake(conn, e.auth)
+		if err != nil {
+			if errors.Is(err, socks5.ErrAuth) {
+				log.Warnf("SOCKS auth failed from %s", conn.RemoteAddr())
 			}
+			_ = conn.Close()
+			return
+		}
 
-			go func() {
-				target, command, err := socks5.ServerHandshake(conn)
-				if err != nil || command != socks5.CmdConnect {
-					_ = conn.Close()
-					return
-				}
+		if command == socks5.CmdUDPAssociate {
+			// The association lives as long as the control connection.
+			a := relay.associate(conn.RemoteAddr(), target)
+			_, _ = io.Copy(io.Discard, conn)
+			_ = conn.Close()
+			relay.release(a)
+			return
+		}
 
-				if c, ok := conn.(*net.TCPConn); ok {
-					_ = c.SetKeepAlive(true)
-				}
+		if c, ok := conn.(*net.TCPConn); ok {
+			_ = c.SetKeepAlive(true)
+		}
 
-				stream, err := e.newStream(target)
-				// If an error happens, we write an error for response.
-				if err != nil {
-					log.Warnf("Starting new stream failed: %v", err)
-					return
-				}
+		e.relayConn(conn, target)
+	})
+
+	return nil
+}
+
+// initTun opens the TUN device and relays the TCP flows read from it.
+func (e *engine) initTun() error {
+	if e.TunName == "" {
+		return nil
+	}
 
-				log.Infof("New stream connection: %s <--> %s", conn.RemoteAddr(), stream.ID())
+	mtu := e.TunMTU
+	if mtu == 0 {
+		mtu = defaultTunMTU
+	}
+	dev, err := tun.Open(e.TunName, mtu)
+	if err != nil {
+		return err
+	}
+	e.tun = dev
+	e.stack = stack.New(dev, dev.MTU(), func(conn net.Conn) {
+		e.handle(conn, func(conn net.Conn) {
+			e.relayConn(conn, socks5.ParseAddrToSocksAddr(conn.LocalAddr()))
+		})
+	})
 
-				defer conn.Close()
-				defer stream.Close()
+	log.Infof("TUN device %s is up", dev.Name())
 
-				stream.Write(target)
-				tunnel.Relay(conn, stream)
-			}()
+	go func() {
+		if err := e.stack.Serve(); err != nil {
+			log.Errorf("TUN read error: %v", err)
 		}
 	}()
 
@@ -191,21 +528,59 @@ func (e *engine) initP2PHost() error {
 	// protocol id that we have defined, and then handle them to
 	// our own streamHandling function.
 	e.host.SetStreamHandler(constant.Protocol, func(stream network.Stream) {
+		if !e.acceptStream(stream) {
+			return
+		}
+
 		buf := pool.Get(socks5.MaxAddrLen)
 		defer pool.Put(buf)
 
 		addr, err := socks5.ReadAddr(stream, buf)
 		if err != nil {
 			log.Warnf("Read address failed: %v", err)
+			_ = stream.Reset()
 			return
 		}
 
+		remote := stream.Conn().RemotePeer()
 		addrHost, addrPort := addr.ToHostPort()
-		if addrHost == e.Fingerprint {
-			addrHost = net.JoinHostPort("127.0.0.1", addrPort)
+		target, err := e.checkTarget(remote, addrHost, addrPort)
+		if err != nil {
+			log.Warnf("Rejected stream from %s to %s: %v", remote, addr, err)
+			_ = stream.Reset()
+			return
+		}
+
+		conn, ok := e.trackConn(stream)
+		if !ok {
+			_ = stream.Reset()
+			return
+		}
+		tunnel.Add(context.ConnContext{Addr: &tcpAddr{target}, Conn: conn})
+	})
+
+	e.host.SetStreamHandler(constant.UDPProtocol, func(stream network.Stream) {
+		if !e.acceptStream(stream) {
+			return
 		}
 
-		tunnel.Add(context.ConnContext{Addr: &tcpAddr{addrHost}, Conn: stream})
+		conn, ok := e.trackConn(stream)
+		if !ok {
+			_ = stream.Reset()
+			return
+		}
+
+		remote := stream.Conn().RemotePeer()
+		tunnel.AddPacket(context.PacketConnContext{
+			Conn: conn,
+			Resolve: func(host, port string) (*net.UDPAddr, error) {
+				target, err := e.checkTarget(remote, host, port)
+				if err != nil {
+					return nil, err
+				}
+				return net.ResolveUDPAddr("udp", target)
+			},
+		})
 	})
 
 	log.Infof("Peer host is listening at:")
@@ -216,28 +591,92 @@ func (e *engine) initP2PHost() error {
 	return nil
 }
 
-// newStream creates a stream between e.host and target peer.
-func (e *engine) newStream(target socks5.Addr) (network.Stream, error) {
-	targetStr, _ := target.ToHostPort()
-	peerID, err := route.Router().FindPeerID(targetStr)
+// relayConn relays conn to the peer of target, it closes conn when done.
+func (e *engine) relayConn(conn net.Conn, target socks5.Addr) {
+	defer conn.Close()
+
+	fingerprint, target := e.peerTarget(target)
+	stream, err := e.newStream(fingerprint, constant.Protocol)
 	if err != nil {
-		return nil, err
+		log.Warnf("Starting new stream failed: %v", err)
+		return
+	}
+	defer stream.Close()
+
+	log.Infof("New stream connection: %s <--> %s", conn.RemoteAddr(), stream.ID())
+
+	stream.Write(target)
+	tunnel.Relay(conn, stream)
+}
+
+// acceptStream resets streams from peers outside of AllowPeers.
+func (e *engine) acceptStream(stream network.Stream) bool {
+	if len(e.AllowPeers) == 0 {
+		return true
 	}
-	targetInfo := peer.AddrInfo{
-		ID: peerID,
+
+	remote := stream.Conn().RemotePeer()
+	if e.peers.Match(e.AllowPeers, remote) {
+		return true
 	}
+	log.Warnf("Rejected stream from unauthorized peer %s", remote)
+	_ = stream.Reset()
+	return false
+}
 
-	err = e.host.Connect(gocontext.Background(), targetInfo)
+// checkTarget applies the policy to a destination requested by peer id and
+// returns the address to dial. Our own fingerprint stands for the local host,
+// which is allowed unless a rule denies it.
+func (e *engine) checkTarget(id peer.ID, host, port string) (string, error) {
+	portNum, err := strconv.Atoi(port)
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+
+	var ip net.IP
+	if host == e.Fingerprint {
+		ip, err = e.policy.CheckLocal(id, portNum)
+	} else {
+		ip, err = e.policy.Check(id, host, portNum)
+	}
+	if err != nil {
+		return "", err
 	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
 
-	stream, err := e.host.NewStream(gocontext.Background(), peerID, constant.Protocol)
+// newStream creates a stream of protocol pid between e.host and the peer
+// registered as fingerprint. The peer ID is cached and an open connection
+// to it reused; if that fails the fingerprint is looked up again, in case
+// it moved to another peer.
+func (e *engine) newStream(fingerprint string, pid protocol.ID) (network.Stream, error) {
+	peerID, err := e.findPeerID(fingerprint)
 	if err != nil {
 		return nil, err
 	}
+	if peerID == "" {
+		return nil, fmt.Errorf("fingerprint %s: %w", fingerprint, server.ErrNotFound)
+	}
 
-	return stream, nil
+	stream, err := e.openStream(peerID, pid)
+	if err != nil && e.peerCache != nil {
+		e.peerCache.Invalidate(fingerprint)
+		if fresh, ferr := e.peerCache.Resolve(fingerprint); ferr == nil && fresh != "" && fresh != peerID {
+			return e.openStream(fresh, pid)
+		}
+	}
+	return stream, err
+}
+
+// openStream opens a stream of protocol pid to id, over the connection
+// to it if there is one.
+func (e *engine) openStream(id peer.ID, pid protocol.ID) (network.Stream, error) {
+	if e.host.Network().Connectedness(id) != network.Connected {
+		if err := e.host.Connect(gocontext.Background(), peer.AddrInfo{ID: id}); err != nil {
+			return nil, err
+		}
+	}
+	return e.host.NewStream(gocontext.Background(), id, pid)
 }
 
 // listenNATChange subscribes nat change event. When change to private, libp2p will auto
@@ -246,9 +685,12 @@ func (e *engine) listenNATChange() {
 	subscriber, err := e.host.EventBus().Subscribe(&event.EvtLocalReachabilityChanged{})
 	if err != nil {
 		log.Errorf("%v", err)
+		return
 	}
+	defer subscriber.Close()
 
 	select {
+	case <-e.done:
 	case ev := <-subscriber.Out():
 		tureEv, ok := ev.(event.EvtLocalReachabilityChanged)
 		if ok {
@@ -0,0 +1,334 @@
+package engine
+
+import (
+	"bufio"
+	gocontext "context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/lp2p/p2pvpn/transport/socks5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/multierr"
+)
+
+// exitFingerprint is the fingerprint of the exit engine of newTestPair.
+const exitFingerprint = "exitbox"
+
+// freeAddr returns a loopback address with a port free for TCP and UDP.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	for i := 0; i < 10; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addr := l.Addr().String()
+		pc, err := net.ListenPacket("udp", addr)
+		_ = l.Close()
+		if err == nil {
+			_ = pc.Close()
+			return addr
+		}
+	}
+	t.Fatal("no free port")
+	return ""
+}
+
+// newTestPair returns a running client engine with its SOCKS and HTTP
+// proxies, and an exit engine registered as exitFingerprint with the
+// default policy. They talk over libp2p on loopback, the fingerprint
+// resolves without server.
+func newTestPair(t *testing.T, drainTimeout time.Duration) *engine {
+	t.Helper()
+	ctx := gocontext.Background()
+
+	exitHost, err := libp2p.New(ctx, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"), libp2p.DisableRelay())
+	require.NoError(t, err)
+	exit := &engine{
+		Key: &Key{
+			Fingerprint:  exitFingerprint,
+			DrainTimeout: 100 * time.Millisecond,
+		},
+		host:    exitHost,
+		running: true,
+		done:    make(chan struct{}),
+	}
+	require.NoError(t, exit.initPolicy())
+	require.NoError(t, exit.initP2PHost())
+	t.Cleanup(func() { _ = exit.shutdown(false) })
+
+	clientHost, err := libp2p.New(ctx, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"), libp2p.DisableRelay())
+	require.NoError(t, err)
+	clientHost.Peerstore().AddAddrs(exitHost.ID(), exitHost.Addrs(), peerstore.PermanentAddrTTL)
+	client := &engine{
+		Key: &Key{
+			SocksAddr:    freeAddr(t),
+			HTTPAddr:     freeAddr(t),
+			Fingerprint:  "laptop",
+			DrainTimeout: drainTimeout,
+		},
+		host:    clientHost,
+		running: true,
+		done:    make(chan struct{}),
+		peerCache: newPeerCache(func(fingerprint string) (peer.ID, error) {
+			if fingerprint == exitFingerprint {
+				return exitHost.ID(), nil
+			}
+			return "", nil
+		}),
+	}
+	require.NoError(t, client.initPolicy())
+	require.NoError(t, client.initSocks())
+	require.NoError(t, client.initHTTP())
+	t.Cleanup(func() {
+		client.mx.Lock()
+		running := client.running
+		client.mx.Unlock()
+		if running {
+			_ = client.shutdown(false)
+		}
+	})
+	return client
+}
+
+// echoTCP serves a TCP echo server on loopback and returns its port.
+func echoTCP(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// echoUDP serves a UDP echo server on loopback and returns its port.
+func echoUDP(t *testing.T) int {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = pc.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc.LocalAddr().(*net.UDPAddr).Port
+}
+
+// assertEcho writes msg to conn and checks it comes back.
+func assertEcho(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := conn.Write([]byte(msg))
+	require.NoError(t, err)
+	buf := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, msg, string(buf))
+}
+
+func TestSocksUDP(t *testing.T) {
+	client := newTestPair(t, 100*time.Millisecond)
+	port := echoUDP(t)
+
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer pc.Close()
+
+	ctrl, err := net.Dial("tcp", client.SocksAddr)
+	require.NoError(t, err)
+	defer ctrl.Close()
+	_, err = socks5.ClientHandshake(ctrl, socks5.ParseAddrToSocksAddr(pc.LocalAddr()), socks5.CmdUDPAssociate, nil)
+	require.NoError(t, err)
+
+	target := socks5.ParseAddr(fmt.Sprintf("%s:%d", exitFingerprint, port))
+	relay, err := net.ResolveUDPAddr("udp", client.SocksAddr)
+	require.NoError(t, err)
+	pkt, err := socks5.EncodeUDPPacket(target, []byte("ping"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 2048)
+	// The first datagrams may be dropped while the stream is set up.
+	for i := 0; ; i++ {
+		require.Less(t, i, 10, "no reply")
+		_, err = pc.WriteTo(pkt, relay)
+		require.NoError(t, err)
+		_ = pc.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := pc.Read(buf)
+		if err != nil {
+			continue
+		}
+		addr, payload, err := socks5.DecodeUDPPacket(buf[:n])
+		require.NoError(t, err)
+		assert.Equal(t, target.String(), addr.String())
+		assert.Equal(t, "ping", string(payload))
+		return
+	}
+}
+
+func TestHTTPProxy(t *testing.T) {
+	client := newTestPair(t, 100*time.Millisecond)
+
+	t.Run("connect", func(t *testing.T) {
+		conn, err := net.Dial("tcp", client.HTTPAddr)
+		require.NoError(t, err)
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		target := fmt.Sprintf("%s:%d", exitFingerprint, echoTCP(t))
+		_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+		require.NoError(t, err)
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(br, buf)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(buf))
+	})
+
+	t.Run("absolute uri", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = fmt.Fprintf(w, "%s %s", r.Method, r.URL.Path)
+		}))
+		defer srv.Close()
+		port := srv.Listener.Addr().(*net.TCPAddr).Port
+
+		proxy, err := url.Parse("http://" + client.HTTPAddr)
+		require.NoError(t, err)
+		hc := &http.Client{
+			Transport: &http.Transport{Proxy: http.ProxyURL(proxy)},
+			Timeout:   5 * time.Second,
+		}
+		defer hc.CloseIdleConnections()
+
+		// The second request reuses the stream of the first one.
+		for _, path := range []string{"/a", "/b"} {
+			resp, err := hc.Get(fmt.Sprintf("http://%s:%d%s", exitFingerprint, port, path))
+			require.NoError(t, err)
+			body, err := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "GET "+path, string(body))
+		}
+
+		resp, err := hc.Get(fmt.Sprintf("http://unknown:%d/", port))
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	})
+}
+
+func TestForward(t *testing.T) {
+	client := newTestPair(t, 100*time.Millisecond)
+	f := Forward{Listen: "127.0.0.1:0", Target: fmt.Sprintf("%s:%d", exitFingerprint, echoTCP(t))}
+
+	require.NoError(t, client.addForward(f))
+	assert.Error(t, client.addForward(f), "duplicate forward")
+	assert.Equal(t, []Forward{f}, client.listForwards())
+
+	client.forwardMx.Lock()
+	addr := client.forwards[f.Listen].l.Addr().String()
+	client.forwardMx.Unlock()
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	assertEcho(t, conn, "forwarded")
+
+	require.NoError(t, client.removeForward(f.Listen))
+	assert.Empty(t, client.listForwards())
+	assert.Error(t, client.removeForward(f.Listen))
+
+	// Relayed connections outlive their forward.
+	assertEcho(t, conn, "still here")
+	_ = conn.Close()
+
+	_, err = net.Dial("tcp", addr)
+	assert.Error(t, err)
+}
+
+// failingCloser fails to close with err.
+type failingCloser struct {
+	err error
+}
+
+func (c failingCloser) Close() error {
+	return c.err
+}
+
+func TestStop(t *testing.T) {
+	client := newTestPair(t, 200*time.Millisecond)
+	f := Forward{Listen: "127.0.0.1:0", Target: fmt.Sprintf("%s:%d", exitFingerprint, echoTCP(t))}
+	require.NoError(t, client.addForward(f))
+
+	errA, errB := errors.New("close a"), errors.New("close b")
+	client.addCloser(failingCloser{errA})
+	client.addCloser(failingCloser{errB})
+
+	// A connection still relayed when stopping is closed after the drain.
+	conn, err := net.Dial("tcp", client.SocksAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = socks5.ClientHandshake(conn, socks5.ParseAddr(f.Target), socks5.CmdConnect, nil)
+	require.NoError(t, err)
+	assertEcho(t, conn, "held")
+
+	stopped := make(chan error, 1)
+	start := time.Now()
+	go func() { stopped <- client.shutdown(false) }()
+
+	assert.Eventually(t, func() bool {
+		client.mx.Lock()
+		defer client.mx.Unlock()
+		return client.closing
+	}, time.Second, 5*time.Millisecond)
+	assert.Error(t, client.shutdown(false), "concurrent shutdown")
+
+	// New connections are refused at once.
+	_, err = net.Dial("tcp", client.SocksAddr)
+	assert.Error(t, err)
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err, "held connection not closed")
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(client.DrainTimeout), "not drained")
+
+	select {
+	case err := <-stopped:
+		assert.ElementsMatch(t, []error{errA, errB}, multierr.Errors(err))
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown hung")
+	}
+	assert.Empty(t, client.listForwards())
+	assert.Error(t, client.stop(), "stopped engine")
+}
@@ -0,0 +1,121 @@
+package engine
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultFakeIPRange is the range fake IPs are taken from, it is reserved
+// for benchmarks so it does not clash with real hosts.
+const DefaultFakeIPRange = "198.18.0.0/15"
+
+// fakeIPPool maps fingerprints to fake IPv4 addresses of a range and back.
+// When the range is used up, the least recently looked up mapping is
+// reused, unless it was handed out within hold, the TTL of the DNS answers
+// resolvers may still cache it for.
+type fakeIPPool struct {
+	hold time.Duration
+	now  func() time.Time
+
+	mx    sync.Mutex
+	first uint32
+	size  uint32
+	next  uint32
+	byFP  map[string]uint32
+	byIP  map[uint32]string
+	// lru holds the offsets in use, the least recently used first.
+	lru   *list.List
+	elems map[uint32]*list.Element
+	// given is when each offset was last handed out by IP.
+	given map[uint32]time.Time
+}
+
+// newFakeIPPool creates a pool of the IPv4 range cidr, its network and
+// broadcast addresses are not used.
+func newFakeIPPool(cidr string) (*fakeIPPool, error) {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ip4 := n.IP.To4()
+	ones, bits := n.Mask.Size()
+	if ip4 == nil || bits != 32 || ones > 30 {
+		return nil, fmt.Errorf("fake ip range %s: want an IPv4 range of 4 addresses or more", cidr)
+	}
+	return &fakeIPPool{
+		hold:  dnsTTL * time.Second,
+		now:   time.Now,
+		first: binary.BigEndian.Uint32(ip4) + 1,
+		size:  uint32(1)<<uint(32-ones) - 2,
+		byFP:  make(map[string]uint32),
+		byIP:  make(map[uint32]string),
+		lru:   list.New(),
+		elems: make(map[uint32]*list.Element),
+		given: make(map[uint32]time.Time),
+	}, nil
+}
+
+// IP returns the fake IP of fingerprint, allocating one if needed. It
+// returns nil when the range is used up by IPs handed out within hold.
+func (p *fakeIPPool) IP(fingerprint string) net.IP {
+	now := p.now()
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	off, ok := p.byFP[fingerprint]
+	if !ok {
+		if p.next < p.size {
+			off = p.next
+			p.next++
+		} else {
+			// The least recently used was handed out the longest ago.
+			off = p.lru.Front().Value.(uint32)
+			if now.Sub(p.given[off]) < p.hold {
+				return nil
+			}
+			delete(p.byFP, p.byIP[off])
+		}
+		p.byFP[fingerprint] = off
+		p.byIP[off] = fingerprint
+	}
+	p.given[off] = now
+	p.touch(off)
+	return p.ip(off)
+}
+
+// Fingerprint returns the fingerprint ip was given to, if ip is a fake IP
+// in use. Using it keeps the mapping from being reused.
+func (p *fakeIPPool) Fingerprint(ip net.IP) (string, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return "", false
+	}
+	off := binary.BigEndian.Uint32(ip4) - p.first
+
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	fingerprint, ok := p.byIP[off]
+	if ok {
+		p.touch(off)
+	}
+	return fingerprint, ok
+}
+
+func (p *fakeIPPool) ip(off uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, p.first+off)
+	return ip
+}
+
+// touch marks off as the most recently used, p.mx is held.
+func (p *fakeIPPool) touch(off uint32) {
+	if e, ok := p.elems[off]; ok {
+		p.lru.MoveToBack(e)
+		return
+	}
+	p.elems[off] = p.lru.PushBack(off)
+}
@@ -0,0 +1,134 @@
+package engine
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/lp2p/p2pvpn/log"
+	"github.com/lp2p/p2pvpn/transport/socks5"
+)
+
+// Forward relays the connections of a local TCP listener to a fixed port
+// of a peer, for programs that can not use a proxy.
+type Forward struct {
+	// Listen is the local address to bind, like "127.0.0.1:5432".
+	Listen string `yaml:"listen"`
+	// Target is the fingerprint and port to reach, like "db-box:5432".
+	Target string `yaml:"target"`
+}
+
+// ParseForward parses the text form "listen=fingerprint:port" of a forward.
+func ParseForward(s string) (Forward, error) {
+	i := strings.IndexByte(s, '=')
+	if i < 0 {
+		return Forward{}, fmt.Errorf("invalid forward %q, want listen=fingerprint:port", s)
+	}
+	f := Forward{Listen: s[:i], Target: s[i+1:]}
+	return f, f.Validate()
+}
+
+// Validate checks the addresses of f.
+func (f Forward) Validate() error {
+	if _, _, err := net.SplitHostPort(f.Listen); err != nil {
+		return fmt.Errorf("forward listen %q: %w", f.Listen, err)
+	}
+	if socks5.ParseAddr(f.Target) == nil {
+		return fmt.Errorf("forward target %q: want fingerprint:port", f.Target)
+	}
+	return nil
+}
+
+// forwarder is a running Forward.
+type forwarder struct {
+	Forward
+	target socks5.Addr
+	l      net.Listener
+}
+
+// AddForward starts forwarding f on the default engine.
+func AddForward(f Forward) error {
+	return _engine.addForward(f)
+}
+
+// RemoveForward stops the forward listening at listen on the default engine,
+// relayed connections are left alone.
+func RemoveForward(listen string) error {
+	return _engine.removeForward(listen)
+}
+
+// Forwards returns the running forwards of the default engine.
+func Forwards() []Forward {
+	return _engine.listForwards()
+}
+
+// initForwards starts the forwards of the key.
+func (e *engine) initForwards() error {
+	for _, f := range e.Forwards {
+		if err := e.addForward(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *engine) addForward(f Forward) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+
+	e.forwardMx.Lock()
+	defer e.forwardMx.Unlock()
+
+	if e.forwards == nil {
+		e.forwards = make(map[string]*forwarder)
+	}
+	if _, ok := e.forwards[f.Listen]; ok {
+		return fmt.Errorf("forward %s already exists", f.Listen)
+	}
+
+	l, err := net.Listen("tcp", f.Listen)
+	if err != nil {
+		return err
+	}
+	fw := &forwarder{Forward: f, target: socks5.ParseAddr(f.Target), l: l}
+	e.forwards[f.Listen] = fw
+
+	log.Infof("Forwarding %s to %s", l.Addr(), f.Target)
+
+	go e.serveForward(fw)
+	return nil
+}
+
+func (e *engine) removeForward(listen string) error {
+	e.forwardMx.Lock()
+	fw, ok := e.forwards[listen]
+	delete(e.forwards, listen)
+	e.forwardMx.Unlock()
+
+	if !ok {
+		return fmt.Errorf("forward %s not found", listen)
+	}
+	return fw.l.Close()
+}
+
+func (e *engine) listForwards() []Forward {
+	e.forwardMx.Lock()
+	defer e.forwardMx.Unlock()
+
+	forwards := make([]Forward, 0, len(e.forwards))
+	for _, fw := range e.forwards {
+		forwards = append(forwards, fw.Forward)
+	}
+	return forwards
+}
+
+func (e *engine) serveForward(fw *forwarder) {
+	e.serve("Forward", fw.l, func(conn net.Conn) {
+		if c, ok := conn.(*net.TCPConn); ok {
+			_ = c.SetKeepAlive(true)
+		}
+		e.relayConn(conn, fw.target)
+	})
+	log.Infof("Stopped forwarding %s to %s", fw.Listen, fw.Target)
+}
@@ -0,0 +1,217 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/lp2p/p2pvpn/constant"
+	"github.com/lp2p/p2pvpn/log"
+	"github.com/lp2p/p2pvpn/transport/socks5"
+	"github.com/lp2p/p2pvpn/tunnel"
+)
+
+// hopHeaders are the hop-by-hop headers a proxy must not forward.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// initHTTP starts the HTTP proxy listener if HTTPAddr is set.
+func (e *engine) initHTTP() error {
+	if e.HTTPAddr == "" {
+		return nil
+	}
+
+	l, err := net.Listen("tcp", e.HTTPAddr)
+	if err != nil {
+		return err
+	}
+
+	e.addCloser(l)
+
+	log.Infof("HTTP proxy listening at: %s", e.HTTPAddr)
+
+	go e.serve("HTTP", l, e.handleHTTPConn)
+
+	return nil
+}
+
+// handleHTTPConn serves CONNECT and absolute-URI requests of a client.
+func (e *engine) handleHTTPConn(conn net.Conn) {
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+
+	// Requests to the same host reuse the stream of the previous one.
+	var stream network.Stream
+	var streamReader *bufio.Reader
+	var streamTarget string
+	defer func() {
+		if stream != nil {
+			_ = stream.Close()
+		}
+	}()
+
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+
+		if !e.httpAuthorized(req) {
+			log.Warnf("HTTP auth failed from %s", conn.RemoteAddr())
+			writeHTTPStatus(conn, http.StatusProxyAuthRequired, http.Header{
+				"Proxy-Authenticate": {`Basic realm="p2pvpn"`},
+			})
+			return
+		}
+
+		if req.Method == http.MethodConnect {
+			target := socks5.ParseAddr(req.Host)
+			if target == nil {
+				writeHTTPStatus(conn, http.StatusBadRequest, nil)
+				return
+			}
+			e.connectHTTP(conn, br, target)
+			return
+		}
+
+		if !req.URL.IsAbs() || req.URL.Scheme != "http" {
+			writeHTTPStatus(conn, http.StatusBadRequest, nil)
+			return
+		}
+
+		hostPort := req.URL.Host
+		if _, _, err := net.SplitHostPort(hostPort); err != nil {
+			hostPort = net.JoinHostPort(req.URL.Hostname(), "80")
+		}
+		if stream == nil || hostPort != streamTarget {
+			if stream != nil {
+				_ = stream.Close()
+				stream = nil
+			}
+			target := socks5.ParseAddr(hostPort)
+			if target == nil {
+				writeHTTPStatus(conn, http.StatusBadRequest, nil)
+				return
+			}
+			var fingerprint string
+			fingerprint, target = e.peerTarget(target)
+			stream, err = e.newStream(fingerprint, constant.Protocol)
+			if err != nil {
+				log.Warnf("Starting new stream failed: %v", err)
+				writeHTTPStatus(conn, http.StatusBadGateway, nil)
+				return
+			}
+			if _, err := stream.Write(target); err != nil {
+				return
+			}
+			streamReader = bufio.NewReader(stream)
+			streamTarget = hostPort
+		}
+
+		removeHopHeaders(req.Header)
+		if err := req.Write(stream); err != nil {
+			return
+		}
+
+		resp, err := http.ReadResponse(streamReader, req)
+		if err != nil {
+			writeHTTPStatus(conn, http.StatusBadGateway, nil)
+			return
+		}
+		removeHopHeaders(resp.Header)
+		// A body delimited by closing the connection ends the connection.
+		keepAlive := !req.Close && !resp.Close &&
+			(resp.ContentLength >= 0 || len(resp.TransferEncoding) > 0)
+
+		err = resp.Write(conn)
+		_ = resp.Body.Close()
+		if err != nil || !keepAlive {
+			return
+		}
+	}
+}
+
+// connectHTTP answers a CONNECT request and relays conn to target.
+func (e *engine) connectHTTP(conn net.Conn, br *bufio.Reader, target socks5.Addr) {
+	fingerprint, target := e.peerTarget(target)
+	stream, err := e.newStream(fingerprint, constant.Protocol)
+	if err != nil {
+		log.Warnf("Starting new stream failed: %v", err)
+		writeHTTPStatus(conn, http.StatusBadGateway, nil)
+		return
+	}
+	defer stream.Close()
+
+	log.Infof("New stream connection: %s <--> %s", conn.RemoteAddr(), stream.ID())
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return
+	}
+	if _, err := stream.Write(target); err != nil {
+		return
+	}
+	// Forward what the client sent along with the request.
+	if n := br.Buffered(); n > 0 {
+		buffered, _ := br.Peek(n)
+		if _, err := stream.Write(buffered); err != nil {
+			return
+		}
+	}
+
+	tunnel.Relay(conn, stream)
+}
+
+// httpAuthorized checks the Proxy-Authorization header of req.
+func (e *engine) httpAuthorized(req *http.Request) bool {
+	if e.auth == nil {
+		return true
+	}
+
+	const prefix = "Basic "
+	header := req.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(header, prefix) {
+		return false
+	}
+	credentials, err := base64.StdEncoding.DecodeString(header[len(prefix):])
+	if err != nil {
+		return false
+	}
+	i := strings.IndexByte(string(credentials), ':')
+	if i < 0 {
+		return false
+	}
+	return e.auth.Verify(string(credentials[:i]), string(credentials[i+1:]))
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, h := range hopHeaders {
+		header.Del(h)
+	}
+}
+
+func writeHTTPStatus(conn net.Conn, code int, header http.Header) {
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Set("Connection", "close")
+	resp := &http.Response{
+		StatusCode: code,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+	}
+	_ = resp.Write(conn)
+}
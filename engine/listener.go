@@ -0,0 +1,136 @@
+package engine
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lp2p/p2pvpn/context"
+	"github.com/lp2p/p2pvpn/log"
+)
+
+// maxAcceptDelay caps the backoff after temporary accept errors.
+const maxAcceptDelay = 1 * time.Second
+
+// serve accepts connections of l until it is closed, each one is handled
+// in its own goroutine and tracked until handle returns.
+func (e *engine) serve(name string, l net.Listener, handle func(conn net.Conn)) {
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			// Back off on errors like running out of file descriptors.
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			log.Debugf("%s accept error: %v, retrying in %v", name, err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+
+		e.handle(conn, handle)
+	}
+}
+
+// handle runs handle for conn in a new goroutine and tracks conn until it
+// returns, conn is closed instead while the engine is stopping.
+func (e *engine) handle(conn net.Conn, handle func(conn net.Conn)) {
+	if !e.track(conn) {
+		_ = conn.Close()
+		return
+	}
+
+	go func() {
+		defer e.untrack(conn)
+		handle(conn)
+	}()
+}
+
+// addCloser registers a listener or device to close when the engine stops.
+func (e *engine) addCloser(c interface{ Close() error }) {
+	e.mx.Lock()
+	e.closers = append(e.closers, c)
+	e.mx.Unlock()
+}
+
+// trackedConn untracks a connection handed to the tunnel once it is closed.
+type trackedConn struct {
+	context.Conn
+	e    *engine
+	once sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { c.e.untrack(c.Conn) })
+	return err
+}
+
+// trackConn tracks conn until the returned connection is closed, ok is
+// false while the engine is stopping.
+func (e *engine) trackConn(conn context.Conn) (context.Conn, bool) {
+	if !e.track(conn) {
+		return nil, false
+	}
+	return &trackedConn{Conn: conn, e: e}, true
+}
+
+func (e *engine) track(conn io.Closer) bool {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+
+	if e.closing {
+		return false
+	}
+	if e.conns == nil {
+		e.conns = make(map[io.Closer]struct{})
+	}
+	e.conns[conn] = struct{}{}
+	e.active.Add(1)
+	return true
+}
+
+func (e *engine) untrack(conn io.Closer) {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+
+	if _, ok := e.conns[conn]; ok {
+		delete(e.conns, conn)
+		e.active.Done()
+	}
+}
+
+// drain waits for the tracked connections to finish until timeout, the
+// remaining ones are closed. It reports how many were closed.
+func (e *engine) drain(timeout time.Duration) int {
+	done := make(chan struct{})
+	go func() {
+		e.active.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return 0
+	case <-timer.C:
+	}
+
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	for conn := range e.conns {
+		_ = conn.Close()
+	}
+	return len(e.conns)
+}
@@ -0,0 +1,265 @@
+package engine
+
+import (
+	gocontext "context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/lp2p/p2pvpn/api/route"
+	"github.com/lp2p/p2pvpn/log"
+	"github.com/lp2p/p2pvpn/server"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/whyrusleeping/mdns"
+)
+
+const (
+	// mdnsService is the mDNS service peers advertise themselves as.
+	mdnsService = "_p2pvpn._udp"
+	// mdnsInterval is how often the LAN is queried, peers found are
+	// remembered for three intervals.
+	mdnsInterval = 10 * time.Second
+	mdnsTTL      = 3 * mdnsInterval
+	// mdnsQueryTimeout bounds the wait for answers of one query.
+	mdnsQueryTimeout = 5 * time.Second
+)
+
+// TXT fields of the advertisement. The signed fingerprint record does not
+// fit in one TXT string of 255 bytes, it is split in numbered fields of
+// mdnsRecordChunk bytes of base64, record0=, record1= and so on.
+const (
+	mdnsPeerField        = "peer="
+	mdnsFingerprintField = "fingerprint="
+	mdnsNetworkField     = "network="
+	mdnsRecordField      = "record"
+	mdnsRecordChunk      = 200
+)
+
+func init() {
+	mdns.DisableLogging = true
+}
+
+// initMDNS advertises our peer ID and signed fingerprint record on the LAN
+// and looks for the peers of our network there. Their LAN addresses are
+// dialed directly, and their fingerprints resolve when no server answers.
+func (e *engine) initMDNS() error {
+	var ips []net.IP
+	port := 0
+	addrs, err := e.host.Network().InterfaceListenAddresses()
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		na, err := manet.ToNetAddr(addr)
+		if err != nil {
+			continue
+		}
+		if tcp, ok := na.(*net.TCPAddr); ok && !tcp.IP.IsLoopback() {
+			if port == 0 {
+				port = tcp.Port
+			}
+			ips = append(ips, tcp.IP)
+		}
+	}
+	if port == 0 {
+		return errors.New("mdns: no TCP listen address on the LAN")
+	}
+
+	txt := []string{
+		mdnsPeerField + e.host.ID().Pretty(),
+		mdnsNetworkField + e.Network,
+	}
+	if e.Fingerprint != "" {
+		priv := e.host.Peerstore().PrivKey(e.host.ID())
+		if priv == nil {
+			return fmt.Errorf("mdns: no private key for %s", e.host.ID())
+		}
+		rec, err := server.SealFingerprint(e.Fingerprint, priv)
+		if err != nil {
+			return fmt.Errorf("mdns: %w", err)
+		}
+		txt = append(txt, mdnsFingerprintField+e.Fingerprint)
+		txt = append(txt, recordFields(rec)...)
+	}
+	service, err := mdns.NewMDNSService(e.host.ID().Pretty(), mdnsService, "", "", port, ips, txt)
+	if err != nil {
+		return fmt.Errorf("mdns: %w", err)
+	}
+	srv, err := mdns.NewServer(&mdns.Config{Zone: service})
+	if err != nil {
+		return fmt.Errorf("mdns: %w", err)
+	}
+	e.addCloser(mdnsServer{srv})
+
+	go e.pollMDNS(e.host, e.done)
+	log.Infof("Advertising %s on the LAN over mDNS", e.Fingerprint)
+	return nil
+}
+
+// mdnsServer closes an mdns.Server.
+type mdnsServer struct {
+	*mdns.Server
+}
+
+func (s mdnsServer) Close() error {
+	return s.Shutdown()
+}
+
+// pollMDNS queries the LAN for the peers of h every mdnsInterval until
+// done is closed.
+func (e *engine) pollMDNS(h host.Host, done chan struct{}) {
+	ticker := time.NewTicker(mdnsInterval)
+	defer ticker.Stop()
+	for {
+		entries := make(chan *mdns.ServiceEntry, 16)
+		go func() {
+			for entry := range entries {
+				e.handleMDNSEntry(h, entry)
+			}
+		}()
+		err := mdns.Query(&mdns.QueryParam{
+			Service: mdnsService,
+			Domain:  "local",
+			Timeout: mdnsQueryTimeout,
+			Entries: entries,
+		})
+		close(entries)
+		if err != nil {
+			log.Debugf("mDNS query failed: %v", err)
+		}
+
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *engine) handleMDNSEntry(h host.Host, entry *mdns.ServiceEntry) {
+	pi, fingerprint, err := parseMDNSEntry(entry, e.Network)
+	if err != nil {
+		log.Debugf("Ignored mDNS entry %s: %v", entry.Name, err)
+		return
+	}
+	if pi.ID == h.ID() {
+		return
+	}
+
+	h.Peerstore().AddAddrs(pi.ID, pi.Addrs, mdnsTTL)
+	if fingerprint != "" {
+		route.Router().AddLANPeer(fingerprint, pi.ID, mdnsTTL)
+	}
+	if h.Network().Connectedness(pi.ID) == network.Connected {
+		return
+	}
+	log.Debugf("Found %s (%s) on the LAN at %v", pi.ID, fingerprint, pi.Addrs)
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), mdnsQueryTimeout)
+	defer cancel()
+	if err := h.Connect(ctx, pi); err != nil {
+		log.Debugf("Failed to connect %s on the LAN: %v", pi.ID, err)
+	}
+}
+
+// recordFields splits the fingerprint record rec in TXT fields.
+func recordFields(rec []byte) []string {
+	encoded := base64.RawStdEncoding.EncodeToString(rec)
+	var fields []string
+	for i := 0; len(encoded) > 0; i++ {
+		n := mdnsRecordChunk
+		if n > len(encoded) {
+			n = len(encoded)
+		}
+		fields = append(fields, mdnsRecordField+strconv.Itoa(i)+"="+encoded[:n])
+		encoded = encoded[n:]
+	}
+	return fields
+}
+
+// parseMDNSEntry returns the peer and the fingerprint of an advertisement
+// of a peer of network. The fingerprint is only returned with a record
+// signed by the peer.
+func parseMDNSEntry(entry *mdns.ServiceEntry, network string) (peer.AddrInfo, string, error) {
+	var id, fingerprint, entryNetwork string
+	chunks := make(map[int]string)
+	for _, field := range entry.InfoFields {
+		switch {
+		case strings.HasPrefix(field, mdnsPeerField):
+			id = strings.TrimPrefix(field, mdnsPeerField)
+		case strings.HasPrefix(field, mdnsFingerprintField):
+			fingerprint = strings.TrimPrefix(field, mdnsFingerprintField)
+		case strings.HasPrefix(field, mdnsNetworkField):
+			entryNetwork = strings.TrimPrefix(field, mdnsNetworkField)
+		case strings.HasPrefix(field, mdnsRecordField):
+			kv := strings.SplitN(strings.TrimPrefix(field, mdnsRecordField), "=", 2)
+			if i, err := strconv.Atoi(kv[0]); err == nil && len(kv) == 2 {
+				chunks[i] = kv[1]
+			}
+		}
+	}
+	if entryNetwork != network {
+		return peer.AddrInfo{}, "", fmt.Errorf("peer of network %q", entryNetwork)
+	}
+	pid, err := peer.Decode(id)
+	if err != nil {
+		return peer.AddrInfo{}, "", err
+	}
+	if fingerprint != "" {
+		if err := checkRecordChunks(chunks, fingerprint, pid); err != nil {
+			return peer.AddrInfo{}, "", err
+		}
+	}
+
+	pi := peer.AddrInfo{ID: pid}
+	for _, ip := range []net.IP{entry.AddrV4, entry.AddrV6} {
+		if ip == nil {
+			continue
+		}
+		addr, err := manet.FromNetAddr(&net.TCPAddr{IP: ip, Port: entry.Port})
+		if err != nil {
+			continue
+		}
+		pi.Addrs = append(pi.Addrs, addr)
+	}
+	if len(pi.Addrs) == 0 {
+		return peer.AddrInfo{}, "", errors.New("no address")
+	}
+	return pi, fingerprint, nil
+}
+
+// checkRecordChunks checks the record fields of an advertisement are a
+// record for fingerprint signed by id.
+func checkRecordChunks(chunks map[int]string, fingerprint string, id peer.ID) error {
+	indexes := make([]int, 0, len(chunks))
+	for i := range chunks {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	var encoded strings.Builder
+	for n, i := range indexes {
+		if i != n {
+			return fmt.Errorf("missing record field %d", n)
+		}
+		encoded.WriteString(chunks[i])
+	}
+	data, err := base64.RawStdEncoding.DecodeString(encoded.String())
+	if err != nil {
+		return fmt.Errorf("record: %w", err)
+	}
+	rec, err := server.OpenFingerprint(data, fingerprint)
+	if err != nil {
+		return err
+	}
+	if rec.PeerID != id {
+		return fmt.Errorf("%w: record is for %s, not %s", server.ErrInvalidRecord, rec.PeerID, id)
+	}
+	return nil
+}
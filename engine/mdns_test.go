@@ -0,0 +1,66 @@
+package engine
+
+import (
+	"net"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/lp2p/p2pvpn/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/whyrusleeping/mdns"
+)
+
+func TestParseMDNSEntry(t *testing.T) {
+	priv, _, err := crypto.GenerateEd25519Key(nil)
+	require.NoError(t, err)
+	id, err := peer.IDFromPrivateKey(priv)
+	require.NoError(t, err)
+	rec, err := server.SealFingerprint("laptop", priv)
+	require.NoError(t, err)
+
+	fields := []string{mdnsPeerField + id.Pretty(), mdnsNetworkField + "lab", mdnsFingerprintField + "laptop"}
+	entry := &mdns.ServiceEntry{
+		AddrV4:     net.ParseIP("192.168.1.2"),
+		Port:       4001,
+		InfoFields: append(fields, recordFields(rec)...),
+	}
+	for _, field := range entry.InfoFields {
+		assert.LessOrEqual(t, len(field), 255)
+	}
+
+	pi, fingerprint, err := parseMDNSEntry(entry, "lab")
+	require.NoError(t, err)
+	assert.Equal(t, id, pi.ID)
+	assert.Equal(t, "laptop", fingerprint)
+	require.Len(t, pi.Addrs, 1)
+	assert.Equal(t, "/ip4/192.168.1.2/tcp/4001", pi.Addrs[0].String())
+
+	// Peers of other networks are ignored.
+	_, _, err = parseMDNSEntry(entry, "")
+	assert.Error(t, err)
+
+	// Fingerprints need a record signed by the peer.
+	entry.InfoFields = fields
+	_, _, err = parseMDNSEntry(entry, "lab")
+	assert.Error(t, err)
+	other, _, err := crypto.GenerateEd25519Key(nil)
+	require.NoError(t, err)
+	forged, err := server.SealFingerprint("laptop", other)
+	require.NoError(t, err)
+	entry.InfoFields = append(fields, recordFields(forged)...)
+	_, _, err = parseMDNSEntry(entry, "lab")
+	assert.ErrorIs(t, err, server.ErrInvalidRecord)
+
+	// Without fingerprint the peer is still found.
+	entry.InfoFields = fields[:2]
+	pi, fingerprint, err = parseMDNSEntry(entry, "lab")
+	require.NoError(t, err)
+	assert.Equal(t, id, pi.ID)
+	assert.Empty(t, fingerprint)
+
+	entry.AddrV4 = nil
+	_, _, err = parseMDNSEntry(entry, "lab")
+	assert.Error(t, err)
+}
@@ -0,0 +1,194 @@
+package engine
+
+import (
+	gocontext "context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/lp2p/p2pvpn/log"
+)
+
+const (
+	// peerCacheTTL is how long a fingerprint lookup is reused, server
+	// events invalidate it sooner.
+	peerCacheTTL = 5 * time.Minute
+	// negativeCacheTTL is how long unknown fingerprints stay unknown.
+	negativeCacheTTL = 10 * time.Second
+	// warmInterval is how often the connections to the peers in use are
+	// checked, the warmPeers most used within warmWindow are kept open.
+	warmInterval = 30 * time.Second
+	warmWindow   = 5 * time.Minute
+	warmPeers    = 8
+	// warmTag protects the warm connections from the connection manager.
+	warmTag = "p2pvpn-warm"
+)
+
+// peerCache caches the peer IDs of fingerprints, unknown fingerprints
+// included, and counts the use of each peer to keep the connections to
+// the busiest ones open.
+type peerCache struct {
+	lookup func(fingerprint string) (peer.ID, error)
+	now    func() time.Time
+
+	mx      sync.Mutex
+	entries map[string]peerEntry
+	// uses are kept apart from entries, so invalidated peers stay warm.
+	uses map[peer.ID]*peerUse
+	warm map[peer.ID]bool
+}
+
+type peerEntry struct {
+	id      peer.ID
+	expires time.Time
+}
+
+// peerUse counts the resolutions to a peer since last was warmWindow ago.
+type peerUse struct {
+	count int
+	last  time.Time
+}
+
+func newPeerCache(lookup func(fingerprint string) (peer.ID, error)) *peerCache {
+	return &peerCache{
+		lookup:  lookup,
+		now:     time.Now,
+		entries: make(map[string]peerEntry),
+		uses:    make(map[peer.ID]*peerUse),
+		warm:    make(map[peer.ID]bool),
+	}
+}
+
+// Resolve returns the peer ID of fingerprint, empty if unknown, looking
+// it up when not cached. Failed lookups are not cached and drop the entry.
+func (c *peerCache) Resolve(fingerprint string) (peer.ID, error) {
+	now := c.now()
+	c.mx.Lock()
+	if e, ok := c.entries[fingerprint]; ok && now.Before(e.expires) {
+		c.use(e.id, now)
+		c.mx.Unlock()
+		return e.id, nil
+	}
+	c.mx.Unlock()
+
+	id, err := c.lookup(fingerprint)
+	now = c.now()
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if err != nil {
+		delete(c.entries, fingerprint)
+		return "", err
+	}
+	ttl := peerCacheTTL
+	if id == "" {
+		ttl = negativeCacheTTL
+	}
+	c.entries[fingerprint] = peerEntry{id: id, expires: now.Add(ttl)}
+	c.use(id, now)
+	return id, nil
+}
+
+// use counts a resolution to id, c.mx is held.
+func (c *peerCache) use(id peer.ID, now time.Time) {
+	if id == "" {
+		return
+	}
+	u, ok := c.uses[id]
+	if !ok || now.Sub(u.last) > warmWindow {
+		u = &peerUse{}
+		c.uses[id] = u
+	}
+	u.count++
+	u.last = now
+}
+
+// Invalidate drops the entry of fingerprint, the next Resolve looks it up.
+func (c *peerCache) Invalidate(fingerprint string) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	delete(c.entries, fingerprint)
+}
+
+// InvalidatePeer drops the entries resolving to id, a peer gone from the
+// server, and stops keeping it warm.
+func (c *peerCache) InvalidatePeer(id peer.ID) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	delete(c.uses, id)
+	for fingerprint, e := range c.entries {
+		if e.id == id {
+			delete(c.entries, fingerprint)
+		}
+	}
+}
+
+// busiest returns the n peers resolved the most within warmWindow.
+func (c *peerCache) busiest(n int) []peer.ID {
+	now := c.now()
+	c.mx.Lock()
+	uses := make(map[peer.ID]int)
+	for id, u := range c.uses {
+		if now.Sub(u.last) > warmWindow {
+			delete(c.uses, id)
+			continue
+		}
+		uses[id] = u.count
+	}
+	c.mx.Unlock()
+
+	ids := make([]peer.ID, 0, len(uses))
+	for id := range uses {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if uses[ids[i]] != uses[ids[j]] {
+			return uses[ids[i]] > uses[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	if len(ids) > n {
+		ids = ids[:n]
+	}
+	return ids
+}
+
+// keepWarm keeps the connections of h to the busiest peers open until done
+// is closed, so their streams do not wait for a dial.
+func (c *peerCache) keepWarm(h host.Host, done chan struct{}) {
+	ticker := time.NewTicker(warmInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		warm := make(map[peer.ID]bool)
+		for _, id := range c.busiest(warmPeers) {
+			warm[id] = true
+			h.ConnManager().Protect(id, warmTag)
+			if h.Network().Connectedness(id) == network.Connected {
+				continue
+			}
+			ctx, cancel := gocontext.WithTimeout(gocontext.Background(), warmInterval)
+			if err := h.Connect(ctx, peer.AddrInfo{ID: id}); err != nil {
+				log.Debugf("Failed to keep %s warm: %v", id, err)
+			}
+			cancel()
+		}
+
+		c.mx.Lock()
+		for id := range c.warm {
+			if !warm[id] {
+				h.ConnManager().Unprotect(id, warmTag)
+			}
+		}
+		c.warm = warm
+		c.mx.Unlock()
+	}
+}
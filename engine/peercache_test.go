@@ -0,0 +1,66 @@
+package engine
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerCache(t *testing.T) {
+	ids := map[string]peer.ID{"laptop": "laptop-id", "desktop": "desktop-id"}
+	var lookups int
+	var fail bool
+	c := newPeerCache(func(fingerprint string) (peer.ID, error) {
+		lookups++
+		if fail {
+			return "", errors.New("server down")
+		}
+		return ids[fingerprint], nil
+	})
+	now := time.Unix(1000, 0)
+	c.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		id, err := c.Resolve("laptop")
+		require.NoError(t, err)
+		assert.Equal(t, peer.ID("laptop-id"), id)
+	}
+	assert.Equal(t, 1, lookups)
+
+	// Unknown fingerprints are cached for a shorter time.
+	id, err := c.Resolve("exitbox")
+	require.NoError(t, err)
+	assert.Empty(t, id)
+	_, _ = c.Resolve("exitbox")
+	assert.Equal(t, 2, lookups)
+	now = now.Add(negativeCacheTTL + time.Second)
+	_, _ = c.Resolve("exitbox")
+	assert.Equal(t, 3, lookups)
+	_, _ = c.Resolve("laptop")
+	assert.Equal(t, 3, lookups)
+
+	// Failures are not cached, they drop the entry.
+	c.Invalidate("laptop")
+	fail = true
+	_, err = c.Resolve("laptop")
+	assert.Error(t, err)
+	fail = false
+	_, _ = c.Resolve("laptop")
+	assert.Equal(t, 5, lookups)
+
+	_, _ = c.Resolve("desktop")
+	assert.Equal(t, []peer.ID{"laptop-id", "desktop-id"}, c.busiest(2))
+	assert.Equal(t, []peer.ID{"laptop-id"}, c.busiest(1))
+
+	c.InvalidatePeer("desktop-id")
+	_, _ = c.Resolve("desktop")
+	assert.Equal(t, 7, lookups)
+
+	// Peers not used within the window are not kept warm.
+	now = now.Add(warmWindow + time.Second)
+	assert.Empty(t, c.busiest(2))
+}
@@ -0,0 +1,233 @@
+package engine
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lp2p/p2pvpn/common/pool"
+	"github.com/lp2p/p2pvpn/constant"
+	"github.com/lp2p/p2pvpn/log"
+	"github.com/lp2p/p2pvpn/transport/socks5"
+	"github.com/lp2p/p2pvpn/tunnel"
+)
+
+// udpQueueLen is the number of datagrams buffered while a session's
+// stream is being set up.
+const udpQueueLen = 64
+
+// udpSession relays the datagrams of one SOCKS client to one peer.
+type udpSession struct {
+	fingerprint string
+	src         net.Addr
+	// fakeIP is the fake IP of fingerprint the client sends to, replies
+	// come from it.
+	fakeIP string
+	ch     chan []byte
+	// done is closed when the association of the session ends.
+	done chan struct{}
+}
+
+// udpAssoc is the UDP association of a SOCKS control connection, only the
+// datagrams of its client are relayed.
+type udpAssoc struct {
+	ip net.IP
+	// port is the port the client sends from, zero until its first
+	// datagram when it did not tell it.
+	port     int
+	sessions map[string]*udpSession
+}
+
+func (a *udpAssoc) match(src *net.UDPAddr) bool {
+	return a.ip.Equal(src.IP) && (a.port == 0 || a.port == src.Port)
+}
+
+// udpRelay reads the SOCKS UDP requests of pc and dispatches them to the
+// sessions of their association, keyed by target fingerprint.
+type udpRelay struct {
+	e  *engine
+	pc net.PacketConn
+
+	mx     sync.Mutex
+	assocs []*udpAssoc
+}
+
+func newUDPRelay(e *engine, pc net.PacketConn) *udpRelay {
+	return &udpRelay{e: e, pc: pc}
+}
+
+// associate starts the association of the control connection from client,
+// which asked to send from addr.
+func (r *udpRelay) associate(client net.Addr, addr socks5.Addr) *udpAssoc {
+	a := &udpAssoc{sessions: make(map[string]*udpSession)}
+	if tcp, ok := client.(*net.TCPAddr); ok {
+		a.ip = tcp.IP
+	}
+	if udp := addr.UDPAddr(); udp != nil {
+		a.port = udp.Port
+	}
+	r.mx.Lock()
+	r.assocs = append(r.assocs, a)
+	r.mx.Unlock()
+	return a
+}
+
+// release ends the association a, its sessions are closed.
+func (r *udpRelay) release(a *udpAssoc) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	for i, other := range r.assocs {
+		if other == a {
+			r.assocs = append(r.assocs[:i], r.assocs[i+1:]...)
+			break
+		}
+	}
+	for fingerprint, s := range a.sessions {
+		delete(a.sessions, fingerprint)
+		close(s.done)
+	}
+}
+
+// lookup returns the association of src, r.mx is held. A client that did
+// not tell its port is bound to the port of its first datagram.
+func (r *udpRelay) lookup(src net.Addr) *udpAssoc {
+	udp, ok := src.(*net.UDPAddr)
+	if !ok {
+		return nil
+	}
+	for _, a := range r.assocs {
+		if a.match(udp) && a.port != 0 {
+			return a
+		}
+	}
+	for _, a := range r.assocs {
+		if a.match(udp) {
+			a.port = udp.Port
+			return a
+		}
+	}
+	return nil
+}
+
+func (r *udpRelay) serve() {
+	for {
+		buf := pool.Get(tunnel.MaxUDPFrameLen)
+		n, src, err := r.pc.ReadFrom(buf)
+		if err != nil {
+			pool.Put(buf)
+			log.Debugf("SOCKS UDP read error: %v", err)
+			return
+		}
+
+		target, _, err := socks5.DecodeUDPPacket(buf[:n])
+		if err != nil {
+			pool.Put(buf)
+			log.Debugf("SOCKS UDP decode error: %v", err)
+			continue
+		}
+		fingerprint, _ := r.e.peerTarget(target)
+		host, _ := target.ToHostPort()
+
+		r.mx.Lock()
+		a := r.lookup(src)
+		if a == nil {
+			r.mx.Unlock()
+			pool.Put(buf)
+			log.Debugf("Dropped SOCKS UDP datagram from %s without association", src)
+			continue
+		}
+		s, ok := a.sessions[fingerprint]
+		if !ok {
+			s = &udpSession{
+				fingerprint: fingerprint,
+				src:         src,
+				ch:          make(chan []byte, udpQueueLen),
+				done:        make(chan struct{}),
+			}
+			if host != fingerprint && net.ParseIP(host) != nil {
+				s.fakeIP = host
+			}
+			a.sessions[fingerprint] = s
+			go func() {
+				defer r.remove(a, s)
+				r.e.runUDPSession(r.pc, s)
+			}()
+		}
+		select {
+		case s.ch <- buf[:n]:
+		default:
+			// Drop the datagram when the session falls behind.
+			pool.Put(buf)
+		}
+		r.mx.Unlock()
+	}
+}
+
+// remove forgets the session s of a once it ended.
+func (r *udpRelay) remove(a *udpAssoc, s *udpSession) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if a.sessions[s.fingerprint] == s {
+		delete(a.sessions, s.fingerprint)
+	}
+	close(s.ch)
+}
+
+// runUDPSession opens a stream to the session's peer and relays datagrams
+// both ways until the session is idle for tunnel.UDPSessionTimeout or its
+// association ends.
+func (e *engine) runUDPSession(pc net.PacketConn, s *udpSession) {
+	stream, err := e.newStream(s.fingerprint, constant.UDPProtocol)
+	if err != nil {
+		log.Warnf("Starting new udp stream failed: %v", err)
+		return
+	}
+	defer stream.Close()
+
+	ended := make(chan struct{})
+	defer close(ended)
+	go func() {
+		select {
+		case <-s.done:
+			_ = stream.Reset()
+		case <-ended:
+		}
+	}()
+
+	log.Infof("New udp stream: %s <--> %s", s.src, stream.ID())
+
+	go func() {
+		for pkt := range s.ch {
+			target, payload, _ := socks5.DecodeUDPPacket(pkt)
+			_, target = e.peerTarget(target)
+			_ = stream.SetReadDeadline(time.Now().Add(tunnel.UDPSessionTimeout))
+			err := tunnel.WriteUDPFrame(stream, target, payload)
+			pool.Put(pkt)
+			if err != nil {
+				_ = stream.Reset()
+			}
+		}
+	}()
+
+	buf := pool.Get(tunnel.MaxUDPFrameLen)
+	defer pool.Put(buf)
+
+	for {
+		_ = stream.SetReadDeadline(time.Now().Add(tunnel.UDPSessionTimeout))
+		addr, payload, err := tunnel.ReadUDPFrame(stream, buf)
+		if err != nil {
+			return
+		}
+		if host, port := addr.ToHostPort(); s.fakeIP != "" && host == s.fingerprint {
+			addr = socks5.ParseAddr(net.JoinHostPort(s.fakeIP, port))
+		}
+
+		pkt, err := socks5.EncodeUDPPacket(addr, payload)
+		if err != nil {
+			continue
+		}
+		if _, err := pc.WriteTo(pkt, s.src); err != nil {
+			log.Debugf("SOCKS UDP write error: %v", err)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package engine
+
+import (
+	"net"
+	"testing"
+
+	"github.com/lp2p/p2pvpn/transport/socks5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUDPAssociation(t *testing.T) {
+	r := newUDPRelay(nil, nil)
+	client := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 50000}
+
+	told := r.associate(client, socks5.ParseAddr("0.0.0.0:4000"))
+	untold := r.associate(client, socks5.ParseAddr("0.0.0.0:0"))
+
+	r.mx.Lock()
+	assert.Equal(t, told, r.lookup(&net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 4000}))
+	// The untold association is bound to the first other port.
+	assert.Equal(t, untold, r.lookup(&net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 4001}))
+	assert.Nil(t, r.lookup(&net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 4002}))
+	assert.Nil(t, r.lookup(&net.UDPAddr{IP: net.ParseIP("10.0.0.3"), Port: 4000}))
+	r.mx.Unlock()
+
+	s := &udpSession{fingerprint: "laptop", done: make(chan struct{})}
+	told.sessions["laptop"] = s
+	r.release(told)
+	assert.Empty(t, told.sessions)
+	select {
+	case <-s.done:
+	default:
+		t.Fatal("session not closed with its association")
+	}
+
+	r.mx.Lock()
+	assert.Nil(t, r.lookup(&net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 4000}))
+	r.mx.Unlock()
+}
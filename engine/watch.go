@@ -0,0 +1,86 @@
+package engine
+
+import (
+	gocontext "context"
+	"errors"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/lp2p/p2pvpn/api/route"
+	"github.com/lp2p/p2pvpn/log"
+	"github.com/lp2p/p2pvpn/server"
+)
+
+// maxWatchBackoff bounds the delay between reconnects of the watch.
+const maxWatchBackoff = time.Minute
+
+// initWatch follows the events of the server until the engine stops, so
+// the addrs we know of other peers are never stale for long.
+func (e *engine) initWatch() error {
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	done, h, cache := e.done, e.host, e.peerCache
+
+	go func() {
+		<-done
+		cancel()
+	}()
+
+	go func() {
+		backoff := time.Second
+		for {
+			events, err := route.Router().Watch(ctx)
+			if errors.Is(err, route.ErrWatchUnsupported) {
+				log.Infof("Server does not support watch, peer addrs are refreshed on dial only")
+				return
+			}
+			if err != nil {
+				log.Debugf("Watch failed: %v", err)
+			} else {
+				backoff = time.Second
+				for ev := range events {
+					applyEvent(h, cache, ev)
+				}
+			}
+
+			select {
+			case <-done:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > maxWatchBackoff {
+				backoff = maxWatchBackoff
+			}
+		}
+	}()
+
+	return nil
+}
+
+// applyEvent updates the peerstore of h and the fingerprints cached with
+// an event of the server.
+func applyEvent(h host.Host, cache *peerCache, ev server.Event) {
+	id := ev.Peer.ID
+	if id == h.ID() {
+		return
+	}
+	log.Debugf("Peer %s (%s): %s", id, ev.Fingerprint, ev.Type)
+
+	ps := h.Peerstore()
+	switch ev.Type {
+	case server.EventRegister, server.EventUpdate:
+		// Only peers we talked to are worth remembering.
+		if len(ps.Addrs(id)) > 0 {
+			ps.SetAddrs(id, ev.Peer.Addrs, peerstore.AddressTTL)
+		}
+		// The fingerprint may be new or bound to another peer now.
+		if cache != nil && ev.Fingerprint != "" {
+			cache.Invalidate(ev.Fingerprint)
+		}
+	case server.EventExpire, server.EventLogout, server.EventKick:
+		ps.ClearAddrs(id)
+		if cache != nil {
+			cache.InvalidatePeer(id)
+		}
+	}
+}
@@ -5,7 +5,6 @@ go 1.16
 require (
 	github.com/flynn/noise v0.0.0-20210331153838-4bdb43be3117 // indirect
 	github.com/gin-gonic/gin v1.7.2
-	github.com/google/uuid v1.2.0 // indirect
 	github.com/ipfs/go-cid v0.0.7
 	github.com/ipfs/go-log/v2 v2.1.3
 	github.com/klauspost/cpuid/v2 v2.0.6 // indirect
@@ -13,12 +12,18 @@ require (
 	github.com/libp2p/go-libp2p v0.13.1-0.20210415091742-3ef2f761d294
 	github.com/libp2p/go-libp2p-circuit v0.4.0
 	github.com/libp2p/go-libp2p-core v0.8.5
+	github.com/libp2p/go-libp2p-kad-dht v0.12.2
 	github.com/libp2p/go-libp2p-noise v0.1.3 // indirect
+	github.com/libp2p/go-libp2p-record v0.1.3
+	github.com/miekg/dns v1.1.41
 	github.com/multiformats/go-multiaddr v0.3.1
 	github.com/multiformats/go-multiaddr-dns v0.3.1 // indirect
 	github.com/multiformats/go-multihash v0.0.15
 	github.com/stretchr/testify v1.7.0
+	github.com/whyrusleeping/mdns v0.0.0-20190826153040-b9b60ed33aa9
+	go.etcd.io/bbolt v1.3.6
 	go.uber.org/atomic v1.8.0 // indirect
-	go.uber.org/multierr v1.7.0 // indirect
+	go.uber.org/multierr v1.7.0
 	go.uber.org/zap v1.17.0
+	gopkg.in/yaml.v2 v2.3.0
 )
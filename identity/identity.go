@@ -0,0 +1,182 @@
+// Package identity keeps the libp2p private key of a host in a file, so its
+// peer ID survives restarts.
+package identity
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// DefaultPath returns the key file called name in the user config directory,
+// or in the working directory if there is none.
+func DefaultPath(name string) string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return name
+	}
+	return filepath.Join(dir, "p2pvpn", name)
+}
+
+// Load reads the private key stored at path.
+func Load(path string) (crypto.PrivKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decode(data)
+}
+
+// LoadOrGenerate reads the private key stored at path, a new Ed25519 key
+// is generated and stored if the file does not exist.
+func LoadOrGenerate(path string) (crypto.PrivKey, bool, error) {
+	priv, err := Load(path)
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return priv, false, err
+	}
+
+	priv, _, err = crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := Save(path, priv); err != nil {
+		return nil, false, err
+	}
+	return priv, true, nil
+}
+
+// Save stores priv at path, readable by the owner only.
+func Save(path string, priv crypto.PrivKey) error {
+	data, err := encode(priv)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, a crash never leaves a torn key.
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Export writes the key stored at path to w.
+func Export(path string, w io.Writer) error {
+	priv, err := Load(path)
+	if err != nil {
+		return err
+	}
+	data, err := encode(priv)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// Import stores the key read from r at path. An existing different key is
+// not replaced, it has to be removed first.
+func Import(path string, r io.Reader) (peer.ID, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	priv, err := decode(data)
+	if err != nil {
+		return "", err
+	}
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return "", err
+	}
+
+	if old, err := Load(path); err == nil {
+		if old.Equals(priv) {
+			return id, nil
+		}
+		return "", fmt.Errorf("identity: %s already holds another key", path)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	return id, Save(path, priv)
+}
+
+// encode marshals priv as base64 text, the same form as IPFS configs.
+func encode(priv crypto.PrivKey) ([]byte, error) {
+	raw, err := crypto.MarshalPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, base64.StdEncoding.EncodedLen(len(raw)), base64.StdEncoding.EncodedLen(len(raw))+1)
+	base64.StdEncoding.Encode(data, raw)
+	return append(data, '\n'), nil
+}
+
+func decode(data []byte) (crypto.PrivKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil {
+		return nil, fmt.Errorf("identity: invalid key file: %w", err)
+	}
+	priv, err := crypto.UnmarshalPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("identity: invalid key file: %w", err)
+	}
+	return priv, nil
+}
+
+// Run performs the export to exportTo or the import from importFrom of the
+// key stored at path, as asked on the command line; "-" is stdout or stdin.
+// It reports whether anything was asked, and the peer ID of an imported
+// key.
+func Run(path, exportTo, importFrom string) (bool, peer.ID, error) {
+	switch {
+	case exportTo != "" && importFrom != "":
+		return true, "", errors.New("identity: export and import are exclusive")
+	case exportTo == "-":
+		return true, "", Export(path, os.Stdout)
+	case exportTo != "":
+		// Never overwrite a file, it may hold another key.
+		f, err := os.OpenFile(exportTo, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return true, "", err
+		}
+		err = Export(path, f)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		return true, "", err
+	case importFrom == "-":
+		id, err := Import(path, os.Stdin)
+		return true, id, err
+	case importFrom != "":
+		data, err := os.ReadFile(importFrom)
+		if err != nil {
+			return true, "", err
+		}
+		id, err := Import(path, bytes.NewReader(data))
+		return true, id, err
+	}
+	return false, "", nil
+}
@@ -0,0 +1,84 @@
+package identity
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadOrGenerate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "p2pvpn", "client.key")
+
+	priv, created, err := LoadOrGenerate(path)
+	require.NoError(t, err)
+	assert.True(t, created)
+
+	again, created, err := LoadOrGenerate(path)
+	require.NoError(t, err)
+	assert.False(t, created)
+	assert.True(t, priv.Equals(again))
+}
+
+func TestExportImport(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "a.key")
+	priv, _, err := LoadOrGenerate(src)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, Export(src, &buf))
+	exported := buf.String()
+
+	dst := filepath.Join(dir, "b.key")
+	id, err := Import(dst, bytes.NewBufferString(exported))
+	require.NoError(t, err)
+	want, _ := peer.IDFromPrivateKey(priv)
+	assert.Equal(t, want, id)
+
+	// Importing the same key again is a no-op, another key is refused.
+	_, err = Import(dst, bytes.NewBufferString(exported))
+	assert.NoError(t, err)
+	other := filepath.Join(dir, "c.key")
+	_, _, err = LoadOrGenerate(other)
+	require.NoError(t, err)
+	buf.Reset()
+	require.NoError(t, Export(other, &buf))
+	_, err = Import(dst, &buf)
+	assert.Error(t, err)
+
+	_, err = Import(dst, bytes.NewBufferString("garbage"))
+	assert.Error(t, err)
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "a.key")
+	priv, _, err := LoadOrGenerate(src)
+	require.NoError(t, err)
+	want, err := peer.IDFromPrivateKey(priv)
+	require.NoError(t, err)
+
+	ok, _, err := Run(src, "", "")
+	assert.False(t, ok)
+	assert.NoError(t, err)
+
+	exported := filepath.Join(dir, "exported.key")
+	ok, _, err = Run(src, exported, "")
+	assert.True(t, ok)
+	require.NoError(t, err)
+	// An existing file is never overwritten.
+	_, _, err = Run(src, exported, "")
+	assert.Error(t, err)
+
+	ok, id, err := Run(filepath.Join(dir, "b.key"), "", exported)
+	assert.True(t, ok)
+	require.NoError(t, err)
+	assert.Equal(t, want, id)
+
+	_, _, err = Run(src, exported, exported)
+	assert.Error(t, err)
+}
@@ -0,0 +1,84 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// GroupPrefix marks a reference to a named group of peers.
+const GroupPrefix = "group:"
+
+// Resolver resolves a fingerprint to its peer ID.
+type Resolver func(fingerprint string) (peer.ID, error)
+
+// Matcher matches peers against entries that are peer IDs, fingerprints
+// or "group:<name>" references.
+type Matcher struct {
+	groups  map[string][]string
+	resolve Resolver
+}
+
+// NewMatcher creates a Matcher, groups map names to peer IDs or
+// fingerprints and resolve looks fingerprints up.
+func NewMatcher(groups map[string][]string, resolve Resolver) (*Matcher, error) {
+	for name, members := range groups {
+		for _, m := range members {
+			if strings.HasPrefix(m, GroupPrefix) {
+				return nil, fmt.Errorf("policy: group %s: nested group %s", name, m)
+			}
+		}
+	}
+	return &Matcher{groups: groups, resolve: resolve}, nil
+}
+
+// Validate checks that entries only refer to known groups.
+func (m *Matcher) Validate(entries []string) error {
+	for _, e := range entries {
+		if !strings.HasPrefix(e, GroupPrefix) {
+			continue
+		}
+		if _, ok := m.groups[strings.TrimPrefix(e, GroupPrefix)]; !ok {
+			return fmt.Errorf("unknown group %q", e)
+		}
+	}
+	return nil
+}
+
+// Match reports whether id is one of entries. Peer IDs are compared first,
+// fingerprints are only resolved when no peer ID matched.
+func (m *Matcher) Match(entries []string, id peer.ID) bool {
+	var fingerprints []string
+	for _, e := range m.expand(entries) {
+		if pid, err := peer.Decode(e); err == nil {
+			if pid == id {
+				return true
+			}
+			continue
+		}
+		fingerprints = append(fingerprints, e)
+	}
+
+	if m.resolve == nil {
+		return false
+	}
+	for _, fingerprint := range fingerprints {
+		if pid, err := m.resolve(fingerprint); err == nil && pid == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Matcher) expand(entries []string) []string {
+	expanded := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if strings.HasPrefix(e, GroupPrefix) {
+			expanded = append(expanded, m.groups[strings.TrimPrefix(e, GroupPrefix)]...)
+		} else {
+			expanded = append(expanded, e)
+		}
+	}
+	return expanded
+}
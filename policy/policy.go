@@ -0,0 +1,311 @@
+// Package policy decides which destinations remote peers may reach through
+// the exit side of the stream handler.
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Action is the verdict of a rule.
+type Action string
+
+const (
+	Allow Action = "allow"
+	Deny  Action = "deny"
+)
+
+// ErrDenied is returned for destinations the policy refuses.
+var ErrDenied = errors.New("policy: denied")
+
+// lookupTimeout bounds the DNS lookup of domain destinations.
+const lookupTimeout = 5 * time.Second
+
+// privateNets are denied unless a rule allows them: private, loopback and
+// link-local ranges, multicast and broadcast, and the benchmark range fake
+// IPs are taken from.
+var privateNets = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"255.255.255.255/32",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+// Rule matches a destination when every non-empty field matches,
+// a field matches when any of its entries does.
+type Rule struct {
+	Action Action `yaml:"action"`
+	// CIDRs match the resolved destination address.
+	CIDRs []string `yaml:"cidrs,omitempty"`
+	// Ports are single ports or ranges like "8000-8080".
+	Ports []string `yaml:"ports,omitempty"`
+	// Domains match the requested host name and its subdomains.
+	Domains []string `yaml:"domains,omitempty"`
+	// Peers are peer IDs, fingerprints or "group:<name>" references
+	// matching the source peer.
+	Peers []string `yaml:"peers,omitempty"`
+}
+
+type portRange struct {
+	lo, hi int
+}
+
+type rule struct {
+	Rule
+	nets    []*net.IPNet
+	ports   []portRange
+	domains []string
+}
+
+// Policy evaluates rules in order, the first matching rule decides.
+// Destinations no rule matches are allowed unless they are private.
+type Policy struct {
+	rules    []*rule
+	peers    *Matcher
+	lookupIP func(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// New compiles rules, peers matches the source peers of Rule.Peers.
+func New(rules []Rule, peers *Matcher) (*Policy, error) {
+	p := &Policy{
+		peers: peers,
+		lookupIP: func(ctx context.Context, host string) ([]net.IP, error) {
+			return net.DefaultResolver.LookupIP(ctx, "ip", host)
+		},
+	}
+	for i, r := range rules {
+		compiled, err := compile(r)
+		if err == nil {
+			err = peers.Validate(r.Peers)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("policy: rule %d: %w", i, err)
+		}
+		p.rules = append(p.rules, compiled)
+	}
+	return p, nil
+}
+
+func compile(r Rule) (*rule, error) {
+	if r.Action != Allow && r.Action != Deny {
+		return nil, fmt.Errorf("unknown action %q", r.Action)
+	}
+
+	c := &rule{Rule: r}
+	for _, s := range r.CIDRs {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		c.nets = append(c.nets, n)
+	}
+	for _, s := range r.Ports {
+		pr, err := parsePortRange(s)
+		if err != nil {
+			return nil, err
+		}
+		c.ports = append(c.ports, pr)
+	}
+	for _, d := range r.Domains {
+		c.domains = append(c.domains, strings.ToLower(strings.Trim(d, ".")))
+	}
+	return c, nil
+}
+
+// ParseRule parses the text form of a rule, an action followed by
+// key=value fields with comma separated values, for example:
+//
+//	allow cidr=127.0.0.1/32 port=5432,8000-8080 peer=db-client
+func ParseRule(s string) (Rule, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return Rule{}, errors.New("policy: empty rule")
+	}
+
+	r := Rule{Action: Action(fields[0])}
+	for _, f := range fields[1:] {
+		i := strings.IndexByte(f, '=')
+		if i < 0 {
+			return Rule{}, fmt.Errorf("policy: invalid field %q", f)
+		}
+		values := strings.Split(f[i+1:], ",")
+		switch f[:i] {
+		case "cidr":
+			r.CIDRs = append(r.CIDRs, values...)
+		case "port":
+			r.Ports = append(r.Ports, values...)
+		case "domain":
+			r.Domains = append(r.Domains, values...)
+		case "peer":
+			r.Peers = append(r.Peers, values...)
+		default:
+			return Rule{}, fmt.Errorf("policy: unknown field %q", f[:i])
+		}
+	}
+
+	if _, err := compile(r); err != nil {
+		return Rule{}, fmt.Errorf("policy: %w", err)
+	}
+	return r, nil
+}
+
+func parsePortRange(s string) (portRange, error) {
+	lo, hi := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		lo, hi = s[:i], s[i+1:]
+	}
+	l, err := strconv.ParseUint(lo, 10, 16)
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port %q", s)
+	}
+	h, err := strconv.ParseUint(hi, 10, 16)
+	if err != nil || h < l {
+		return portRange{}, fmt.Errorf("invalid port %q", s)
+	}
+	return portRange{int(l), int(h)}, nil
+}
+
+// Check decides whether peer id may reach host:port. host is resolved if
+// it is a domain name, the returned address is the one that was checked
+// and must be the one dialed.
+func (p *Policy) Check(id peer.ID, host string, port int) (net.IP, error) {
+	ips := []net.IP{net.ParseIP(host)}
+	domain := ""
+	if ips[0] == nil {
+		domain = strings.ToLower(strings.TrimSuffix(host, "."))
+		ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+		defer cancel()
+
+		var err error
+		ips, err = p.lookupIP(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	for _, ip := range ips {
+		if err = p.check(id, domain, ip, port); err == nil {
+			return ip, nil
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("%w: no address for %s", ErrDenied, host)
+	}
+	return nil, err
+}
+
+// CheckLocal decides whether peer id may reach port of the local host, which
+// it asked for by our own fingerprint. The rules apply as in Check, but
+// loopback is allowed when none matches.
+func (p *Policy) CheckLocal(id peer.ID, port int) (net.IP, error) {
+	ip := net.IPv4(127, 0, 0, 1)
+	if err := p.checkRules(id, "", ip, port); err != nil && err != errNoMatch {
+		return nil, err
+	}
+	return ip, nil
+}
+
+func (p *Policy) check(id peer.ID, domain string, ip net.IP, port int) error {
+	if err := p.checkRules(id, domain, ip, port); err != errNoMatch {
+		return err
+	}
+	if containsIP(privateNets, ip) {
+		return fmt.Errorf("%w: %s is a private address", ErrDenied, ip)
+	}
+	return nil
+}
+
+// errNoMatch is returned by checkRules when no rule matches.
+var errNoMatch = errors.New("policy: no rule matches")
+
+// checkRules applies the first rule matching the destination, it returns
+// errNoMatch when there is none, and nil when the destination is allowed.
+func (p *Policy) checkRules(id peer.ID, domain string, ip net.IP, port int) error {
+	for i, r := range p.rules {
+		if !p.match(r, id, domain, ip, port) {
+			continue
+		}
+		if r.Action == Deny {
+			return fmt.Errorf("%w: %s port %d by rule %d", ErrDenied, ip, port, i)
+		}
+		return nil
+	}
+	return errNoMatch
+}
+
+func (p *Policy) match(r *rule, id peer.ID, domain string, ip net.IP, port int) bool {
+	if len(r.nets) > 0 && !containsIP(r.nets, ip) {
+		return false
+	}
+	if len(r.ports) > 0 && !containsPort(r.ports, port) {
+		return false
+	}
+	if len(r.domains) > 0 && !matchDomain(r.domains, domain) {
+		return false
+	}
+	if len(r.Peers) > 0 && !p.peers.Match(r.Peers, id) {
+		return false
+	}
+	return true
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPort(ports []portRange, port int) bool {
+	for _, r := range ports {
+		if port >= r.lo && port <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+func matchDomain(domains []string, domain string) bool {
+	if domain == "" {
+		return false
+	}
+	for _, d := range domains {
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, s := range cidrs {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
@@ -0,0 +1,163 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	alice = randPeerID()
+	bob   = randPeerID()
+)
+
+func randPeerID() peer.ID {
+	id, err := test.RandPeerID()
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
+
+func newTestMatcher(t *testing.T, groups map[string][]string) *Matcher {
+	m, err := NewMatcher(groups, func(fingerprint string) (peer.ID, error) {
+		if fingerprint == "alice-box" {
+			return alice, nil
+		}
+		return "", errors.New("not found")
+	})
+	require.NoError(t, err)
+	return m
+}
+
+func newTestPolicy(t *testing.T, rules ...string) *Policy {
+	var parsed []Rule
+	for _, s := range rules {
+		r, err := ParseRule(s)
+		require.NoError(t, err)
+		parsed = append(parsed, r)
+	}
+
+	p, err := New(parsed, newTestMatcher(t, map[string][]string{
+		"ops": {"alice-box"},
+	}))
+	require.NoError(t, err)
+
+	p.lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+		switch host {
+		case "db.corp.example":
+			return []net.IP{net.ParseIP("10.1.2.3")}, nil
+		case "example.com":
+			return []net.IP{net.ParseIP("93.184.216.34")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	return p
+}
+
+func TestDefaultDeniesPrivate(t *testing.T) {
+	p := newTestPolicy(t)
+
+	for _, host := range []string{"127.0.0.1", "10.0.0.1", "192.168.1.1", "::1", "fe80::1", "db.corp.example",
+		"224.0.0.251", "255.255.255.255", "ff02::1", "198.18.0.1"} {
+		_, err := p.Check(alice, host, 22)
+		assert.ErrorIs(t, err, ErrDenied, host)
+	}
+
+	ip, err := p.Check(alice, "example.com", 443)
+	assert.NoError(t, err)
+	assert.Equal(t, "93.184.216.34", ip.String())
+}
+
+func TestRules(t *testing.T) {
+	p := newTestPolicy(t,
+		"deny port=25",
+		"allow cidr=127.0.0.1/32 port=5432,8000-8080 peer=alice-box",
+		"allow domain=corp.example",
+		"allow cidr=192.168.0.0/16 peer=group:ops",
+	)
+
+	_, err := p.Check(alice, "127.0.0.1", 5432)
+	assert.NoError(t, err)
+	_, err = p.Check(alice, "127.0.0.1", 8080)
+	assert.NoError(t, err)
+	_, err = p.Check(alice, "127.0.0.1", 22)
+	assert.ErrorIs(t, err, ErrDenied)
+	_, err = p.Check(bob, "127.0.0.1", 5432)
+	assert.ErrorIs(t, err, ErrDenied)
+
+	ip, err := p.Check(bob, "db.corp.example", 3306)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.1.2.3", ip.String())
+
+	_, err = p.Check(alice, "example.com", 25)
+	assert.ErrorIs(t, err, ErrDenied)
+
+	_, err = p.Check(alice, "192.168.1.1", 22)
+	assert.NoError(t, err)
+	_, err = p.Check(bob, "192.168.1.1", 22)
+	assert.ErrorIs(t, err, ErrDenied)
+}
+
+func TestCheckLocal(t *testing.T) {
+	ip, err := newTestPolicy(t).CheckLocal(alice, 22)
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", ip.String())
+
+	p := newTestPolicy(t,
+		"allow cidr=127.0.0.1/32 port=22 peer=alice-box",
+		"deny cidr=127.0.0.1/32",
+	)
+	_, err = p.CheckLocal(alice, 22)
+	assert.NoError(t, err)
+	_, err = p.CheckLocal(bob, 22)
+	assert.ErrorIs(t, err, ErrDenied)
+	_, err = p.CheckLocal(alice, 5432)
+	assert.ErrorIs(t, err, ErrDenied)
+}
+
+func TestUnknownGroup(t *testing.T) {
+	_, err := New([]Rule{{Action: Allow, Peers: []string{"group:nobody"}}}, newTestMatcher(t, nil))
+	assert.Error(t, err)
+
+	_, err = NewMatcher(map[string][]string{"a": {"group:b"}}, nil)
+	assert.Error(t, err)
+}
+
+func TestMatcher(t *testing.T) {
+	m := newTestMatcher(t, map[string][]string{
+		"team-ops":    {"alice-box"},
+		"contractors": {peer.Encode(bob)},
+	})
+
+	assert.True(t, m.Match([]string{"group:team-ops"}, alice))
+	assert.False(t, m.Match([]string{"group:team-ops"}, bob))
+	assert.True(t, m.Match([]string{"group:contractors"}, bob))
+	assert.True(t, m.Match([]string{peer.Encode(alice)}, alice))
+	assert.False(t, m.Match([]string{"unknown-box"}, alice))
+	assert.NoError(t, m.Validate([]string{"group:team-ops", "alice-box"}))
+	assert.Error(t, m.Validate([]string{"group:interns"}))
+}
+
+func TestParseRule(t *testing.T) {
+	r, err := ParseRule("allow cidr=10.0.0.0/8 port=22,80-90 domain=corp peer=a,b")
+	require.NoError(t, err)
+	assert.Equal(t, Rule{
+		Action:  Allow,
+		CIDRs:   []string{"10.0.0.0/8"},
+		Ports:   []string{"22", "80-90"},
+		Domains: []string{"corp"},
+		Peers:   []string{"a", "b"},
+	}, r)
+
+	for _, s := range []string{"", "permit", "allow port=90-80", "allow cidr=10.0.0.0", "allow what=1"} {
+		_, err := ParseRule(s)
+		assert.Error(t, err, s)
+	}
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/lp2p/p2pvpn/common/auth"
+	"github.com/lp2p/p2pvpn/constant"
+	"github.com/lp2p/p2pvpn/log"
+)
+
+// PeerStatus is what the admin API tells about a registered peer.
+type PeerStatus struct {
+	Peer        peer.AddrInfo `json:"peer"`
+	Fingerprint string        `json:"fingerprint,omitempty"`
+	LastSeen    time.Time     `json:"last_seen"`
+	Expires     time.Time     `json:"expires"`
+}
+
+// Stats counts the entries of the route table.
+type Stats struct {
+	Peers          int `json:"peers"`
+	Fingerprints   int `json:"fingerprints"`
+	Owners         int `json:"owners"`
+	PendingRebinds int `json:"pending_rebinds"`
+	Watchers       int `json:"watchers"`
+}
+
+// Peers returns every registered peer, ordered by fingerprint.
+func (t *Table) Peers() []PeerStatus {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	fingerprints := make(map[peer.ID]string, len(t.fingerprints))
+	for fingerprint, id := range t.fingerprints {
+		fingerprints[id] = fingerprint
+	}
+	peers := make([]PeerStatus, 0, len(t.peers))
+	for id, pi := range t.peers {
+		l := t.leases[id]
+		peers = append(peers, PeerStatus{
+			Peer:        pi,
+			Fingerprint: fingerprints[id],
+			LastSeen:    l.LastSeen,
+			Expires:     l.Expires,
+		})
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].Fingerprint != peers[j].Fingerprint {
+			return peers[i].Fingerprint < peers[j].Fingerprint
+		}
+		return peers[i].Peer.ID < peers[j].Peer.ID
+	})
+	return peers
+}
+
+// PeerStatus returns the registration of peer id.
+func (t *Table) PeerStatus(id peer.ID) (PeerStatus, bool) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	pi, ok := t.peers[id]
+	if !ok {
+		return PeerStatus{}, false
+	}
+	l := t.leases[id]
+	return PeerStatus{
+		Peer:        pi,
+		Fingerprint: t.fingerprintOf(id),
+		LastSeen:    l.LastSeen,
+		Expires:     l.Expires,
+	}, true
+}
+
+// Kick removes peer id and its fingerprint. Ownership of the fingerprint
+// is kept, and registrations of the peer are refused with ErrKicked for
+// the TTL of its lease, so kicking works with a shared secret too.
+func (t *Table) Kick(id peer.ID) error {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	pi, ok := t.peers[id]
+	if !ok {
+		return ErrNotFound
+	}
+	ttl := DefaultLeaseTTL
+	if l, ok := t.leases[id]; ok {
+		ttl = l.Expires.Sub(l.LastSeen)
+	}
+	fingerprint := t.fingerprintOf(id)
+	if err := t.buryUntil(id, EventKick, t.now().Add(ttl)); err != nil {
+		return err
+	}
+	t.publish(EventKick, pi, fingerprint)
+	return nil
+}
+
+// Stats counts the entries of the table.
+func (t *Table) Stats() Stats {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	owners := 0
+	for _, o := range t.owners {
+		if !o.Released {
+			owners++
+		}
+	}
+	return Stats{
+		Peers:          len(t.peers),
+		Fingerprints:   len(t.fingerprints),
+		Owners:         owners,
+		PendingRebinds: len(t.pending),
+		Watchers:       len(t.subs),
+	}
+}
+
+// SetAdminTokens replaces the tokens accepted by the admin API.
+func (a *APIService) SetAdminTokens(tokens []Token) {
+	var credentials []auth.Credential
+	for _, t := range tokens {
+		if !t.Revoked {
+			credentials = append(credentials, auth.Credential{ID: t.ID, Secret: t.Secret})
+		}
+	}
+	a.admin.SetCredentials(credentials)
+}
+
+// AdminAuth is a gin middleware to auth admin requests, they must be
+// signed by an admin token. Admin tokens manage every network, requests
+// choose one like client requests do.
+func (a *APIService) AdminAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := a.admin.Verify(c.Request)
+		if err != nil || id == "" {
+			log.Warnf("Refused admin request from %s: %v", c.ClientIP(), err)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, StatusResp{
+				Status: false,
+			})
+			return
+		}
+		n, ok := a.network(c)
+		if !ok {
+			falseResponse(http.StatusNotFound, c)
+			c.Abort()
+			return
+		}
+		c.Set(credentialKey, id)
+		c.Set(networkKey, n)
+		c.Next()
+	}
+}
+
+// registerAdminHandler registers the admin API handlers to router.
+func (a *APIService) registerAdminHandler() {
+	admin := a.router.Group(constant.AdminUrl, a.AdminAuth())
+	admin.GET("peers", a.ListPeers)
+	admin.GET("peers/:peer", a.ShowPeer)
+	admin.DELETE("peers/:peer", a.KickPeer)
+	admin.GET("stats", a.GetStats)
+	admin.GET("rebinds", a.ListRebinds)
+	admin.POST("rebinds/:fingerprint", a.ApproveRebind)
+	admin.DELETE("owners/:fingerprint", a.ReleaseFingerprint)
+}
+
+// ListPeers returns every registered peer.
+func (a *APIService) ListPeers(c *gin.Context) {
+	c.JSON(http.StatusOK, PeersResp{
+		Status: true,
+		Peers:  a.table(c).Peers(),
+	})
+}
+
+// ShowPeer returns one peer, by peer id or fingerprint.
+func (a *APIService) ShowPeer(c *gin.Context) {
+	id, ok := a.adminPeer(c)
+	if !ok {
+		return
+	}
+	status, ok := a.table(c).PeerStatus(id)
+	if !ok {
+		falseResponse(http.StatusNotFound, c)
+		return
+	}
+	c.JSON(http.StatusOK, PeerStatusResp{
+		Status: true,
+		Peer:   status,
+	})
+}
+
+// KickPeer removes a peer, by peer id or fingerprint.
+func (a *APIService) KickPeer(c *gin.Context) {
+	id, ok := a.adminPeer(c)
+	if !ok {
+		return
+	}
+	if err := a.table(c).Kick(id); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			falseResponse(http.StatusNotFound, c)
+		} else {
+			falseResponse(http.StatusInternalServerError, c)
+		}
+		return
+	}
+	log.Warnf("Admin %s kicked peer %s", c.GetString(credentialKey), id)
+	c.JSON(http.StatusOK, StatusResp{
+		Status: true,
+	})
+}
+
+// GetStats returns the counts of the route table.
+func (a *APIService) GetStats(c *gin.Context) {
+	c.JSON(http.StatusOK, StatsResp{
+		Status:  true,
+		Stats:   a.table(c).Stats(),
+		Started: a.started,
+	})
+}
+
+// ListRebinds returns the refused rebinds waiting for approval.
+func (a *APIService) ListRebinds(c *gin.Context) {
+	c.JSON(http.StatusOK, RebindsResp{
+		Status:  true,
+		Rebinds: a.table(c).PendingRebinds(),
+	})
+}
+
+// ApproveRebind lets the peer of form field peer_id take the fingerprint
+// over with its next registration.
+func (a *APIService) ApproveRebind(c *gin.Context) {
+	fingerprint := c.Param("fingerprint")
+	id, err := peer.Decode(c.PostForm("peer_id"))
+	if err != nil {
+		falseResponse(http.StatusBadRequest, c)
+		return
+	}
+	if err := a.table(c).ApproveRebind(fingerprint, id); err != nil {
+		falseResponse(http.StatusInternalServerError, c)
+		return
+	}
+	log.Warnf("Admin %s approved rebind of %s to %s", c.GetString(credentialKey), fingerprint, id)
+	c.JSON(http.StatusOK, StatusResp{
+		Status: true,
+	})
+}
+
+// ReleaseFingerprint forgets the owner of a fingerprint.
+func (a *APIService) ReleaseFingerprint(c *gin.Context) {
+	fingerprint := c.Param("fingerprint")
+	if err := a.table(c).Release(fingerprint); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			falseResponse(http.StatusNotFound, c)
+		} else {
+			falseResponse(http.StatusInternalServerError, c)
+		}
+		return
+	}
+	log.Warnf("Admin %s released fingerprint %s", c.GetString(credentialKey), fingerprint)
+	c.JSON(http.StatusOK, StatusResp{
+		Status: true,
+	})
+}
+
+// adminPeer resolves the peer parameter, a fingerprint or a peer id, and
+// responds 404 if it is neither.
+func (a *APIService) adminPeer(c *gin.Context) (peer.ID, bool) {
+	param := c.Param("peer")
+	if id := a.table(c).FindPeerID(param); id != "" {
+		return id, true
+	}
+	id, err := peer.Decode(param)
+	if err != nil {
+		falseResponse(http.StatusNotFound, c)
+		return "", false
+	}
+	return id, true
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lp2p/p2pvpn/common/auth"
+	"github.com/lp2p/p2pvpn/common/utils"
+	"github.com/lp2p/p2pvpn/constant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKick(t *testing.T) {
+	id, priv := newTestPeer(t)
+	cid := utils.StrToCid(constant.PeerRendezvous).String()
+	tab := NewRouteTable()
+	require.NoError(t, tab.Provide(cid, testInfo(t, id, "/ip4/1.2.3.4/tcp/4001"), "laptop", seal(t, "laptop", priv), 0))
+
+	peers := tab.Peers()
+	require.Len(t, peers, 1)
+	assert.Equal(t, "laptop", peers[0].Fingerprint)
+	assert.Equal(t, 1, tab.Stats().Peers)
+
+	require.NoError(t, tab.Kick(id))
+	assert.Empty(t, tab.Peers())
+	assert.ErrorIs(t, tab.Kick(id), ErrNotFound)
+
+	// The kicked peer still owns its fingerprint, but may only register
+	// again once its lease would have run out.
+	assert.Equal(t, 1, tab.Stats().Owners)
+	assert.ErrorIs(t, tab.Provide(cid, testInfo(t, id), "laptop", seal(t, "laptop", priv), 0), ErrKicked)
+	assert.Empty(t, tab.Peers())
+	now := time.Now().Add(DefaultLeaseTTL)
+	tab.now = func() time.Time { return now }
+	require.NoError(t, tab.Provide(cid, testInfo(t, id), "laptop", seal(t, "laptop", priv), 0))
+}
+
+// readOnlyStorage fails to put values.
+type readOnlyStorage struct {
+	*MemoryStorage
+}
+
+func (s readOnlyStorage) Put(string, string, []byte) error {
+	return errors.New("read only")
+}
+
+func TestAdminRelease(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	id, priv := newTestPeer(t)
+	storage := NewMemoryStorage()
+	tab, err := NewTable(storage)
+	require.NoError(t, err)
+	require.NoError(t, tab.Provide("cid", testInfo(t, id), "laptop", seal(t, "laptop", priv), 0))
+	a := NewAPIService(gin.New(), tab, "", "secret")
+	a.SetAdminTokens([]Token{{ID: "ops", Secret: "admin"}})
+	a.RegisterHandler()
+
+	release := func(fingerprint string) int {
+		req := httptest.NewRequest(http.MethodDelete, constant.AdminUrl+"owners/"+fingerprint, nil)
+		require.NoError(t, auth.Sign(req, auth.Credential{ID: "ops", Secret: "admin"}))
+		w := httptest.NewRecorder()
+		a.router.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusNotFound, release("desktop"))
+	tab.storage = readOnlyStorage{storage}
+	assert.Equal(t, http.StatusInternalServerError, release("laptop"))
+	tab.storage = storage
+	assert.Equal(t, http.StatusOK, release("laptop"))
+	assert.Equal(t, http.StatusNotFound, release("laptop"))
+}
+
+func TestAdminAuth(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	a := NewAPIService(gin.New(), NewRouteTable(), "", "secret")
+	a.SetTokens([]Token{{ID: "laptop", Secret: "client"}})
+	a.SetAdminTokens([]Token{{ID: "ops", Secret: "admin"}})
+	a.RegisterHandler()
+
+	status := func(c auth.Credential) int {
+		req := httptest.NewRequest(http.MethodGet, constant.AdminUrl+"stats", nil)
+		require.NoError(t, auth.Sign(req, c))
+		w := httptest.NewRecorder()
+		a.router.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusOK, status(auth.Credential{ID: "ops", Secret: "admin"}))
+	assert.Equal(t, http.StatusUnauthorized, status(auth.Credential{ID: "laptop", Secret: "client"}))
+	assert.Equal(t, http.StatusUnauthorized, status(auth.Credential{Secret: "secret"}))
+}
@@ -1,59 +1,99 @@
 package server
 
 import (
+	"errors"
+	"net"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/peer"
-	"github.com/lp2p/p2pvpn/common/utils"
+	"github.com/lp2p/p2pvpn/common/auth"
 	"github.com/lp2p/p2pvpn/constant"
+	"github.com/lp2p/p2pvpn/log"
+	"github.com/lp2p/p2pvpn/transport/streamnet"
 )
 
 type APIService struct {
-	router   *gin.Engine
-	addr     string
-	tab      *Table
+	router *gin.Engine
+	addr   string
+	// networks are the virtual networks served by name, the default one
+	// included.
+	networks map[string]*network
 	serverID peer.ID
-	secret   string
+	// admin verifies the admin API requests, it has credentials of its
+	// own so client tokens never grant admin rights.
+	admin *auth.Verifier
+	// cluster verifies the syncs of the other servers of the cluster.
+	cluster *auth.Verifier
+	// trustedProxies are the proxies allowed to tell the address of
+	// clients, see SetTrustedProxies.
+	trustedProxies []*net.IPNet
+	started        time.Time
+	register       sync.Once
 }
 
 // NewDefaultAPIService create a APIService using gin.Default,
 // with Logger and Recovery.
-func NewDefaultAPIService(addr string, secret string) *APIService {
+func NewDefaultAPIService(tab *Table, addr string, secret string) *APIService {
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.Default()
-	tab := NewRouteTable()
 	return NewAPIService(router, tab, addr, secret)
 }
 
 // NewAPIService create a APIService with provider gin.Engine and route.RouteTable,
 // it's convenient for testing.
+// tab and secret are those of the default network, an empty secret only
+// accepts the tokens set by SetTokens. AddNetwork adds more networks.
 func NewAPIService(router *gin.Engine, tab *Table, addr, secret string) *APIService {
-	return &APIService{
-		router: router,
-		addr:   addr,
-		tab:    tab,
-		secret: secret,
+	a := &APIService{
+		router:   router,
+		addr:     addr,
+		networks: make(map[string]*network),
+		admin:    auth.NewVerifier(nil),
+		cluster:  auth.NewVerifier(nil),
+		started:  time.Now(),
 	}
+	a.cluster.SetMaxBodyLen(maxSnapshotLen)
+	n := &network{tab: tab, secret: secret, verifier: auth.NewVerifier(nil)}
+	n.verifier.SetCredentials(n.credentials(nil))
+	a.networks[DefaultNetwork] = n
+	return a
 }
 
-// RegisterHandler registers api service handlers to router.
+// RegisterHandler registers api service handlers to router, client
+// handlers behind Auth and admin handlers behind AdminAuth. The v1 handlers
+// are served at the root and under constant.V1Url. Only the first call
+// registers them, Run and ServeP2P may both be used.
 func (a *APIService) RegisterHandler() {
-	a.router.GET(constant.RoutingUrl+":id", a.GetPeer)
-	a.router.POST(constant.RoutingUrl+":cid", a.NewPeer)
+	a.register.Do(a.registerHandler)
+}
+
+func (a *APIService) registerHandler() {
+	for _, prefix := range []string{"/", constant.V1Url} {
+		v1 := a.router.Group(prefix, a.Auth())
+		v1.GET(constant.RoutingUrl+":id", a.GetPeer)
+		v1.POST(constant.RoutingUrl+":cid", a.NewPeer)
+
+		v1.GET(constant.RoutingProviderUrl+":cid", a.GetProvider)
 
-	a.router.GET(constant.RoutingProviderUrl+":cid", a.GetProvider)
+		v1.GET(constant.FingerprintsUrl+":fingerprint", a.GetPeerID)
+		v1.DELETE(constant.FingerprintsUrl+":fingerprint", a.DeletePeer)
 
-	a.router.GET(constant.FingerprintsUrl+":fingerprint", a.GetPeerID)
-	a.router.DELETE(constant.FingerprintsUrl+":fingerprint", a.DeletePeer)
+		v1.GET(constant.WatchUrl, a.Watch)
+
+		v1.GET(constant.ServerIDUrl, a.GetServerID)
+	}
 
-	a.router.GET(constant.ServerIDUrl, a.GetServerID)
-	a.router.POST(constant.ServerIDUrl+":id", a.SetServerID)
+	a.registerV2Handler()
+	a.registerAdminHandler()
+	a.router.POST(constant.ClusterSyncUrl, a.SyncCluster)
 }
 
 // Run starts api service.
 func (a *APIService) Run() {
-	a.router.Use(a.Auth())
 	a.RegisterHandler()
 	err := a.router.Run(a.addr)
 	if err != nil {
@@ -61,17 +101,61 @@ func (a *APIService) Run() {
 	}
 }
 
-// Auth is a gin middleware to auth request.
+// SetServerID sets the peer ID of the server host clients are told about.
+// It must be called before Run and ServeP2P, the handlers read it
+// unguarded.
+func (a *APIService) SetServerID(id peer.ID) {
+	a.serverID = id
+}
+
+// ServeP2P serves the api on the constant.RendezvousProtocol streams of h,
+// clients then only need the multiaddr of h and know the server by its
+// peer ID. The HTTP listener of Run is not needed for it.
+func (a *APIService) ServeP2P(h host.Host) error {
+	a.RegisterHandler()
+	l := streamnet.Listen(h, constant.RendezvousProtocol)
+	err := http.Serve(l, a.router)
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// Gin context keys of the verified credential ID and of its network.
+const (
+	credentialKey = "credential"
+	networkKey    = "network"
+)
+
+// Auth is a gin middleware to auth request, requests must be signed by
+// the shared secret or a token of the network they choose.
 func (a *APIService) Auth() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		clientSecret := c.GetHeader("auth")
-		secret := utils.Md5(a.secret)
-		if clientSecret == secret {
-			c.Next()
-		} else {
+		n, id, err := a.verify(c)
+		if err != nil {
+			log.Debugf("Refused request from %s: %v", c.ClientIP(), err)
 			c.AbortWithStatusJSON(http.StatusUnauthorized, StatusResp{
 				Status: false,
 			})
+			return
 		}
+		c.Set(credentialKey, id)
+		c.Set(networkKey, n)
+		c.Next()
+	}
+}
+
+// verify checks the signature of the request with the credentials of the
+// network it chooses. Unknown networks are refused like unknown
+// credentials, so their names do not leak.
+func (a *APIService) verify(c *gin.Context) (*network, string, error) {
+	n, ok := a.network(c)
+	if !ok {
+		return nil, "", auth.ErrUnknown
+	}
+	id, err := n.verifier.Verify(c.Request)
+	if err != nil {
+		return nil, "", err
 	}
+	return n, id, nil
 }
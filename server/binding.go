@@ -0,0 +1,272 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/lp2p/p2pvpn/log"
+)
+
+// binding is the stored form of a fingerprint bound to a peer, with the
+// record proving it. Stores written before records were required hold the
+// peer ID alone.
+type binding struct {
+	PeerID peer.ID `json:"peer_id"`
+	Record []byte  `json:"record,omitempty"`
+}
+
+func (b *binding) UnmarshalJSON(data []byte) error {
+	var idStr string
+	if err := json.Unmarshal(data, &idStr); err == nil {
+		id, err := peer.Decode(idStr)
+		b.PeerID = id
+		return err
+	}
+	type plain binding
+	return json.Unmarshal(data, (*plain)(b))
+}
+
+// owner is the key a fingerprint belongs to. Ownership outlives the
+// binding, a fingerprint of a peer that logged out or expired can only be
+// taken by another key after an admin approves it.
+type owner struct {
+	PeerID peer.ID `json:"peer_id"`
+	Seq    uint64  `json:"seq"`
+	// Record is the record of PeerID with Seq, replicas check it.
+	Record []byte `json:"record,omitempty"`
+	// Released owners are kept as tombstones, with a Seq above that of
+	// their record so that they win over it in replicas.
+	Released bool `json:"released,omitempty"`
+}
+
+// check checks the record of o is a record of its peer for fingerprint
+// with its Seq. Released owners have no record to check, they are trusted
+// like the other admin decisions.
+func (o owner) check(fingerprint string) error {
+	if o.Released {
+		return nil
+	}
+	rec, err := OpenFingerprint(o.Record, fingerprint)
+	if err != nil {
+		return err
+	}
+	if rec.PeerID != o.PeerID || rec.Seq != o.Seq {
+		return fmt.Errorf("%w: record is for %s at %d", ErrInvalidRecord, rec.PeerID, rec.Seq)
+	}
+	return nil
+}
+
+// bind binds fingerprint to id if proof is a valid record of id, t.mx
+// must be held.
+func (t *Table) bind(fingerprint string, id peer.ID, proof []byte) error {
+	rec, err := OpenFingerprint(proof, fingerprint)
+	if err != nil {
+		return err
+	}
+	if rec.PeerID != id {
+		return fmt.Errorf("%w: record is for %s", ErrInvalidRecord, rec.PeerID)
+	}
+
+	o, owned := t.owners[fingerprint]
+	approved := false
+	if owned && o.Released {
+		if rec.Seq <= o.Seq {
+			return ErrStaleRecord
+		}
+	} else if owned && o.PeerID != id {
+		if t.approvals[fingerprint] != id {
+			t.addPending(fingerprint, id)
+			return ErrFingerprintOwned
+		}
+		approved = true
+	} else if owned && rec.Seq <= o.Seq {
+		return ErrStaleRecord
+	}
+
+	o = owner{PeerID: id, Seq: rec.Seq, Record: proof}
+	if err := t.put(bucketOwners, fingerprint, o); err != nil {
+		return err
+	}
+	t.owners[fingerprint] = o
+	if approved {
+		if err := t.delete(bucketApprovals, fingerprint); err != nil {
+			return err
+		}
+		delete(t.approvals, fingerprint)
+		delete(t.pending, fingerprint)
+	}
+
+	b := binding{PeerID: id, Record: proof}
+	if err := t.put(bucketFingerprints, fingerprint, b); err != nil {
+		return err
+	}
+	t.setFingerprint(fingerprint, id, proof)
+	return nil
+}
+
+// setFingerprint binds fingerprint to id in memory, t.mx must be held.
+func (t *Table) setFingerprint(fingerprint string, id peer.ID, record []byte) {
+	if prev, ok := t.fingerprints[fingerprint]; ok {
+		t.unindex(fingerprint, prev)
+	}
+	t.fingerprints[fingerprint] = id
+	if record != nil {
+		t.records[fingerprint] = record
+	} else {
+		delete(t.records, fingerprint)
+	}
+	// The last fingerprint bound is the one of the peer.
+	t.byPeer[id] = append(t.byPeer[id], fingerprint)
+}
+
+// unsetFingerprint unbinds fingerprint in memory, t.mx must be held.
+func (t *Table) unsetFingerprint(fingerprint string) {
+	if id, ok := t.fingerprints[fingerprint]; ok {
+		t.unindex(fingerprint, id)
+	}
+	delete(t.fingerprints, fingerprint)
+	delete(t.records, fingerprint)
+}
+
+// unindex removes fingerprint from the fingerprints of id, t.mx must be
+// held.
+func (t *Table) unindex(fingerprint string, id peer.ID) {
+	fingerprints := t.byPeer[id]
+	for i, fp := range fingerprints {
+		if fp == fingerprint {
+			fingerprints = append(fingerprints[:i:i], fingerprints[i+1:]...)
+			break
+		}
+	}
+	if len(fingerprints) == 0 {
+		delete(t.byPeer, id)
+	} else {
+		t.byPeer[id] = fingerprints
+	}
+}
+
+// checkUnbind checks proof allows the owner of fingerprint, bound to id,
+// to remove its binding, t.mx must be held.
+func (t *Table) checkUnbind(fingerprint string, id peer.ID, proof []byte) error {
+	rec, err := OpenFingerprint(proof, fingerprint)
+	if err != nil {
+		return err
+	}
+	o, owned := t.owners[fingerprint]
+	if !owned || o.Released {
+		// Bound before records were required, or released since.
+		o.PeerID = id
+	}
+	if rec.PeerID != o.PeerID {
+		return ErrFingerprintOwned
+	}
+	if rec.Seq <= o.Seq {
+		return ErrStaleRecord
+	}
+
+	o = owner{PeerID: rec.PeerID, Seq: rec.Seq, Record: proof}
+	if err := t.put(bucketOwners, fingerprint, o); err != nil {
+		return err
+	}
+	t.owners[fingerprint] = o
+	return nil
+}
+
+// Record returns the record proving the binding of fingerprint, nil for
+// bindings made before records were required.
+func (t *Table) Record(fingerprint string) []byte {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	return t.records[fingerprint]
+}
+
+// ApproveRebind lets id take fingerprint over from its current owner with
+// its next registration.
+func (t *Table) ApproveRebind(fingerprint string, id peer.ID) error {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	if err := t.put(bucketApprovals, fingerprint, id.String()); err != nil {
+		return err
+	}
+	t.approvals[fingerprint] = id
+	return nil
+}
+
+// Release forgets the owner of fingerprint, the next peer registering it
+// becomes the owner.
+func (t *Table) Release(fingerprint string) error {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	o, ok := t.owners[fingerprint]
+	if !ok || o.Released {
+		return fmt.Errorf("fingerprint %q has no owner: %w", fingerprint, ErrNotFound)
+	}
+	o = owner{PeerID: o.PeerID, Seq: o.Seq + 1, Released: true}
+	if err := t.put(bucketOwners, fingerprint, o); err != nil {
+		return err
+	}
+	t.owners[fingerprint] = o
+	return nil
+}
+
+// maxPendingRebinds bounds the rebinds kept for admins to approve, clients
+// can make up as many as there are owned fingerprints.
+const maxPendingRebinds = 256
+
+// addPending records that id tried to take fingerprint over, unless too
+// many other rebinds are pending. t.mx must be held.
+func (t *Table) addPending(fingerprint string, id peer.ID) {
+	if _, ok := t.pending[fingerprint]; !ok && len(t.pending) >= maxPendingRebinds {
+		log.Debugf("Too many pending rebinds, dropped %s to %s", fingerprint, id)
+		return
+	}
+	t.pending[fingerprint] = id
+}
+
+// PendingRebinds returns the fingerprints other peers than their owner
+// tried to register since the server started, with the last such peer.
+func (t *Table) PendingRebinds() map[string]peer.ID {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	pending := make(map[string]peer.ID, len(t.pending))
+	for fingerprint, id := range t.pending {
+		pending[fingerprint] = id
+	}
+	return pending
+}
+
+// loadBindings loads owners and approvals, t.mx must be held.
+func (t *Table) loadBindings() error {
+	err := t.storage.ForEach(bucketOwners, func(key string, value []byte) error {
+		var o owner
+		if err := json.Unmarshal(value, &o); err != nil {
+			return err
+		}
+		t.owners[key] = o
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("load owners: %w", err)
+	}
+
+	err = t.storage.ForEach(bucketApprovals, func(key string, value []byte) error {
+		var idStr string
+		if err := json.Unmarshal(value, &idStr); err != nil {
+			return err
+		}
+		id, err := peer.Decode(idStr)
+		if err != nil {
+			return err
+		}
+		t.approvals[key] = id
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("load approvals: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lp2p/p2pvpn/common/auth"
+	"github.com/lp2p/p2pvpn/constant"
+	"github.com/lp2p/p2pvpn/log"
+)
+
+// ClusterCredentialID is the credential ID servers of a cluster sign the
+// sync requests with.
+const ClusterCredentialID = "_cluster"
+
+// clusterTimeout bounds a sync with one server.
+const clusterTimeout = 10 * time.Second
+
+// maxSnapshotLen is the largest snapshot a sync may push, client requests
+// are limited to auth.DefaultMaxBodyLen.
+const maxSnapshotLen = 64 << 20
+
+// Cluster keeps the table of a server in sync with the other servers of a
+// cluster by anti-entropy: each sync pushes the snapshot of the table to a
+// peer server, which merges it and answers with its own snapshot.
+type Cluster struct {
+	network    string
+	tab        *Table
+	peers      []string
+	credential auth.Credential
+	client     *http.Client
+	// down remembers the unreachable peers, so failures are logged once.
+	down map[string]bool
+}
+
+// NewCluster returns the cluster of tab, the table of network, with the
+// servers at the peers urls, all sharing secret.
+func NewCluster(network string, tab *Table, peers []string, secret string) *Cluster {
+	c := &Cluster{
+		network:    network,
+		tab:        tab,
+		credential: auth.Credential{ID: ClusterCredentialID, Secret: secret},
+		client:     &http.Client{Timeout: clusterTimeout},
+		down:       make(map[string]bool),
+	}
+	for _, p := range peers {
+		c.peers = append(c.peers, strings.TrimSuffix(p, "/"))
+	}
+	return c
+}
+
+// Run syncs with every peer each interval until stop is closed.
+func (c *Cluster) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		c.Sync()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sync syncs with every peer once.
+func (c *Cluster) Sync() {
+	for _, p := range c.peers {
+		err := c.SyncWith(p)
+		switch {
+		case err != nil && !c.down[p]:
+			log.Warnf("Cluster sync with %s failed: %v", p, err)
+			c.down[p] = true
+		case err == nil && c.down[p]:
+			log.Warnf("Cluster sync with %s recovered", p)
+			delete(c.down, p)
+		}
+	}
+}
+
+// SyncWith exchanges snapshots with the server at url.
+func (c *Cluster) SyncWith(url string) error {
+	data, err := json.Marshal(c.tab.Snapshot())
+	if err != nil {
+		return err
+	}
+	target := url + constant.ClusterSyncUrl
+	if c.network != DefaultNetwork {
+		target += "?" + NetworkParam + "=" + neturl.QueryEscape(c.network)
+	}
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := auth.Sign(req, c.credential); err != nil {
+		return err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("sync: %s", resp.Status)
+	}
+
+	var s Snapshot
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return err
+	}
+	return c.tab.Merge(s)
+}
+
+// SetClusterSecret sets the secret the other servers of the cluster sync
+// with, empty refuses every sync.
+func (a *APIService) SetClusterSecret(secret string) {
+	var credentials []auth.Credential
+	if secret != "" {
+		credentials = append(credentials, auth.Credential{ID: ClusterCredentialID, Secret: secret})
+	}
+	a.cluster.SetCredentials(credentials)
+}
+
+// SyncCluster merges the snapshot of another server of the cluster and
+// answers with ours, of the network the request chooses.
+func (a *APIService) SyncCluster(c *gin.Context) {
+	if _, err := a.cluster.Verify(c.Request); err != nil {
+		log.Warnf("Refused cluster sync from %s: %v", c.ClientIP(), err)
+		falseResponse(http.StatusUnauthorized, c)
+		return
+	}
+	n, ok := a.network(c)
+	if !ok {
+		falseResponse(http.StatusNotFound, c)
+		return
+	}
+
+	var s Snapshot
+	if err := c.ShouldBindJSON(&s); err != nil {
+		falseResponse(http.StatusBadRequest, c)
+		return
+	}
+	ours := n.tab.Snapshot()
+	if err := n.tab.Merge(s); err != nil {
+		log.Errorf("Cluster merge failed: %v", err)
+		falseResponse(http.StatusInternalServerError, c)
+		return
+	}
+	c.JSON(http.StatusOK, ours)
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/lp2p/p2pvpn/common/utils"
+	"github.com/lp2p/p2pvpn/constant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestReplica(t *testing.T, secret string) (*Table, string) {
+	gin.SetMode(gin.ReleaseMode)
+	tab := NewRouteTable()
+	a := NewAPIService(gin.New(), tab, "", "secret")
+	a.SetClusterSecret(secret)
+	a.RegisterHandler()
+	srv := httptest.NewServer(a.router)
+	t.Cleanup(srv.Close)
+	return tab, srv.URL
+}
+
+func TestCluster(t *testing.T) {
+	cid := utils.StrToCid(constant.PeerRendezvous).String()
+	a, aUrl := newTestReplica(t, "cluster")
+	b, bUrl := newTestReplica(t, "cluster")
+	c, _ := newTestReplica(t, "cluster")
+	toB := NewCluster(DefaultNetwork, a, []string{bUrl}, "cluster")
+	toA := NewCluster(DefaultNetwork, b, []string{aUrl}, "cluster")
+	// c only knows b, changes reach it through b.
+	cToB := NewCluster(DefaultNetwork, c, []string{bUrl}, "cluster")
+
+	id, priv := newTestPeer(t)
+	require.NoError(t, a.Provide(cid, testInfo(t, id, "/ip4/1.2.3.4/tcp/4001"), "laptop", seal(t, "laptop", priv), time.Minute))
+	require.NoError(t, toB.SyncWith(bUrl))
+	require.NoError(t, cToB.SyncWith(bUrl))
+	for _, tab := range []*Table{b, c} {
+		assert.Equal(t, id, tab.FindPeerID("laptop"))
+		providers, err := tab.FindProvider(cid)
+		require.NoError(t, err)
+		assert.Contains(t, providers, id.String())
+	}
+
+	// A logout on b wins over the older registration on a.
+	require.NoError(t, b.Delete("laptop", seal(t, "laptop", priv)))
+	require.NoError(t, toA.SyncWith(aUrl))
+	assert.Equal(t, "", a.FindPeerID("laptop").String())
+	require.NoError(t, toB.SyncWith(bUrl))
+	assert.Equal(t, "", b.FindPeerID("laptop").String())
+
+	// Registering again wins over the logout.
+	time.Sleep(time.Millisecond)
+	require.NoError(t, a.Provide(cid, testInfo(t, id), "laptop", seal(t, "laptop", priv), time.Minute))
+	require.NoError(t, toB.SyncWith(bUrl))
+	assert.Equal(t, id, b.FindPeerID("laptop"))
+
+	// Ownership is replicated too.
+	mallory, malloryPriv := newTestPeer(t)
+	err := b.Provide(cid, testInfo(t, mallory), "laptop", seal(t, "laptop", malloryPriv), 0)
+	assert.ErrorIs(t, err, ErrFingerprintOwned)
+
+	// So are the rebinds pending and their approvals.
+	require.NoError(t, toA.SyncWith(aUrl))
+	assert.Equal(t, map[string]peer.ID{"laptop": mallory}, a.PendingRebinds())
+	require.NoError(t, a.ApproveRebind("laptop", mallory))
+	require.NoError(t, toB.SyncWith(bUrl))
+	require.NoError(t, b.Provide(cid, testInfo(t, mallory), "laptop", seal(t, "laptop", malloryPriv), 0))
+	assert.Equal(t, mallory, b.FindPeerID("laptop"))
+	// The approval is used up everywhere once synced back.
+	require.NoError(t, toA.SyncWith(aUrl))
+	assert.Equal(t, mallory, a.FindPeerID("laptop"))
+	assert.Empty(t, a.PendingRebinds())
+	require.NoError(t, toB.SyncWith(bUrl))
+	assert.Empty(t, b.PendingRebinds())
+	err = b.Provide(cid, testInfo(t, id), "laptop", seal(t, "laptop", priv), 0)
+	assert.ErrorIs(t, err, ErrFingerprintOwned)
+
+	// A release is not undone by a replica that still has the owner.
+	require.NoError(t, b.Release("laptop"))
+	require.NoError(t, toB.SyncWith(bUrl))
+	require.NoError(t, toA.SyncWith(aUrl))
+	require.NoError(t, a.Provide(cid, testInfo(t, id), "laptop", seal(t, "laptop", priv), 0))
+	assert.Equal(t, id, a.FindPeerID("laptop"))
+	require.NoError(t, toB.SyncWith(bUrl))
+	assert.Equal(t, id, b.FindPeerID("laptop"))
+
+	// Owners are only merged with the record of their peer.
+	forged := a.Snapshot()
+	o := forged.Owners["laptop"]
+	forged.Owners["laptop"] = owner{PeerID: mallory, Seq: o.Seq + 1, Record: o.Record}
+	require.NoError(t, c.Merge(forged))
+	err = c.Provide(cid, testInfo(t, id), "laptop", seal(t, "laptop", priv), 0)
+	assert.NoError(t, err)
+
+	// Syncs with the wrong secret are refused.
+	assert.Error(t, NewCluster(DefaultNetwork, a, nil, "wrong").SyncWith(bUrl))
+}
+
+func TestMergeStale(t *testing.T) {
+	id, priv := newTestPeer(t)
+	a, b := NewRouteTable(), NewRouteTable()
+	require.NoError(t, a.Provide("cid", testInfo(t, id), "laptop", seal(t, "laptop", priv), time.Hour))
+	stale := a.Snapshot()
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	require.NoError(t, b.Merge(stale))
+	require.NoError(t, b.Kick(id))
+
+	// A replica offline for long does not bring the kicked peer back,
+	// before or after its tombstone is pruned.
+	for _, d := range []time.Duration{30 * time.Minute, MaxLeaseTTL + time.Minute} {
+		now = now.Add(d)
+		_, err := b.Expire(now)
+		require.NoError(t, err)
+		require.NoError(t, b.Merge(stale))
+		assert.Equal(t, "", b.FindPeerID("laptop").String(), d)
+	}
+}
+
+func TestMergeMovedFingerprint(t *testing.T) {
+	id, priv := newTestPeer(t)
+	other, otherPriv := newTestPeer(t)
+	a, b := NewRouteTable(), NewRouteTable()
+	require.NoError(t, b.Provide("cid", testInfo(t, id), "laptop", seal(t, "laptop", priv), 0))
+
+	require.NoError(t, a.ApproveRebind("laptop", other))
+	require.NoError(t, a.Provide("cid", testInfo(t, other), "laptop", seal(t, "laptop", otherPriv), 0))
+
+	// The former peer of a fingerprint taken over elsewhere is removed
+	// like the others, watchers and replicas learn of it.
+	events, cancel := b.Subscribe(8)
+	defer cancel()
+	require.NoError(t, b.Merge(a.Snapshot()))
+	assert.Equal(t, other, b.FindPeerID("laptop"))
+	_, err := b.Find(id)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Contains(t, b.Snapshot().Tombstones, id)
+
+	var logout *Event
+	for len(events) > 0 {
+		if e := <-events; e.Type == EventLogout {
+			logout = &e
+		}
+	}
+	require.NotNil(t, logout)
+	assert.Equal(t, id, logout.Peer.ID)
+	assert.Equal(t, "laptop", logout.Fingerprint)
+}
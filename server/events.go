@@ -0,0 +1,99 @@
+package server
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/lp2p/p2pvpn/log"
+)
+
+// EventType is the kind of change an Event reports.
+type EventType string
+
+const (
+	// EventRegister is sent when a peer registers for the first time.
+	EventRegister EventType = "register"
+	// EventUpdate is sent when a registered peer changes its addrs or
+	// fingerprint, plain lease renewals send none.
+	EventUpdate EventType = "update"
+	// EventExpire is sent when the lease of a peer ran out.
+	EventExpire EventType = "expire"
+	// EventLogout is sent when a peer logged out.
+	EventLogout EventType = "logout"
+	// EventKick is sent when an admin removed a peer.
+	EventKick EventType = "kick"
+)
+
+// Event is a change of the route table.
+type Event struct {
+	Type        EventType     `json:"type"`
+	Peer        peer.AddrInfo `json:"peer"`
+	Fingerprint string        `json:"fingerprint,omitempty"`
+	Time        time.Time     `json:"time"`
+}
+
+// Subscribe returns a channel receiving the events of the table, and the
+// function ending the subscription. Subscribers that fall more than buffer
+// events behind are dropped, their channel is closed.
+func (t *Table) Subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+
+	t.mx.Lock()
+	t.subs[ch] = struct{}{}
+	t.mx.Unlock()
+
+	return ch, func() {
+		t.mx.Lock()
+		defer t.mx.Unlock()
+		if _, ok := t.subs[ch]; ok {
+			delete(t.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// publish sends an event to every subscriber, t.mx must be held.
+func (t *Table) publish(typ EventType, pi peer.AddrInfo, fingerprint string) {
+	e := Event{
+		Type:        typ,
+		Peer:        pi,
+		Fingerprint: fingerprint,
+		Time:        t.now(),
+	}
+	for ch := range t.subs {
+		select {
+		case ch <- e:
+		default:
+			log.Warnf("Dropped a watcher lagging behind")
+			delete(t.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// fingerprintOf returns the fingerprint last bound to id, t.mx must be
+// held.
+func (t *Table) fingerprintOf(id peer.ID) string {
+	fingerprints := t.byPeer[id]
+	if len(fingerprints) == 0 {
+		return ""
+	}
+	return fingerprints[len(fingerprints)-1]
+}
+
+// sameAddrs reports whether a and b hold the same addrs in any order.
+func sameAddrs(a, b peer.AddrInfo) bool {
+	if len(a.Addrs) != len(b.Addrs) {
+		return false
+	}
+	seen := make(map[string]bool, len(a.Addrs))
+	for _, addr := range a.Addrs {
+		seen[addr.String()] = true
+	}
+	for _, addr := range b.Addrs {
+		if !seen[addr.String()] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lp2p/p2pvpn/common/utils"
+	"github.com/lp2p/p2pvpn/constant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvents(t *testing.T) {
+	id, priv := newTestPeer(t)
+	cid := utils.StrToCid(constant.PeerRendezvous).String()
+	tab := NewRouteTable()
+	now := time.Now()
+	tab.now = func() time.Time { return now }
+
+	events, cancel := tab.Subscribe(8)
+	defer cancel()
+	next := func() Event {
+		select {
+		case e := <-events:
+			return e
+		default:
+			t.Fatal("no event")
+			return Event{}
+		}
+	}
+
+	pi := testInfo(t, id, "/ip4/1.2.3.4/tcp/4001")
+	require.NoError(t, tab.Provide(cid, pi, "laptop", seal(t, "laptop", priv), time.Minute))
+	e := next()
+	assert.Equal(t, EventRegister, e.Type)
+	assert.Equal(t, id, e.Peer.ID)
+	assert.Equal(t, "laptop", e.Fingerprint)
+
+	// Renewals are silent, new addrs are not.
+	require.NoError(t, tab.Provide(cid, pi, "laptop", seal(t, "laptop", priv), time.Minute))
+	assert.Empty(t, events)
+	require.NoError(t, tab.Provide(cid, testInfo(t, id, "/ip4/5.6.7.8/tcp/4001"), "laptop", seal(t, "laptop", priv), time.Minute))
+	assert.Equal(t, EventUpdate, next().Type)
+
+	_, err := tab.Expire(now.Add(time.Minute))
+	require.NoError(t, err)
+	e = next()
+	assert.Equal(t, EventExpire, e.Type)
+	assert.Equal(t, "laptop", e.Fingerprint)
+
+	require.NoError(t, tab.Provide(cid, pi, "laptop", seal(t, "laptop", priv), time.Minute))
+	assert.Equal(t, EventRegister, next().Type)
+	require.NoError(t, tab.Delete("laptop", seal(t, "laptop", priv)))
+	assert.Equal(t, EventLogout, next().Type)
+}
+
+func TestFingerprintIndex(t *testing.T) {
+	id, priv := newTestPeer(t)
+	other, otherPriv := newTestPeer(t)
+	tab := NewRouteTable()
+
+	require.NoError(t, tab.Provide("cid", testInfo(t, id), "laptop", seal(t, "laptop", priv), 0))
+	require.NoError(t, tab.Provide("cid", testInfo(t, id), "laptop2", seal(t, "laptop2", priv), 0))
+	tab.mx.Lock()
+	assert.Equal(t, "laptop2", tab.fingerprintOf(id))
+	tab.mx.Unlock()
+
+	// A fingerprint taken over leaves the index of its former peer.
+	require.NoError(t, tab.ApproveRebind("laptop2", other))
+	require.NoError(t, tab.Provide("cid", testInfo(t, other), "laptop2", seal(t, "laptop2", otherPriv), 0))
+	tab.mx.Lock()
+	assert.Equal(t, "laptop", tab.fingerprintOf(id))
+	assert.Equal(t, "laptop2", tab.fingerprintOf(other))
+	tab.mx.Unlock()
+
+	require.NoError(t, tab.Kick(id))
+	tab.mx.Lock()
+	assert.Equal(t, "", tab.fingerprintOf(id))
+	assert.Equal(t, "laptop2", tab.fingerprintOf(other))
+	tab.mx.Unlock()
+}
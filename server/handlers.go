@@ -1,12 +1,15 @@
 package server
 
 import (
-	"net"
+	"encoding/base64"
+	"errors"
 	"net/http"
-	"strings"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/lp2p/p2pvpn/log"
 )
 
 // GetPeer returns peer information by peer id.
@@ -16,13 +19,15 @@ func (a *APIService) GetPeer(c *gin.Context) {
 		falseResponse(http.StatusInternalServerError, c)
 		return
 	}
-	info, err := a.tab.Find(id)
+	tab := a.peerTable(c, id)
+	info, err := tab.Find(id)
 	if err != nil {
 		falseResponse(http.StatusNotFound, c)
 	} else {
 		c.JSON(http.StatusOK, PeerResp{
 			Status:   true,
 			AddrInfo: info,
+			LastSeen: lastSeen(tab, id),
 		})
 	}
 }
@@ -38,19 +43,47 @@ func (a *APIService) NewPeer(c *gin.Context) {
 		return
 	}
 
-	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	observed, err := a.observedIP(c)
 	if err != nil {
 		falseResponse(http.StatusInternalServerError, c)
 		return
 	}
-	addrs = strings.Replace(addrs, "127.0.0.1", host, 1)
 
-	err = a.tab.Provide(cid, id, addrs, fingerprint)
+	// ttl is the lease in seconds, zero is DefaultLeaseTTL.
+	var ttl time.Duration
+	if s := c.PostForm("ttl"); s != "" {
+		seconds, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			falseResponse(http.StatusBadRequest, c)
+			return
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+
+	// record proves id owns fingerprint, see SealFingerprint.
+	record, err := base64.StdEncoding.DecodeString(c.PostForm("record"))
 	if err != nil {
-		falseResponse(http.StatusInternalServerError, c)
+		falseResponse(http.StatusBadRequest, c)
+		return
+	}
+
+	pi, err := parseAddrInfo(id, addrs)
+	if err != nil {
+		falseResponse(http.StatusBadRequest, c)
+		return
+	}
+	pi.Addrs = observedAddrs(pi.Addrs, observed)
+
+	err = a.table(c).Provide(cid, pi, fingerprint, record, ttl)
+	if errors.Is(err, ErrFingerprintOwned) {
+		log.Warnf("Refused rebind of fingerprint %s to %s, pending admin approval", fingerprint, id)
+	}
+	if err != nil {
+		falseResponse(bindingStatus(err), c)
 	} else {
-		c.JSON(http.StatusOK, StatusResp{
-			Status: true,
+		c.JSON(http.StatusOK, NewPeerResp{
+			Status:   true,
+			Observed: observedMultiaddr(observed),
 		})
 	}
 }
@@ -58,9 +91,14 @@ func (a *APIService) NewPeer(c *gin.Context) {
 // DeletePeer delete peer entry.
 func (a *APIService) DeletePeer(c *gin.Context) {
 	fingerprint := c.Param("fingerprint")
-	err := a.tab.Delete(fingerprint)
+	record, err := base64.StdEncoding.DecodeString(c.Query("record"))
 	if err != nil {
-		falseResponse(http.StatusInternalServerError, c)
+		falseResponse(http.StatusBadRequest, c)
+		return
+	}
+	err = a.table(c).Delete(fingerprint, record)
+	if err != nil {
+		falseResponse(bindingStatus(err), c)
 		return
 	}
 	c.JSON(http.StatusOK, StatusResp{
@@ -71,13 +109,21 @@ func (a *APIService) DeletePeer(c *gin.Context) {
 // GetProvider returns all peers under the same provider.
 func (a *APIService) GetProvider(c *gin.Context) {
 	cid := c.Param("cid")
-	pmap, err := a.tab.FindProvider(cid)
+	tab := a.providerTable(c, cid)
+	pmap, err := tab.FindProvider(cid)
 	if err != nil {
 		falseResponse(http.StatusNotFound, c)
 	} else {
+		lastSeen := make(map[string]time.Time, len(pmap))
+		for idStr, pi := range pmap {
+			if t, ok := tab.LastSeen(pi.ID); ok {
+				lastSeen[idStr] = t
+			}
+		}
 		c.JSON(http.StatusOK, ProvidersResp{
 			Status:    true,
 			AddrInfos: pmap,
+			LastSeen:  lastSeen,
 		})
 	}
 }
@@ -85,7 +131,8 @@ func (a *APIService) GetProvider(c *gin.Context) {
 // GetPeerID returns peer id by fingerprint.
 func (a *APIService) GetPeerID(c *gin.Context) {
 	fingerprint := c.Param("fingerprint")
-	id := a.tab.FindPeerID(fingerprint)
+	tab := a.table(c)
+	id := tab.FindPeerID(fingerprint)
 	var status int
 	if id == "" {
 		status = http.StatusNotFound
@@ -93,20 +140,9 @@ func (a *APIService) GetPeerID(c *gin.Context) {
 		status = http.StatusOK
 	}
 	c.JSON(status, IDResp{
-		PeerID: id,
-	})
-}
-
-// SetServerID sets server libp2p host id.
-func (a *APIService) SetServerID(c *gin.Context) {
-	id, err := peer.Decode(c.Param("id"))
-	if err != nil {
-		falseResponse(http.StatusInternalServerError, c)
-		return
-	}
-	a.serverID = id
-	c.JSON(http.StatusOK, StatusResp{
-		Status: true,
+		PeerID:   id,
+		LastSeen: lastSeen(tab, id),
+		Record:   tab.Record(fingerprint),
 	})
 }
 
@@ -117,6 +153,31 @@ func (a *APIService) GetServerID(c *gin.Context) {
 	})
 }
 
+// lastSeen returns when peer id last renewed its lease in tab, nil if
+// unknown.
+func lastSeen(tab *Table, id peer.ID) *time.Time {
+	t, ok := tab.LastSeen(id)
+	if !ok {
+		return nil
+	}
+	return &t
+}
+
+// bindingStatus maps errors of binding a fingerprint to a status code.
+func bindingStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidRecord):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrFingerprintOwned), errors.Is(err, ErrStaleRecord):
+		return http.StatusConflict
+	case errors.Is(err, ErrKicked):
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
 // falseResponse returns false status json response.
 func falseResponse(status int, c *gin.Context) {
 	c.JSON(status, StatusResp{
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lp2p/p2pvpn/common/auth"
+	"github.com/lp2p/p2pvpn/constant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPeerLease(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	tab := NewRouteTable()
+	a := NewAPIService(gin.New(), tab, "", "secret")
+	a.RegisterHandler()
+
+	register := func(form url.Values) {
+		req := httptest.NewRequest(http.MethodPost, constant.RoutingUrl+"cid", strings.NewReader(form.Encode()))
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		require.NoError(t, auth.Sign(req, auth.Credential{Secret: "secret"}))
+		w := httptest.NewRecorder()
+		a.router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+	expires := func(form url.Values) time.Duration {
+		tab.mx.Lock()
+		defer tab.mx.Unlock()
+		id := form.Get("id")
+		for pid, l := range tab.leases {
+			if pid.String() == id {
+				return time.Until(l.Expires)
+			}
+		}
+		t.Fatalf("no lease for %s", id)
+		return 0
+	}
+
+	// Registrations without ttl expire like the others when not renewed.
+	old, _ := newTestPeer(t)
+	form := url.Values{"id": {old.String()}, "addrs": {"/ip4/127.0.0.1/tcp/4001"}}
+	register(form)
+	assert.InDelta(t, DefaultLeaseTTL.Seconds(), expires(form).Seconds(), 5)
+
+	current, _ := newTestPeer(t)
+	form = url.Values{"id": {current.String()}, "addrs": {"/ip4/127.0.0.1/tcp/4001"}, "ttl": {"30"}}
+	register(form)
+	assert.InDelta(t, 30, expires(form).Seconds(), 5)
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/lp2p/p2pvpn/log"
+)
+
+const (
+	// DefaultLeaseTTL is the lease of registrations that ask for none.
+	DefaultLeaseTTL = 90 * time.Second
+
+	// minLeaseTTL and MaxLeaseTTL bound the leases clients ask for,
+	// the server host registers itself with MaxLeaseTTL.
+	minLeaseTTL = 10 * time.Second
+	MaxLeaseTTL = 24 * time.Hour
+)
+
+// lease is the registration lease of a peer, renewed by every Provide.
+type lease struct {
+	LastSeen time.Time `json:"last_seen"`
+	Expires  time.Time `json:"expires"`
+}
+
+// clampTTL bounds ttl, zero is DefaultLeaseTTL.
+func clampTTL(ttl time.Duration) time.Duration {
+	switch {
+	case ttl == 0:
+		return DefaultLeaseTTL
+	case ttl < minLeaseTTL:
+		return minLeaseTTL
+	case ttl > MaxLeaseTTL:
+		return MaxLeaseTTL
+	}
+	return ttl
+}
+
+// LastSeen returns when peer id last renewed its lease.
+func (t *Table) LastSeen(id peer.ID) (time.Time, bool) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	l, ok := t.leases[id]
+	return l.LastSeen, ok
+}
+
+// Expire removes the peers whose lease ended before now, with their
+// fingerprints and provider entries. It returns the removed peers.
+func (t *Table) Expire(now time.Time) ([]peer.ID, error) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	var expired []peer.ID
+	for id, l := range t.leases {
+		if now.Before(l.Expires) {
+			continue
+		}
+		pi, fingerprint := t.peers[id], t.fingerprintOf(id)
+		if err := t.bury(id, EventExpire); err != nil {
+			return expired, err
+		}
+		expired = append(expired, id)
+		t.publish(EventExpire, pi, fingerprint)
+	}
+	return expired, t.pruneTombstones(now)
+}
+
+// removePeer removes every record of id, t.mx must be held.
+func (t *Table) removePeer(id peer.ID) error {
+	idStr := id.String()
+	for _, fingerprint := range append([]string(nil), t.byPeer[id]...) {
+		if err := t.delete(bucketFingerprints, fingerprint); err != nil {
+			return err
+		}
+		t.unsetFingerprint(fingerprint)
+	}
+	for cid, pmap := range t.providers {
+		if _, ok := pmap[idStr]; !ok {
+			continue
+		}
+		if err := t.delete(bucketProviders, cid+"/"+idStr); err != nil {
+			return err
+		}
+		delete(pmap, idStr)
+	}
+	if err := t.delete(bucketPeers, idStr); err != nil {
+		return err
+	}
+	delete(t.peers, id)
+	if err := t.delete(bucketLeases, idStr); err != nil {
+		return err
+	}
+	delete(t.leases, id)
+	return nil
+}
+
+// RunJanitor expires stale peers every interval until stop is closed.
+func (t *Table) RunJanitor(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			expired, err := t.Expire(now)
+			for _, id := range expired {
+				log.Infof("Lease of peer %s expired", id)
+			}
+			if err != nil {
+				log.Errorf("Failed to expire leases: %v", err)
+			}
+		}
+	}
+}
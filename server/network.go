@@ -0,0 +1,143 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p/p2p/host/relay"
+	"github.com/lp2p/p2pvpn/common/auth"
+	"github.com/lp2p/p2pvpn/common/utils"
+)
+
+// DefaultNetwork is the network of the clients that do not choose one, it
+// uses the shared secret of the server.
+const DefaultNetwork = ""
+
+// NetworkParam is the query parameter requests choose their network with.
+const NetworkParam = "network"
+
+// validNetwork restricts network names to what fits in a bucket name and a
+// query parameter.
+var validNetwork = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// relayCid is the provider the server hosts register under as relays, they
+// relay for every network.
+var relayCid = utils.StrToCid(relay.RelayRendezvous).String()
+
+// Network is a virtual network of a server. Its peers and fingerprints are
+// kept in a table of their own and only its credentials reach them: the
+// tokens of the network and Secret, if any.
+type Network struct {
+	Name   string `yaml:"name"`
+	Secret string `yaml:"secret,omitempty"`
+}
+
+// ValidateNetwork checks that name can be the name of a network.
+func ValidateNetwork(name string) error {
+	if !validNetwork.MatchString(name) {
+		return fmt.Errorf("network: invalid name %q", name)
+	}
+	return nil
+}
+
+// network is the table and the credentials of a Network.
+type network struct {
+	tab      *Table
+	secret   string
+	verifier *auth.Verifier
+}
+
+// AddNetwork serves the network n from tab, its clients sign with the
+// tokens of n set by SetTokens or with n.Secret.
+func (a *APIService) AddNetwork(n Network, tab *Table) error {
+	if err := ValidateNetwork(n.Name); err != nil {
+		return err
+	}
+	if _, ok := a.networks[n.Name]; ok {
+		return fmt.Errorf("network: duplicate name %q", n.Name)
+	}
+	nw := &network{tab: tab, secret: n.Secret, verifier: auth.NewVerifier(nil)}
+	nw.verifier.SetCredentials(nw.credentials(nil))
+	a.networks[n.Name] = nw
+	return nil
+}
+
+// network returns the network of the request, chosen by NetworkParam.
+func (a *APIService) network(c *gin.Context) (*network, bool) {
+	n, ok := a.networks[c.Query(NetworkParam)]
+	return n, ok
+}
+
+// table returns the table of the network the request was authenticated
+// for.
+func (a *APIService) table(c *gin.Context) *Table {
+	return c.MustGet(networkKey).(*network).tab
+}
+
+// providerTable returns the table to find the providers of cid in, the
+// relays are registered in the default network and shared by all.
+func (a *APIService) providerTable(c *gin.Context, cid string) *Table {
+	if cid == relayCid {
+		return a.networks[DefaultNetwork].tab
+	}
+	return a.table(c)
+}
+
+// peerTable returns the table to find peer id in, the server host is in
+// the default network and shared by all.
+func (a *APIService) peerTable(c *gin.Context, id peer.ID) *Table {
+	if id != "" && id == a.serverID {
+		return a.networks[DefaultNetwork].tab
+	}
+	return a.table(c)
+}
+
+// NetworkStorage returns the part of s that keeps the records of the
+// network name, in buckets of its own. The default network uses s as is.
+// Closing it leaves s open.
+func NetworkStorage(s Storage, name string) Storage {
+	if name == DefaultNetwork {
+		return s
+	}
+	return networkStorage{Storage: s, prefix: networkBucketPrefix(name)}
+}
+
+func networkBucketPrefix(name string) string {
+	return "networks/" + name + "/"
+}
+
+type networkStorage struct {
+	Storage
+	prefix string
+}
+
+func (s networkStorage) Put(bucket, key string, value []byte) error {
+	return s.Storage.Put(s.prefix+bucket, key, value)
+}
+
+func (s networkStorage) Delete(bucket, key string) error {
+	return s.Storage.Delete(s.prefix+bucket, key)
+}
+
+func (s networkStorage) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	return s.Storage.ForEach(s.prefix+bucket, fn)
+}
+
+func (s networkStorage) Clear(bucket string) error {
+	return s.Storage.Clear(s.prefix + bucket)
+}
+
+func (s networkStorage) Apply(b *Batch) error {
+	prefixed := &Batch{ops: make([]batchOp, len(b.ops))}
+	for i, op := range b.ops {
+		op.bucket = s.prefix + op.bucket
+		prefixed.ops[i] = op
+	}
+	return s.Storage.Apply(prefixed)
+}
+
+func (s networkStorage) Close() error {
+	return nil
+}
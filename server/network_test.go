@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lp2p/p2pvpn/common/auth"
+	"github.com/lp2p/p2pvpn/constant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetworks(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	storage := NewMemoryStorage()
+	tab, err := NewTable(storage)
+	require.NoError(t, err)
+	a := NewAPIService(gin.New(), tab, "", "secret")
+	office, err := NewTable(NetworkStorage(storage, "office"))
+	require.NoError(t, err)
+	require.NoError(t, a.AddNetwork(Network{Name: "office"}, office))
+	lab, err := NewTable(NetworkStorage(storage, "lab"))
+	require.NoError(t, err)
+	require.NoError(t, a.AddNetwork(Network{Name: "lab", Secret: "lab-secret"}, lab))
+	assert.Error(t, a.AddNetwork(Network{Name: "lab"}, lab))
+	a.SetTokens([]Token{{ID: "alice", Secret: "alice-secret", Network: "office"}})
+	a.RegisterHandler()
+
+	call := func(network string, c auth.Credential, method, path string, body interface{}) int {
+		data, err := json.Marshal(body)
+		require.NoError(t, err)
+		if network != DefaultNetwork {
+			path += "?" + NetworkParam + "=" + url.QueryEscape(network)
+		}
+		req := httptest.NewRequest(method, path, bytes.NewReader(data))
+		req.Header.Set("Content-Type", "application/json")
+		require.NoError(t, auth.Sign(req, c))
+		w := httptest.NewRecorder()
+		a.router.ServeHTTP(w, req)
+		return w.Code
+	}
+	alice := auth.Credential{ID: "alice", Secret: "alice-secret"}
+	labSecret := auth.Credential{Secret: "lab-secret"}
+
+	id, priv := newTestPeer(t)
+	assert.Equal(t, http.StatusOK, call("office", alice, http.MethodPost, constant.V2ProvidersUrl+"cid", RegisterRequest{
+		PeerID:      id,
+		Addrs:       []string{"/ip4/1.2.3.4/tcp/4001"},
+		Fingerprint: "laptop",
+		Record:      seal(t, "laptop", priv),
+	}))
+	assert.Equal(t, http.StatusOK, call("office", alice, http.MethodGet, constant.V2FingerprintsUrl+"laptop", nil))
+
+	// Credentials only work in their network.
+	assert.Equal(t, http.StatusUnauthorized, call("lab", alice, http.MethodGet, constant.V2FingerprintsUrl+"laptop", nil))
+	assert.Equal(t, http.StatusUnauthorized, call("office", labSecret, http.MethodGet, constant.V2FingerprintsUrl+"laptop", nil))
+	assert.Equal(t, http.StatusUnauthorized, call("nope", alice, http.MethodGet, constant.V2FingerprintsUrl+"laptop", nil))
+
+	// Fingerprints and peers of a network are not found from the others.
+	assert.Equal(t, http.StatusNotFound, call("lab", labSecret, http.MethodGet, constant.V2FingerprintsUrl+"laptop", nil))
+	assert.Equal(t, http.StatusNotFound, call(DefaultNetwork, auth.Credential{Secret: "secret"}, http.MethodGet, constant.V2FingerprintsUrl+"laptop", nil))
+	assert.Equal(t, http.StatusNotFound, call("lab", labSecret, http.MethodGet, constant.V2PeersUrl+id.String(), nil))
+
+	// Relays registered in the default network serve every network.
+	relayID, _ := newTestPeer(t)
+	require.NoError(t, tab.Provide(relayCid, testInfo(t, relayID, "/ip4/1.2.3.4/tcp/4002"), "", nil, time.Minute))
+	var providers ProvidersResponse
+	req := httptest.NewRequest(http.MethodGet, constant.V2ProvidersUrl+relayCid+"?"+NetworkParam+"=lab", nil)
+	require.NoError(t, auth.Sign(req, labSecret))
+	w := httptest.NewRecorder()
+	a.router.ServeHTTP(w, req)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &providers))
+	require.Len(t, providers.Peers, 1)
+	assert.Equal(t, relayID, providers.Peers[0].Peer.ID)
+
+	// Networks survive a restart from the shared storage.
+	reopened, err := NewTable(NetworkStorage(storage, "office"))
+	require.NoError(t, err)
+	assert.Equal(t, id, reopened.FindPeerID("laptop"))
+	assert.Empty(t, tab.FindPeerID("laptop"))
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// Headers trusted proxies pass the address of the client in.
+const (
+	headerForwardedFor = "X-Forwarded-For"
+	headerRealIP       = "X-Real-Ip"
+)
+
+// SetTrustedProxies sets the proxies whose forwarded headers tell the
+// address of clients, as IPs or CIDRs. Headers of other remotes are
+// ignored, so clients can not pick their observed address.
+func (a *APIService) SetTrustedProxies(proxies []string) error {
+	nets, err := ParseTrustedProxies(proxies)
+	if err != nil {
+		return err
+	}
+	a.trustedProxies = nets
+	return nil
+}
+
+// ParseTrustedProxies parses proxies given as IPs or CIDRs.
+func ParseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", p)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", p)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// observedIP returns the address the request comes from. Behind trusted
+// proxies it is the last address of X-Forwarded-For that is not a trusted
+// proxy, or X-Real-Ip.
+func (a *APIService) observedIP(c *gin.Context) (net.IP, error) {
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid remote address %q", c.Request.RemoteAddr)
+	}
+	if !a.trusted(ip) {
+		return ip, nil
+	}
+
+	// Each proxy appends the address it got the request from, the ones
+	// before the first untrusted address from the right are the client's
+	// to forge.
+	hops := strings.Split(strings.Join(c.Request.Header.Values(headerForwardedFor), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !a.trusted(hop) {
+			return ip, nil
+		}
+	}
+	if real := net.ParseIP(strings.TrimSpace(c.GetHeader(headerRealIP))); real != nil {
+		return real, nil
+	}
+	return ip, nil
+}
+
+func (a *APIService) trusted(ip net.IP) bool {
+	for _, n := range a.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// privateNets are the RFC 1918 and unique local ranges.
+var privateNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+func isPrivateIP(ip net.IP) bool {
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// observedAddrs rewrites the addrs a peer registers as seen from the
+// server: loopback and unspecified IPs, which only mean something on the
+// peer, are replaced by the observed IP, and link-local ones, which no
+// other peer can dial, are dropped. Over relays nothing is observed, so
+// loopback and unspecified IPs are dropped too. The rest of each multiaddr
+// is kept and duplicates are removed.
+//
+// Private IPs are kept, peers on the same LAN can dial them, but when the
+// peer is observed on a public IP they are moved last, so the others dial
+// its public addresses first.
+func observedAddrs(addrs []ma.Multiaddr, observed net.IP) []ma.Multiaddr {
+	var out, private []ma.Multiaddr
+	public := observed != nil && !observed.IsLoopback() && !observed.IsUnspecified() && !isPrivateIP(observed)
+	seen := make(map[string]bool)
+	for _, addr := range addrs {
+		addr, ok := observedAddr(addr, observed)
+		if !ok || seen[string(addr.Bytes())] {
+			continue
+		}
+		seen[string(addr.Bytes())] = true
+		if ip, err := manet.ToIP(addr); public && err == nil && isPrivateIP(ip) {
+			private = append(private, addr)
+			continue
+		}
+		out = append(out, addr)
+	}
+	return append(out, private...)
+}
+
+func observedAddr(addr ma.Multiaddr, observed net.IP) (ma.Multiaddr, bool) {
+	first, rest := ma.SplitFirst(addr)
+	if first == nil {
+		return nil, false
+	}
+	if first.Protocol().Code != ma.P_IP4 && first.Protocol().Code != ma.P_IP6 {
+		// dns, p2p-circuit and the like are not addresses of the peer.
+		return addr, true
+	}
+
+	ip := net.IP(first.RawValue())
+	switch {
+	case ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast():
+		return nil, false
+	case ip.IsLoopback(), ip.IsUnspecified():
+		if observed.IsLoopback() && ip.IsLoopback() {
+			// Peers on the server host keep their own loopback.
+			return addr, true
+		}
+		if observed == nil || observed.IsUnspecified() {
+			// Relayed rendezvous streams have no address to observe.
+			return nil, false
+		}
+		if (ip.To4() == nil) != (observed.To4() == nil) {
+			// An IPv4 listener can not be reached on an IPv6 address.
+			return nil, false
+		}
+		observedMa, err := manet.FromIP(observed)
+		if err != nil {
+			return nil, false
+		}
+		if rest == nil {
+			return observedMa, true
+		}
+		return observedMa.Encapsulate(rest), true
+	}
+	return addr, true
+}
+
+// observedMultiaddr returns ip as a multiaddr, like /ip4/1.2.3.4, empty
+// if nothing was observed.
+func observedMultiaddr(ip net.IP) string {
+	if ip.IsUnspecified() {
+		return ""
+	}
+	m, err := manet.FromIP(ip)
+	if err != nil {
+		return ""
+	}
+	return m.String()
+}
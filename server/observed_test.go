@@ -0,0 +1,116 @@
+package server
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObservedAddrs(t *testing.T) {
+	tests := []struct {
+		name     string
+		observed string
+		addrs    []string
+		want     []string
+	}{
+		{
+			name:     "every loopback",
+			observed: "203.0.113.7",
+			addrs:    []string{"/ip4/127.0.0.1/tcp/4001", "/ip4/127.0.0.1/udp/4001/quic", "/ip4/192.168.1.2/tcp/4001"},
+			want:     []string{"/ip4/203.0.113.7/tcp/4001", "/ip4/203.0.113.7/udp/4001/quic", "/ip4/192.168.1.2/tcp/4001"},
+		},
+		{
+			name:     "ipv6 remote",
+			observed: "2001:db8::7",
+			addrs:    []string{"/ip6/::1/tcp/4001", "/ip4/127.0.0.1/tcp/4001", "/ip6/fe80::1/tcp/4001"},
+			want:     []string{"/ip6/2001:db8::7/tcp/4001"},
+		},
+		{
+			name:     "other family",
+			observed: "2001:db8::7",
+			addrs:    []string{"/ip4/0.0.0.0/tcp/4001", "/ip4/127.0.0.1/udp/4001/quic", "/ip4/192.168.1.2/tcp/4001"},
+			want:     []string{"/ip4/192.168.1.2/tcp/4001"},
+		},
+		{
+			name:     "ipv4 remote",
+			observed: "203.0.113.7",
+			addrs:    []string{"/ip6/::/tcp/4001", "/ip6/::1/tcp/4001", "/ip4/0.0.0.0/tcp/4001"},
+			want:     []string{"/ip4/203.0.113.7/tcp/4001"},
+		},
+		{
+			name:     "unspecified and duplicates",
+			observed: "203.0.113.7",
+			addrs:    []string{"/ip4/0.0.0.0/tcp/4001", "/ip4/203.0.113.7/tcp/4001", "/p2p-circuit"},
+			want:     []string{"/ip4/203.0.113.7/tcp/4001", "/p2p-circuit"},
+		},
+		{
+			name:     "peer on the server host",
+			observed: "127.0.0.1",
+			addrs:    []string{"/ip4/127.0.0.1/tcp/4001", "/ip4/169.254.1.1/tcp/4001"},
+			want:     []string{"/ip4/127.0.0.1/tcp/4001"},
+		},
+		{
+			name:     "private addrs last",
+			observed: "203.0.113.7",
+			addrs:    []string{"/ip4/10.0.0.2/tcp/4001", "/ip6/fd00::2/tcp/4001", "/ip4/127.0.0.1/tcp/4001", "/dns4/example.com/tcp/4001"},
+			want:     []string{"/ip4/203.0.113.7/tcp/4001", "/dns4/example.com/tcp/4001", "/ip4/10.0.0.2/tcp/4001", "/ip6/fd00::2/tcp/4001"},
+		},
+		{
+			name:     "private remote",
+			observed: "192.168.1.1",
+			addrs:    []string{"/ip4/10.0.0.2/tcp/4001", "/ip4/127.0.0.1/tcp/4001"},
+			want:     []string{"/ip4/10.0.0.2/tcp/4001", "/ip4/192.168.1.1/tcp/4001"},
+		},
+		{
+			name:     "relayed rendezvous stream",
+			observed: "0.0.0.0",
+			addrs:    []string{"/ip4/0.0.0.0/tcp/4001", "/ip4/127.0.0.1/tcp/4001", "/ip4/192.168.1.2/tcp/4001"},
+			want:     []string{"/ip4/192.168.1.2/tcp/4001"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var addrs []ma.Multiaddr
+			for _, s := range tt.addrs {
+				addrs = append(addrs, ma.StringCast(s))
+			}
+			var got []string
+			for _, addr := range observedAddrs(addrs, net.ParseIP(tt.observed)) {
+				got = append(got, addr.String())
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestObservedIP(t *testing.T) {
+	a := NewAPIService(gin.New(), NewRouteTable(), "", "")
+	require.NoError(t, a.SetTrustedProxies([]string{"10.0.0.1", "fd00::/8"}))
+	assert.Error(t, a.SetTrustedProxies([]string{"nope"}))
+
+	observed := func(remote string, headers map[string]string) string {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remote
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = req
+		ip, err := a.observedIP(c)
+		require.NoError(t, err)
+		return ip.String()
+	}
+
+	// Untrusted remotes can not forge their address.
+	assert.Equal(t, "198.51.100.1", observed("198.51.100.1:1234", map[string]string{headerForwardedFor: "1.1.1.1"}))
+	// The client forged the first hop, the proxy appended the real one.
+	assert.Equal(t, "203.0.113.7", observed("10.0.0.1:1234", map[string]string{headerForwardedFor: "1.1.1.1, 203.0.113.7"}))
+	assert.Equal(t, "2001:db8::7", observed("[fd00::1]:1234", map[string]string{headerForwardedFor: "2001:db8::7, fd00::2"}))
+	assert.Equal(t, "203.0.113.8", observed("10.0.0.1:1234", map[string]string{headerRealIP: "203.0.113.8"}))
+	assert.Equal(t, "10.0.0.1", observed("10.0.0.1:1234", nil))
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/record"
+)
+
+var (
+	// ErrInvalidRecord is returned for fingerprint records that are
+	// malformed, badly signed or for another fingerprint.
+	ErrInvalidRecord = errors.New("invalid fingerprint record")
+	// ErrStaleRecord is returned for records older than the last one
+	// accepted for the fingerprint.
+	ErrStaleRecord = errors.New("stale fingerprint record")
+	// ErrFingerprintOwned is returned when another key owns a fingerprint
+	// and no admin approved the rebind.
+	ErrFingerprintOwned = errors.New("fingerprint is owned by another peer")
+)
+
+func init() {
+	record.RegisterType(&FingerprintRecord{})
+}
+
+// FingerprintRecord claims Fingerprint for PeerID. It is sealed in an
+// envelope signed by the key of PeerID, so the server and other peers can
+// check the binding.
+type FingerprintRecord struct {
+	Fingerprint string  `json:"fingerprint"`
+	PeerID      peer.ID `json:"peer_id"`
+	// Seq grows with every record sealed by a peer, the server refuses
+	// records older than the last one it accepted.
+	Seq uint64 `json:"seq"`
+}
+
+// Domain implements record.Record.
+func (r *FingerprintRecord) Domain() string {
+	return "p2pvpn-fingerprint-record"
+}
+
+// Codec implements record.Record.
+func (r *FingerprintRecord) Codec() []byte {
+	return []byte("/p2pvpn/fingerprint-record")
+}
+
+// MarshalRecord implements record.Record.
+func (r *FingerprintRecord) MarshalRecord() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+// UnmarshalRecord implements record.Record.
+func (r *FingerprintRecord) UnmarshalRecord(data []byte) error {
+	return json.Unmarshal(data, r)
+}
+
+var (
+	seqMx   sync.Mutex
+	lastSeq uint64
+)
+
+// nextSeq returns the Seq of a record sealed at now: its time, or one more
+// than the last one when the clock went backwards.
+func nextSeq(now time.Time) uint64 {
+	seqMx.Lock()
+	defer seqMx.Unlock()
+
+	seq := uint64(now.UnixNano())
+	if seq <= lastSeq {
+		seq = lastSeq + 1
+	}
+	lastSeq = seq
+	return seq
+}
+
+// SealFingerprint signs a record claiming fingerprint with priv and
+// returns the marshaled envelope.
+func SealFingerprint(fingerprint string, priv crypto.PrivKey) ([]byte, error) {
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	rec := &FingerprintRecord{
+		Fingerprint: fingerprint,
+		PeerID:      id,
+		Seq:         nextSeq(time.Now()),
+	}
+	envelope, err := record.Seal(rec, priv)
+	if err != nil {
+		return nil, err
+	}
+	return envelope.Marshal()
+}
+
+// OpenFingerprint checks the envelope data is a record for fingerprint
+// signed by the key of the peer it names, and returns the record.
+func OpenFingerprint(data []byte, fingerprint string) (*FingerprintRecord, error) {
+	rec := &FingerprintRecord{}
+	envelope, err := record.ConsumeTypedEnvelope(data, rec)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+	}
+	signer, err := peer.IDFromPublicKey(envelope.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+	}
+	if signer != rec.PeerID {
+		return nil, fmt.Errorf("%w: signed by %s for %s", ErrInvalidRecord, signer, rec.PeerID)
+	}
+	if rec.Fingerprint != fingerprint {
+		return nil, fmt.Errorf("%w: record is for %q", ErrInvalidRecord, rec.Fingerprint)
+	}
+	return rec, nil
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/lp2p/p2pvpn/common/utils"
+	"github.com/lp2p/p2pvpn/constant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenFingerprint(t *testing.T) {
+	id, priv := newTestPeer(t)
+
+	rec, err := OpenFingerprint(seal(t, "laptop", priv), "laptop")
+	require.NoError(t, err)
+	assert.Equal(t, id, rec.PeerID)
+
+	_, err = OpenFingerprint(seal(t, "laptop", priv), "exitbox")
+	assert.ErrorIs(t, err, ErrInvalidRecord)
+	_, err = OpenFingerprint([]byte("garbage"), "laptop")
+	assert.ErrorIs(t, err, ErrInvalidRecord)
+	_, err = OpenFingerprint(nil, "laptop")
+	assert.ErrorIs(t, err, ErrInvalidRecord)
+}
+
+func TestRebind(t *testing.T) {
+	tab := NewRouteTable()
+	cid := utils.StrToCid(constant.PeerRendezvous).String()
+	alice, alicePriv := newTestPeer(t)
+	mallory, malloryPriv := newTestPeer(t)
+
+	require.NoError(t, tab.Provide(cid, testInfo(t, alice), "laptop", seal(t, "laptop", alicePriv), 0))
+
+	// A record signed by another key than the registering peer.
+	err := tab.Provide(cid, testInfo(t, mallory), "laptop", seal(t, "laptop", alicePriv), 0)
+	assert.ErrorIs(t, err, ErrInvalidRecord)
+
+	// A replayed record.
+	old := seal(t, "laptop", alicePriv)
+	require.NoError(t, tab.Provide(cid, testInfo(t, alice), "laptop", seal(t, "laptop", alicePriv), 0))
+	assert.ErrorIs(t, tab.Provide(cid, testInfo(t, alice), "laptop", old, 0), ErrStaleRecord)
+
+	// Another key is refused, also after the owner logged out.
+	err = tab.Provide(cid, testInfo(t, mallory), "laptop", seal(t, "laptop", malloryPriv), 0)
+	assert.ErrorIs(t, err, ErrFingerprintOwned)
+	assert.ErrorIs(t, tab.Delete("laptop", seal(t, "laptop", malloryPriv)), ErrFingerprintOwned)
+	require.NoError(t, tab.Delete("laptop", seal(t, "laptop", alicePriv)))
+	err = tab.Provide(cid, testInfo(t, mallory), "laptop", seal(t, "laptop", malloryPriv), 0)
+	assert.ErrorIs(t, err, ErrFingerprintOwned)
+	assert.Equal(t, map[string]peer.ID{"laptop": mallory}, tab.PendingRebinds())
+
+	// An approval lets it take the fingerprint over once.
+	require.NoError(t, tab.ApproveRebind("laptop", mallory))
+	require.NoError(t, tab.Provide(cid, testInfo(t, mallory), "laptop", seal(t, "laptop", malloryPriv), 0))
+	assert.Equal(t, mallory, tab.FindPeerID("laptop"))
+	assert.Empty(t, tab.PendingRebinds())
+	err = tab.Provide(cid, testInfo(t, alice), "laptop", seal(t, "laptop", alicePriv), 0)
+	assert.ErrorIs(t, err, ErrFingerprintOwned)
+
+	// A released fingerprint goes to the next peer registering it.
+	require.NoError(t, tab.Release("laptop"))
+	require.NoError(t, tab.Provide(cid, testInfo(t, alice), "laptop", seal(t, "laptop", alicePriv), 0))
+	assert.Equal(t, alice, tab.FindPeerID("laptop"))
+}
+
+func TestNextSeq(t *testing.T) {
+	now := time.Now()
+	first := nextSeq(now)
+	// The clock going backwards does not make records stale.
+	assert.Greater(t, nextSeq(now.Add(-time.Hour)), first)
+	assert.Greater(t, nextSeq(now), first+1)
+}
+
+func TestPendingRebindsBounded(t *testing.T) {
+	tab := NewRouteTable()
+	owner, ownerPriv := newTestPeer(t)
+	mallory, malloryPriv := newTestPeer(t)
+
+	for i := 0; i <= maxPendingRebinds; i++ {
+		fingerprint := fmt.Sprintf("box%d", i)
+		require.NoError(t, tab.Provide("cid", testInfo(t, owner), fingerprint, seal(t, fingerprint, ownerPriv), 0))
+		err := tab.Provide("cid", testInfo(t, mallory), fingerprint, seal(t, fingerprint, malloryPriv), 0)
+		assert.ErrorIs(t, err, ErrFingerprintOwned)
+	}
+	assert.Len(t, tab.PendingRebinds(), maxPendingRebinds)
+	assert.Equal(t, maxPendingRebinds, tab.Stats().PendingRebinds)
+}
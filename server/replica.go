@@ -0,0 +1,345 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/lp2p/p2pvpn/log"
+)
+
+// tombstoneTTL is how long removals are remembered, so replicas that have
+// not seen them yet do not bring the removed peers back. The leases of the
+// registrations they removed have all run out by then, and replicas skip
+// peers with a lease run out.
+const tombstoneTTL = MaxLeaseTTL
+
+// Tombstone records the removal of a peer.
+type Tombstone struct {
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+	// Until is when a kicked peer may register again.
+	Until time.Time `json:"until,omitempty"`
+}
+
+// ReplicaPeer is the state of a registered peer replicated to other
+// servers.
+type ReplicaPeer struct {
+	Peer        peer.AddrInfo `json:"peer"`
+	Providers   []string      `json:"providers"`
+	Fingerprint string        `json:"fingerprint,omitempty"`
+	Record      []byte        `json:"record,omitempty"`
+	Lease       lease         `json:"lease"`
+}
+
+// Snapshot is the replicated state of a table. Replicas merge snapshots
+// entry by entry, the newest write of a peer wins: a registration by the
+// time of its lease renewal, a removal by the time of its tombstone.
+type Snapshot struct {
+	Peers      map[peer.ID]ReplicaPeer `json:"peers"`
+	Tombstones map[peer.ID]Tombstone   `json:"tombstones"`
+	// Owners are merged by the sequence number of their records, released
+	// owners included.
+	Owners map[string]owner `json:"owners"`
+	// Approvals and Pending rebinds are merged while their fingerprint is
+	// not taken over yet, local ones win.
+	Approvals map[string]peer.ID `json:"approvals"`
+	Pending   map[string]peer.ID `json:"pending"`
+}
+
+// bury removes peer id and records the removal as typ, t.mx must be held.
+func (t *Table) bury(id peer.ID, typ EventType) error {
+	return t.buryUntil(id, typ, time.Time{})
+}
+
+// buryUntil is bury refusing registrations of id until until, t.mx must be
+// held.
+func (t *Table) buryUntil(id peer.ID, typ EventType, until time.Time) error {
+	if err := t.removePeer(id); err != nil {
+		return err
+	}
+	tb := Tombstone{Type: typ, Time: t.now(), Until: until}
+	if err := t.put(bucketTombstones, id.String(), tb); err != nil {
+		return err
+	}
+	t.tombstones[id] = tb
+	return nil
+}
+
+// unbury forgets the removal of a peer that registers again, t.mx must be
+// held.
+func (t *Table) unbury(id peer.ID) error {
+	if _, ok := t.tombstones[id]; !ok {
+		return nil
+	}
+	if err := t.delete(bucketTombstones, id.String()); err != nil {
+		return err
+	}
+	delete(t.tombstones, id)
+	return nil
+}
+
+// pruneTombstones forgets removals older than tombstoneTTL, t.mx must be
+// held.
+func (t *Table) pruneTombstones(now time.Time) error {
+	for id, tb := range t.tombstones {
+		if now.Sub(tb.Time) < tombstoneTTL {
+			continue
+		}
+		if err := t.delete(bucketTombstones, id.String()); err != nil {
+			return err
+		}
+		delete(t.tombstones, id)
+	}
+	return nil
+}
+
+// Snapshot returns the replicated state of the table.
+func (t *Table) Snapshot() Snapshot {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	s := Snapshot{
+		Peers:      make(map[peer.ID]ReplicaPeer, len(t.peers)),
+		Tombstones: make(map[peer.ID]Tombstone, len(t.tombstones)),
+		Owners:     make(map[string]owner, len(t.owners)),
+		Approvals:  make(map[string]peer.ID, len(t.approvals)),
+		Pending:    make(map[string]peer.ID, len(t.pending)),
+	}
+	for id, pi := range t.peers {
+		rp := ReplicaPeer{Peer: pi, Lease: t.leases[id]}
+		for cid, pmap := range t.providers {
+			if _, ok := pmap[id.String()]; ok {
+				rp.Providers = append(rp.Providers, cid)
+			}
+		}
+		if fingerprint := t.fingerprintOf(id); fingerprint != "" {
+			rp.Fingerprint = fingerprint
+			rp.Record = t.records[fingerprint]
+		}
+		s.Peers[id] = rp
+	}
+	for id, tb := range t.tombstones {
+		s.Tombstones[id] = tb
+	}
+	for fingerprint, o := range t.owners {
+		s.Owners[fingerprint] = o
+	}
+	for fingerprint, id := range t.approvals {
+		s.Approvals[fingerprint] = id
+	}
+	for fingerprint, id := range t.pending {
+		s.Pending[fingerprint] = id
+	}
+	return s
+}
+
+// Merge applies the entries of s newer than those of the table.
+func (t *Table) Merge(s Snapshot) error {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	for fingerprint, o := range s.Owners {
+		if local, ok := t.owners[fingerprint]; ok && local.Seq >= o.Seq {
+			continue
+		}
+		if err := o.check(fingerprint); err != nil {
+			log.Warnf("Skipped replicated owner of %s: %v", fingerprint, err)
+			continue
+		}
+		if err := t.put(bucketOwners, fingerprint, o); err != nil {
+			return err
+		}
+		t.owners[fingerprint] = o
+		if err := t.settleRebind(fingerprint); err != nil {
+			return err
+		}
+	}
+	if err := t.mergeRebinds(s); err != nil {
+		return err
+	}
+
+	for id, tb := range s.Tombstones {
+		if local, ok := t.tombstones[id]; ok && !tb.Time.After(local.Time) {
+			continue
+		}
+		if l, ok := t.leases[id]; ok {
+			if l.LastSeen.After(tb.Time) {
+				continue
+			}
+			pi, fingerprint := t.peers[id], t.fingerprintOf(id)
+			if err := t.removePeer(id); err != nil {
+				return err
+			}
+			t.publish(tb.Type, pi, fingerprint)
+		}
+		if err := t.put(bucketTombstones, id.String(), tb); err != nil {
+			return err
+		}
+		t.tombstones[id] = tb
+	}
+
+	now := t.now()
+	for id, rp := range s.Peers {
+		if !now.Before(rp.Lease.Expires) {
+			continue
+		}
+		if tb, ok := t.tombstones[id]; ok && !rp.Lease.LastSeen.After(tb.Time) {
+			continue
+		}
+		if l, ok := t.leases[id]; ok && !rp.Lease.LastSeen.After(l.LastSeen) {
+			continue
+		}
+		err := t.applyPeer(id, rp)
+		if errors.Is(err, ErrInvalidRecord) || errors.Is(err, ErrFingerprintOwned) {
+			log.Warnf("Skipped replicated peer %s: %v", id, err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("merge peer %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// settleRebind forgets the approval and the pending rebind of fingerprint
+// once its owner is the peer they are for, t.mx must be held.
+func (t *Table) settleRebind(fingerprint string) error {
+	o := t.owners[fingerprint]
+	if o.Released {
+		return nil
+	}
+	if id, ok := t.approvals[fingerprint]; ok && id == o.PeerID {
+		if err := t.delete(bucketApprovals, fingerprint); err != nil {
+			return err
+		}
+		delete(t.approvals, fingerprint)
+	}
+	if id, ok := t.pending[fingerprint]; ok && id == o.PeerID {
+		delete(t.pending, fingerprint)
+	}
+	return nil
+}
+
+// mergeRebinds adds the approvals and pending rebinds of s the table does
+// not have, unless already settled, t.mx must be held.
+func (t *Table) mergeRebinds(s Snapshot) error {
+	settled := func(fingerprint string, id peer.ID) bool {
+		o, ok := t.owners[fingerprint]
+		return ok && !o.Released && o.PeerID == id
+	}
+	for fingerprint, id := range s.Approvals {
+		if _, ok := t.approvals[fingerprint]; ok || settled(fingerprint, id) {
+			continue
+		}
+		if err := t.put(bucketApprovals, fingerprint, id.String()); err != nil {
+			return err
+		}
+		t.approvals[fingerprint] = id
+	}
+	for fingerprint, id := range s.Pending {
+		if _, ok := t.pending[fingerprint]; ok || settled(fingerprint, id) {
+			continue
+		}
+		t.addPending(fingerprint, id)
+	}
+	return nil
+}
+
+// applyPeer replaces the registration of id by rp, t.mx must be held.
+func (t *Table) applyPeer(id peer.ID, rp ReplicaPeer) error {
+	if rp.Peer.ID != id {
+		return fmt.Errorf("%w: entry is for %s", ErrInvalidRecord, rp.Peer.ID)
+	}
+	// Replicas are trusted with leases, not with bindings: the record must
+	// hold and the fingerprint must belong to the peer.
+	if rp.Fingerprint != "" {
+		rec, err := OpenFingerprint(rp.Record, rp.Fingerprint)
+		if err != nil {
+			return err
+		}
+		if rec.PeerID != id {
+			return fmt.Errorf("%w: record is for %s", ErrInvalidRecord, rec.PeerID)
+		}
+		if o, ok := t.owners[rp.Fingerprint]; ok && !o.Released && o.PeerID != id {
+			return fmt.Errorf("%w: %s", ErrFingerprintOwned, rp.Fingerprint)
+		}
+	}
+
+	old, known := t.peers[id]
+	oldFingerprint := t.fingerprintOf(id)
+	if known {
+		if err := t.removePeer(id); err != nil {
+			return err
+		}
+	}
+	if err := t.unbury(id); err != nil {
+		return err
+	}
+
+	idStr := id.String()
+	if err := t.put(bucketLeases, idStr, rp.Lease); err != nil {
+		return err
+	}
+	t.leases[id] = rp.Lease
+	for _, cid := range rp.Providers {
+		if err := t.put(bucketProviders, cid+"/"+idStr, rp.Peer); err != nil {
+			return err
+		}
+		pmap, ok := t.providers[cid]
+		if !ok {
+			pmap = make(map[string]peer.AddrInfo)
+			t.providers[cid] = pmap
+		}
+		pmap[idStr] = rp.Peer
+	}
+	if err := t.put(bucketPeers, idStr, rp.Peer); err != nil {
+		return err
+	}
+	t.peers[id] = rp.Peer
+	if rp.Fingerprint != "" {
+		if prev, ok := t.fingerprints[rp.Fingerprint]; ok && prev != id {
+			// The fingerprint moved to id, its former peer is gone.
+			prevInfo := t.peers[prev]
+			if err := t.bury(prev, EventLogout); err != nil {
+				return err
+			}
+			t.publish(EventLogout, prevInfo, rp.Fingerprint)
+		}
+		b := binding{PeerID: id, Record: rp.Record}
+		if err := t.put(bucketFingerprints, rp.Fingerprint, b); err != nil {
+			return err
+		}
+		t.setFingerprint(rp.Fingerprint, id, rp.Record)
+	}
+
+	switch {
+	case !known:
+		t.publish(EventRegister, rp.Peer, rp.Fingerprint)
+	case !sameAddrs(old, rp.Peer) || rp.Fingerprint != oldFingerprint:
+		t.publish(EventUpdate, rp.Peer, rp.Fingerprint)
+	}
+	return nil
+}
+
+// loadTombstones loads the removals, t.mx must be held.
+func (t *Table) loadTombstones() error {
+	err := t.storage.ForEach(bucketTombstones, func(key string, value []byte) error {
+		id, err := peer.Decode(key)
+		if err != nil {
+			return err
+		}
+		var tb Tombstone
+		if err := json.Unmarshal(value, &tb); err != nil {
+			return err
+		}
+		t.tombstones[id] = tb
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("load tombstones: %w", err)
+	}
+	return nil
+}
@@ -1,25 +1,68 @@
 package server
 
-import "github.com/libp2p/go-libp2p-core/peer"
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
 
 // StatusResp receives server response status.
 type StatusResp struct {
 	Status bool `json:"status"`
 }
 
+// NewPeerResp receives the response of a registration.
+type NewPeerResp struct {
+	Status bool `json:"status"`
+	// Observed is the IP the server sees the peer at, like /ip4/1.2.3.4.
+	Observed string `json:"observed,omitempty"`
+}
+
 // ProvidersResp receives FindProvidersAsync response.
 type ProvidersResp struct {
 	Status    bool                     `json:"status"`
 	AddrInfos map[string]peer.AddrInfo `json:"addr_infos,omitempty"`
+	// LastSeen is when each peer last renewed its lease.
+	LastSeen map[string]time.Time `json:"last_seen,omitempty"`
 }
 
 // PeerResp receives FindPeer response.
 type PeerResp struct {
 	Status   bool          `json:"status"`
 	AddrInfo peer.AddrInfo `json:"addr_info,omitempty"`
+	LastSeen *time.Time    `json:"last_seen,omitempty"`
 }
 
 // IDResp receives FindPeerID and GetServerID response.
 type IDResp struct {
-	PeerID peer.ID `json:"peer_id,omitempty"`
+	PeerID   peer.ID    `json:"peer_id,omitempty"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+	// Record is the envelope signed by PeerID claiming the fingerprint.
+	Record []byte `json:"record,omitempty"`
+}
+
+// PeersResp receives the peer list of the admin API.
+type PeersResp struct {
+	Status bool         `json:"status"`
+	Peers  []PeerStatus `json:"peers"`
+}
+
+// PeerStatusResp receives one peer of the admin API.
+type PeerStatusResp struct {
+	Status bool       `json:"status"`
+	Peer   PeerStatus `json:"peer"`
+}
+
+// StatsResp receives the stats of the admin API.
+type StatsResp struct {
+	Status  bool      `json:"status"`
+	Stats   Stats     `json:"stats"`
+	Started time.Time `json:"started"`
+}
+
+// RebindsResp receives the pending rebinds of the admin API, fingerprint
+// to the peer refused.
+type RebindsResp struct {
+	Status  bool               `json:"status"`
+	Rebinds map[string]peer.ID `json:"rebinds"`
 }
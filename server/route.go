@@ -1,33 +1,214 @@
 package server
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/libp2p/go-libp2p-core/peer"
-	"github.com/lp2p/p2pvpn/common/utils"
-	"github.com/lp2p/p2pvpn/constant"
+	"github.com/lp2p/p2pvpn/log"
 	ma "github.com/multiformats/go-multiaddr"
 )
 
+// ErrNotFound is returned for peers the table does not know.
+var ErrNotFound = errors.New("route: not found")
+
+// ErrKicked is returned for peers registering again before the lease they
+// were kicked with ran out.
+var ErrKicked = errors.New("route: peer kicked")
+
 type Table struct {
 	mx           sync.Mutex
 	providers    map[string]map[string]peer.AddrInfo
 	peers        map[peer.ID]peer.AddrInfo
 	fingerprints map[string]peer.ID
+	// byPeer indexes fingerprints by peer, in the order they were bound.
+	byPeer     map[peer.ID][]string
+	leases     map[peer.ID]lease
+	records    map[string][]byte
+	owners     map[string]owner
+	approvals  map[string]peer.ID
+	pending    map[string]peer.ID
+	subs       map[chan Event]struct{}
+	tombstones map[peer.ID]Tombstone
+	storage    Storage
+	// batch holds the writes of the transaction begun by begin, if any.
+	batch *Batch
+	now   func() time.Time
 }
 
+// NewRouteTable creates a Table kept in memory only.
 func NewRouteTable() *Table {
-	return &Table{
+	t, _ := NewTable(NewMemoryStorage())
+	return t
+}
+
+// NewTable creates a Table backed by storage and loads its records,
+// changes are written through to storage.
+func NewTable(storage Storage) (*Table, error) {
+	t := &Table{
 		providers:    make(map[string]map[string]peer.AddrInfo),
+		peers:        make(map[peer.ID]peer.AddrInfo),
 		fingerprints: make(map[string]peer.ID),
+		byPeer:       make(map[peer.ID][]string),
+		leases:       make(map[peer.ID]lease),
+		records:      make(map[string][]byte),
+		owners:       make(map[string]owner),
+		approvals:    make(map[string]peer.ID),
+		pending:      make(map[string]peer.ID),
+		subs:         make(map[chan Event]struct{}),
+		tombstones:   make(map[peer.ID]Tombstone),
+		storage:      storage,
+		now:          time.Now,
+	}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Close closes the storage of the table.
+func (t *Table) Close() error {
+	return t.storage.Close()
+}
+
+func (t *Table) load() error {
+	err := t.storage.ForEach(bucketProviders, func(key string, value []byte) error {
+		i := strings.LastIndexByte(key, '/')
+		if i < 0 {
+			return fmt.Errorf("invalid provider key %q", key)
+		}
+		var pi peer.AddrInfo
+		if err := json.Unmarshal(value, &pi); err != nil {
+			return err
+		}
+		cid, idStr := key[:i], key[i+1:]
+		pmap, ok := t.providers[cid]
+		if !ok {
+			pmap = make(map[string]peer.AddrInfo)
+			t.providers[cid] = pmap
+		}
+		pmap[idStr] = pi
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("load providers: %w", err)
+	}
+
+	err = t.storage.ForEach(bucketPeers, func(key string, value []byte) error {
+		var pi peer.AddrInfo
+		if err := json.Unmarshal(value, &pi); err != nil {
+			return err
+		}
+		t.peers[pi.ID] = pi
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("load peers: %w", err)
+	}
+
+	err = t.storage.ForEach(bucketFingerprints, func(key string, value []byte) error {
+		var b binding
+		if err := json.Unmarshal(value, &b); err != nil {
+			return err
+		}
+		t.setFingerprint(key, b.PeerID, b.Record)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("load fingerprints: %w", err)
 	}
+
+	err = t.storage.ForEach(bucketLeases, func(key string, value []byte) error {
+		id, err := peer.Decode(key)
+		if err != nil {
+			return err
+		}
+		var l lease
+		if err := json.Unmarshal(value, &l); err != nil {
+			return err
+		}
+		t.leases[id] = l
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("load leases: %w", err)
+	}
+	if err := t.loadBindings(); err != nil {
+		return err
+	}
+	return t.loadTombstones()
 }
 
-// parseAddrInfoHack parses addrs string to peer.AddrInfo
+// put stores the JSON encoding of v at key of bucket, t.mx must be held.
+func (t *Table) put(bucket, key string, v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if t.batch != nil {
+		t.batch.Put(bucket, key, value)
+		return nil
+	}
+	return t.storage.Put(bucket, key, value)
+}
+
+// delete removes key from bucket, t.mx must be held.
+func (t *Table) delete(bucket, key string) error {
+	if t.batch != nil {
+		t.batch.Delete(bucket, key)
+		return nil
+	}
+	return t.storage.Delete(bucket, key)
+}
+
+// begin buffers the writes of the table until commit, which makes them in
+// one transaction. t.mx must be held.
+func (t *Table) begin() {
+	t.batch = &Batch{}
+}
+
+// commit makes the writes buffered since begin if err is nil. When err is
+// not nil or the writes fail, the records changed in memory since begin
+// are loaded again from storage, which was left as it was. t.mx must be
+// held.
+func (t *Table) commit(err error) error {
+	b := t.batch
+	t.batch = nil
+	if err == nil {
+		if err = t.storage.Apply(b); err == nil {
+			return nil
+		}
+	} else if b.Len() == 0 {
+		return err
+	}
+	if rerr := t.reload(); rerr != nil {
+		log.Errorf("Failed to reload the route table: %v", rerr)
+	}
+	return err
+}
+
+// reload replaces the records in memory by those of storage, t.mx must be
+// held.
+func (t *Table) reload() error {
+	t.providers = make(map[string]map[string]peer.AddrInfo)
+	t.peers = make(map[peer.ID]peer.AddrInfo)
+	t.fingerprints = make(map[string]peer.ID)
+	t.byPeer = make(map[peer.ID][]string)
+	t.leases = make(map[peer.ID]lease)
+	t.records = make(map[string][]byte)
+	t.owners = make(map[string]owner)
+	t.approvals = make(map[string]peer.ID)
+	t.tombstones = make(map[peer.ID]Tombstone)
+	return t.load()
+}
+
+// parseAddrInfo parses addrs string to peer.AddrInfo
 // addrs format: addr,addr
-func parseAddrInfoHack(id peer.ID, addrs string) (peer.AddrInfo, error) {
+func parseAddrInfo(id peer.ID, addrs string) (peer.AddrInfo, error) {
 	var remoteAddresses []ma.Multiaddr
 	array := strings.Split(addrs, ",")
 	for _, addr := range array {
@@ -52,48 +233,95 @@ func (t *Table) Find(id peer.ID) (peer.AddrInfo, error) {
 	defer t.mx.Unlock()
 	pi, ok := t.peers[id]
 	if !ok {
-		return peer.AddrInfo{}, fmt.Errorf("route: not found")
+		return peer.AddrInfo{}, ErrNotFound
 	}
 	return pi, nil
 }
 
-func (t *Table) Provide(cid string, id peer.ID, addrs, fingerprint string) error {
+// Provide registers peer pi under cid and renews its lease for ttl; zero
+// ttl is DefaultLeaseTTL. A fingerprint is bound to pi.ID only with proof,
+// a FingerprintRecord envelope signed by it. The records of the
+// registration are written in one transaction.
+func (t *Table) Provide(cid string, pi peer.AddrInfo, fingerprint string, proof []byte, ttl time.Duration) error {
 	t.mx.Lock()
 	defer t.mx.Unlock()
-	pmap, ok := t.providers[cid]
-	if !ok {
-		pmap = make(map[string]peer.AddrInfo)
-		t.providers[cid] = pmap
+
+	old, known := t.peers[pi.ID]
+	oldFingerprint := t.fingerprintOf(pi.ID)
+	t.begin()
+	if err := t.commit(t.provide(cid, pi, fingerprint, proof, ttl)); err != nil {
+		return err
 	}
 
-	pi, err := parseAddrInfoHack(id, addrs)
-	if err != nil {
+	switch {
+	case !known:
+		t.publish(EventRegister, pi, fingerprint)
+	case !sameAddrs(old, pi) || fingerprint != oldFingerprint:
+		t.publish(EventUpdate, pi, fingerprint)
+	}
+	return nil
+}
+
+// provide makes the changes of Provide, t.mx must be held.
+func (t *Table) provide(cid string, pi peer.AddrInfo, fingerprint string, proof []byte, ttl time.Duration) error {
+	id := pi.ID
+	if tb, ok := t.tombstones[id]; ok && t.now().Before(tb.Until) {
+		return fmt.Errorf("peer %s: %w", id, ErrKicked)
+	}
+	// The server registers itself without fingerprint.
+	if fingerprint != "" {
+		if err := t.bind(fingerprint, id, proof); err != nil {
+			return err
+		}
+	}
+
+	if err := t.unbury(id); err != nil {
 		return err
 	}
+
 	// If we use peer.ID as map key, json.Marshal can not encode properly,
 	// so we save it as string.
 	idStr := id.String()
-	pmap[idStr] = pi
-
-	t.fingerprints[fingerprint] = id
-
-	if t.peers == nil {
-		t.peers = make(map[peer.ID]peer.AddrInfo)
+	now := t.now()
+	l := lease{LastSeen: now, Expires: now.Add(clampTTL(ttl))}
+	if err := t.put(bucketLeases, idStr, l); err != nil {
+		return err
 	}
+	t.leases[id] = l
+	if err := t.put(bucketProviders, cid+"/"+idStr, pi); err != nil {
+		return err
+	}
+	if err := t.put(bucketPeers, idStr, pi); err != nil {
+		return err
+	}
+	pmap, ok := t.providers[cid]
+	if !ok {
+		pmap = make(map[string]peer.AddrInfo)
+		t.providers[cid] = pmap
+	}
+	pmap[idStr] = pi
 	t.peers[id] = pi
-
 	return nil
 }
 
 func (t *Table) FindProvider(provider string) (map[string]peer.AddrInfo, error) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
 	pmap, ok := t.providers[provider]
 	if !ok {
 		return nil, fmt.Errorf("provider not found")
 	}
-	return pmap, nil
+	// Callers encode the result after the lock is released.
+	providers := make(map[string]peer.AddrInfo, len(pmap))
+	for k, v := range pmap {
+		providers[k] = v
+	}
+	return providers, nil
 }
 
 func (t *Table) FindPeerID(fingerprint string) peer.ID {
+	t.mx.Lock()
+	defer t.mx.Unlock()
 	id, ok := t.fingerprints[fingerprint]
 	if !ok {
 		return ""
@@ -101,20 +329,22 @@ func (t *Table) FindPeerID(fingerprint string) peer.ID {
 	return id
 }
 
-func (t *Table) Delete(fingerprint string) error {
+// Delete unbinds fingerprint and removes its peer, proof is a record of
+// the owner newer than the last one.
+func (t *Table) Delete(fingerprint string, proof []byte) error {
+	t.mx.Lock()
+	defer t.mx.Unlock()
 	id, ok := t.fingerprints[fingerprint]
-	if ok {
-		delete(t.fingerprints, fingerprint)
-		delete(t.peers, id)
-	} else {
-		return fmt.Errorf("fail to delete")
+	if !ok {
+		return fmt.Errorf("fingerprint %s: %w", fingerprint, ErrNotFound)
 	}
-
-	cid := utils.StrToCid(constant.PeerRendezvous)
-	peerMap, ok := t.providers[cid.String()]
-	if ok {
-		delete(peerMap, id.String())
-		return nil
+	if err := t.checkUnbind(fingerprint, id, proof); err != nil {
+		return err
 	}
-	return fmt.Errorf("fail to delete")
+	pi := t.peers[id]
+	if err := t.bury(id, EventLogout); err != nil {
+		return err
+	}
+	t.publish(EventLogout, pi, fingerprint)
+	return nil
 }
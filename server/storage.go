@@ -0,0 +1,244 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Buckets of the records a Table stores.
+const (
+	bucketProviders    = "providers"
+	bucketPeers        = "peers"
+	bucketFingerprints = "fingerprints"
+	bucketLeases       = "leases"
+	bucketOwners       = "owners"
+	bucketApprovals    = "approvals"
+	bucketTombstones   = "tombstones"
+)
+
+// buckets lists every bucket, backups cover exactly these.
+var buckets = []string{
+	bucketProviders,
+	bucketPeers,
+	bucketFingerprints,
+	bucketLeases,
+	bucketOwners,
+	bucketApprovals,
+	bucketTombstones,
+}
+
+// Storage persists the records of a Table as keys and values in buckets.
+type Storage interface {
+	// Put stores value at key of bucket, replacing any old value.
+	Put(bucket, key string, value []byte) error
+	// Delete removes key from bucket, missing keys are not an error.
+	Delete(bucket, key string) error
+	// ForEach calls fn for every key of bucket until it returns an error.
+	ForEach(bucket string, fn func(key string, value []byte) error) error
+	// Clear removes every key of bucket.
+	Clear(bucket string) error
+	// Apply makes the changes of b in order, all of them or none.
+	Apply(b *Batch) error
+	Close() error
+}
+
+// Batch is a list of changes Storage.Apply makes at once.
+type Batch struct {
+	ops []batchOp
+}
+
+type batchOpKind int
+
+const (
+	opPut batchOpKind = iota
+	opDelete
+	opClear
+)
+
+type batchOp struct {
+	kind   batchOpKind
+	bucket string
+	key    string
+	value  []byte
+}
+
+// Put stores value at key of bucket, replacing any old value.
+func (b *Batch) Put(bucket, key string, value []byte) {
+	b.ops = append(b.ops, batchOp{kind: opPut, bucket: bucket, key: key, value: value})
+}
+
+// Delete removes key from bucket.
+func (b *Batch) Delete(bucket, key string) {
+	b.ops = append(b.ops, batchOp{kind: opDelete, bucket: bucket, key: key})
+}
+
+// Clear removes every key of bucket.
+func (b *Batch) Clear(bucket string) {
+	b.ops = append(b.ops, batchOp{kind: opClear, bucket: bucket})
+}
+
+// Len returns the number of changes of b.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// MemoryStorage keeps records in memory, they are lost on restart.
+type MemoryStorage struct {
+	mx      sync.Mutex
+	buckets map[string]map[string][]byte
+}
+
+// NewMemoryStorage creates an empty MemoryStorage.
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{buckets: make(map[string]map[string][]byte)}
+}
+
+func (s *MemoryStorage) Put(bucket, key string, value []byte) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.put(bucket, key, value)
+	return nil
+}
+
+func (s *MemoryStorage) put(bucket, key string, value []byte) {
+	b, ok := s.buckets[bucket]
+	if !ok {
+		b = make(map[string][]byte)
+		s.buckets[bucket] = b
+	}
+	b[key] = append([]byte(nil), value...)
+}
+
+func (s *MemoryStorage) Delete(bucket, key string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	delete(s.buckets[bucket], key)
+	return nil
+}
+
+func (s *MemoryStorage) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	s.mx.Lock()
+	b := s.buckets[bucket]
+	keys := make([]string, 0, len(b))
+	for k := range b {
+		keys = append(keys, k)
+	}
+	values := make([][]byte, len(keys))
+	sort.Strings(keys)
+	for i, k := range keys {
+		values[i] = b[k]
+	}
+	s.mx.Unlock()
+
+	for i, k := range keys {
+		if err := fn(k, values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) Clear(bucket string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	delete(s.buckets, bucket)
+	return nil
+}
+
+func (s *MemoryStorage) Apply(b *Batch) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	for _, op := range b.ops {
+		switch op.kind {
+		case opPut:
+			s.put(op.bucket, op.key, op.value)
+		case opDelete:
+			delete(s.buckets[op.bucket], op.key)
+		case opClear:
+			delete(s.buckets, op.bucket)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) Close() error {
+	return nil
+}
+
+// backup is the portable form of the records of a Storage.
+type backup struct {
+	Buckets map[string]map[string]json.RawMessage `json:"buckets"`
+}
+
+// Backup writes every record of s to w as JSON, it can be restored to any
+// kind of Storage. It covers the default network and the named networks.
+func Backup(s Storage, w io.Writer, networks ...string) error {
+	b := backup{Buckets: make(map[string]map[string]json.RawMessage)}
+	for _, bucket := range networkBuckets(networks) {
+		records := make(map[string]json.RawMessage)
+		err := s.ForEach(bucket, func(key string, value []byte) error {
+			records[key] = append(json.RawMessage(nil), value...)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		b.Buckets[bucket] = records
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(b)
+}
+
+// Restore replaces every record of s by the ones of a backup read from r,
+// in the default network and the named networks.
+func Restore(s Storage, r io.Reader, networks ...string) error {
+	var b backup
+	if err := json.NewDecoder(r).Decode(&b); err != nil {
+		return fmt.Errorf("invalid backup: %w", err)
+	}
+	all := networkBuckets(networks)
+	for bucket := range b.Buckets {
+		if !knownBucket(all, bucket) {
+			return fmt.Errorf("invalid backup: unknown bucket %q", bucket)
+		}
+	}
+
+	// The old records are only gone if the new ones are in.
+	var batch Batch
+	for _, bucket := range all {
+		batch.Clear(bucket)
+		for key, value := range b.Buckets[bucket] {
+			batch.Put(bucket, key, value)
+		}
+	}
+	return s.Apply(&batch)
+}
+
+// networkBuckets lists the buckets of the default network and of networks.
+func networkBuckets(networks []string) []string {
+	all := append([]string(nil), buckets...)
+	for _, n := range networks {
+		for _, bucket := range buckets {
+			all = append(all, networkBucketPrefix(n)+bucket)
+		}
+	}
+	return all
+}
+
+func knownBucket(all []string, bucket string) bool {
+	for _, b := range all {
+		if b == bucket {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltStorage keeps records in a bbolt database file, they survive
+// restarts.
+type BoltStorage struct {
+	db *bolt.DB
+}
+
+// OpenBoltStorage opens the database at path, creating it if missing.
+// Only one process may have it open.
+func OpenBoltStorage(path string) (*BoltStorage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		if errors.Is(err, bolt.ErrTimeout) {
+			return nil, fmt.Errorf("storage: %s is in use by another process", path)
+		}
+		return nil, fmt.Errorf("storage: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range buckets {
+			if _, err := tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("storage: %w", err)
+	}
+	return &BoltStorage{db: db}, nil
+}
+
+func (s *BoltStorage) Put(bucket, key string, value []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), value)
+	})
+}
+
+func (s *BoltStorage) Delete(bucket, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+func (s *BoltStorage) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		// Values are only valid in the transaction, fn gets copies.
+		return b.ForEach(func(k, v []byte) error {
+			return fn(string(k), append([]byte(nil), v...))
+		})
+	})
+}
+
+func (s *BoltStorage) Clear(bucket string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(bucket)) != nil {
+			if err := tx.DeleteBucket([]byte(bucket)); err != nil {
+				return err
+			}
+		}
+		_, err := tx.CreateBucket([]byte(bucket))
+		return err
+	})
+}
+
+func (s *BoltStorage) Apply(batch *Batch) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, op := range batch.ops {
+			name := []byte(op.bucket)
+			switch op.kind {
+			case opPut:
+				b, err := tx.CreateBucketIfNotExists(name)
+				if err != nil {
+					return err
+				}
+				if err := b.Put([]byte(op.key), op.value); err != nil {
+					return err
+				}
+			case opDelete:
+				if b := tx.Bucket(name); b != nil {
+					if err := b.Delete([]byte(op.key)); err != nil {
+						return err
+					}
+				}
+			case opClear:
+				if tx.Bucket(name) != nil {
+					if err := tx.DeleteBucket(name); err != nil {
+						return err
+					}
+				}
+				if _, err := tx.CreateBucket(name); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStorage) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+	"github.com/lp2p/p2pvpn/common/utils"
+	"github.com/lp2p/p2pvpn/constant"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestPeer(t *testing.T) (peer.ID, crypto.PrivKey) {
+	priv, _, err := test.RandTestKeyPair(crypto.Ed25519, 256)
+	require.NoError(t, err)
+	id, err := peer.IDFromPrivateKey(priv)
+	require.NoError(t, err)
+	return id, priv
+}
+
+func testInfo(t *testing.T, id peer.ID, addrs ...string) peer.AddrInfo {
+	pi := peer.AddrInfo{ID: id}
+	for _, s := range addrs {
+		addr, err := ma.NewMultiaddr(s)
+		require.NoError(t, err)
+		pi.Addrs = append(pi.Addrs, addr)
+	}
+	return pi
+}
+
+func seal(t *testing.T, fingerprint string, priv crypto.PrivKey) []byte {
+	record, err := SealFingerprint(fingerprint, priv)
+	require.NoError(t, err)
+	return record
+}
+
+func TestTablePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.db")
+	cid := utils.StrToCid(constant.PeerRendezvous).String()
+	id, priv := newTestPeer(t)
+
+	storage, err := OpenBoltStorage(path)
+	require.NoError(t, err)
+	tab, err := NewTable(storage)
+	require.NoError(t, err)
+	require.NoError(t, tab.Provide(cid, testInfo(t, id, "/ip4/1.2.3.4/tcp/4001"), "laptop", seal(t, "laptop", priv), 0))
+	require.NoError(t, tab.Close())
+
+	storage, err = OpenBoltStorage(path)
+	require.NoError(t, err)
+	tab, err = NewTable(storage)
+	require.NoError(t, err)
+	assert.Equal(t, id, tab.FindPeerID("laptop"))
+	pi, err := tab.Find(id)
+	require.NoError(t, err)
+	assert.Equal(t, "/ip4/1.2.3.4/tcp/4001", pi.Addrs[0].String())
+	providers, err := tab.FindProvider(cid)
+	require.NoError(t, err)
+	assert.Contains(t, providers, id.String())
+
+	// Deletes are persisted too.
+	require.NoError(t, tab.Delete("laptop", seal(t, "laptop", priv)))
+	require.NoError(t, tab.Close())
+	storage, err = OpenBoltStorage(path)
+	require.NoError(t, err)
+	tab, err = NewTable(storage)
+	require.NoError(t, err)
+	assert.Equal(t, "", tab.FindPeerID("laptop").String())
+	require.NoError(t, tab.Close())
+}
+
+func TestBackupRestore(t *testing.T) {
+	id, priv := newTestPeer(t)
+
+	src, err := NewTable(NewMemoryStorage())
+	require.NoError(t, err)
+	require.NoError(t, src.Provide("cid", testInfo(t, id), "laptop", seal(t, "laptop", priv), 0))
+
+	var buf bytes.Buffer
+	require.NoError(t, Backup(src.storage, &buf))
+
+	dst, err := OpenBoltStorage(filepath.Join(t.TempDir(), "routes.db"))
+	require.NoError(t, err)
+	defer dst.Close()
+	require.NoError(t, dst.Put(bucketFingerprints, "stale", []byte(`"x"`)))
+	require.NoError(t, Restore(dst, &buf))
+
+	tab, err := NewTable(dst)
+	require.NoError(t, err)
+	assert.Equal(t, id, tab.FindPeerID("laptop"))
+	assert.NotNil(t, tab.Record("laptop"))
+	assert.Equal(t, "", tab.FindPeerID("stale").String())
+
+	assert.Error(t, Restore(dst, bytes.NewBufferString(`{"buckets":{"nope":{}}}`)))
+}
+
+// failingStorage fails to apply batches.
+type failingStorage struct {
+	*MemoryStorage
+}
+
+func (s failingStorage) Apply(*Batch) error {
+	return errors.New("disk full")
+}
+
+func TestRestoreFails(t *testing.T) {
+	s := failingStorage{NewMemoryStorage()}
+	require.NoError(t, s.Put(bucketFingerprints, "kept", []byte(`"x"`)))
+
+	backup := `{"buckets":{"fingerprints":{"new":"y"}}}`
+	assert.Error(t, Restore(s, bytes.NewBufferString(backup)))
+	var keys []string
+	require.NoError(t, s.ForEach(bucketFingerprints, func(key string, _ []byte) error {
+		keys = append(keys, key)
+		return nil
+	}))
+	assert.Equal(t, []string{"kept"}, keys)
+}
+
+func TestProvideFails(t *testing.T) {
+	id, priv := newTestPeer(t)
+	other, otherPriv := newTestPeer(t)
+	storage := NewMemoryStorage()
+	tab, err := NewTable(storage)
+	require.NoError(t, err)
+	require.NoError(t, tab.Provide("cid", testInfo(t, id), "laptop", seal(t, "laptop", priv), 0))
+
+	// Nothing of a registration that failed to be written is kept.
+	tab.storage = failingStorage{storage}
+	events, cancel := tab.Subscribe(1)
+	defer cancel()
+	assert.Error(t, tab.Provide("cid", testInfo(t, other), "desktop", seal(t, "desktop", otherPriv), 0))
+	assert.Equal(t, "", tab.FindPeerID("desktop").String())
+	_, err = tab.Find(other)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Equal(t, id, tab.FindPeerID("laptop"))
+	assert.Empty(t, events)
+
+	tab.storage = storage
+	require.NoError(t, tab.Provide("cid", testInfo(t, other), "desktop", seal(t, "desktop", otherPriv), 0))
+	assert.Equal(t, other, tab.FindPeerID("desktop"))
+}
+
+func TestLeaseExpire(t *testing.T) {
+	id, priv := newTestPeer(t)
+	cid := utils.StrToCid(constant.PeerRendezvous).String()
+
+	tab := NewRouteTable()
+	now := time.Now()
+	tab.now = func() time.Time { return now }
+	require.NoError(t, tab.Provide(cid, testInfo(t, id), "laptop", seal(t, "laptop", priv), time.Minute))
+
+	lastSeen, ok := tab.LastSeen(id)
+	assert.True(t, ok)
+	assert.Equal(t, now, lastSeen)
+
+	expired, err := tab.Expire(now.Add(30 * time.Second))
+	require.NoError(t, err)
+	assert.Empty(t, expired)
+
+	// A renewal moves the expiry.
+	now = now.Add(50 * time.Second)
+	require.NoError(t, tab.Provide(cid, testInfo(t, id), "laptop", seal(t, "laptop", priv), time.Minute))
+	expired, err = tab.Expire(now.Add(30 * time.Second))
+	require.NoError(t, err)
+	assert.Empty(t, expired)
+
+	expired, err = tab.Expire(now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, []peer.ID{id}, expired)
+	assert.Equal(t, "", tab.FindPeerID("laptop").String())
+	_, err = tab.Find(id)
+	assert.Error(t, err)
+	providers, err := tab.FindProvider(cid)
+	require.NoError(t, err)
+	assert.Empty(t, providers)
+}
@@ -0,0 +1,291 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/lp2p/p2pvpn/constant"
+	"github.com/lp2p/p2pvpn/log"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// Error codes of the v2 API.
+const (
+	CodeBadRequest       = "bad_request"
+	CodeUnauthorized     = "unauthorized"
+	CodeNotFound         = "not_found"
+	CodeInvalidRecord    = "invalid_record"
+	CodeStaleRecord      = "stale_record"
+	CodeFingerprintOwned = "fingerprint_owned"
+	CodeKicked           = "kicked"
+	CodeInternal         = "internal"
+)
+
+// codeErrors are the errors of the table behind the codes, so clients can
+// match an APIError with errors.Is.
+var codeErrors = map[string]error{
+	CodeNotFound:         ErrNotFound,
+	CodeInvalidRecord:    ErrInvalidRecord,
+	CodeStaleRecord:      ErrStaleRecord,
+	CodeFingerprintOwned: ErrFingerprintOwned,
+	CodeKicked:           ErrKicked,
+}
+
+// codeStatus are the HTTP statuses of the codes.
+var codeStatus = map[string]int{
+	CodeBadRequest:       http.StatusBadRequest,
+	CodeUnauthorized:     http.StatusUnauthorized,
+	CodeNotFound:         http.StatusNotFound,
+	CodeInvalidRecord:    http.StatusBadRequest,
+	CodeStaleRecord:      http.StatusConflict,
+	CodeFingerprintOwned: http.StatusConflict,
+	CodeKicked:           http.StatusForbidden,
+	CodeInternal:         http.StatusInternalServerError,
+}
+
+// APIError is an error of the v2 API.
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Is reports whether target is the error of the table behind e.Code.
+func (e *APIError) Is(target error) bool {
+	return codeErrors[e.Code] == target
+}
+
+// ErrorResponse is the body of the v2 API errors.
+type ErrorResponse struct {
+	Error *APIError `json:"error"`
+}
+
+// RegisterRequest registers a peer under a provider, see Table.Provide.
+type RegisterRequest struct {
+	PeerID      peer.ID  `json:"peer_id"`
+	Addrs       []string `json:"addrs"`
+	Fingerprint string   `json:"fingerprint,omitempty"`
+	// Record is the envelope signed by PeerID claiming Fingerprint.
+	Record []byte `json:"record,omitempty"`
+	// TTL is the lease in seconds, zero is the server default.
+	TTL int `json:"ttl,omitempty"`
+}
+
+// RegisterResponse tells the lease granted.
+type RegisterResponse struct {
+	Peer    peer.AddrInfo `json:"peer"`
+	Expires time.Time     `json:"expires"`
+	// Observed is the IP the server sees the peer at, like /ip4/1.2.3.4.
+	Observed string `json:"observed,omitempty"`
+}
+
+// UnregisterRequest removes a fingerprint and its peer.
+type UnregisterRequest struct {
+	// Record is a fresh record of the owner, see Table.Delete.
+	Record []byte `json:"record"`
+}
+
+// PeerResponse is a registered peer.
+type PeerResponse struct {
+	Peer     peer.AddrInfo `json:"peer"`
+	LastSeen *time.Time    `json:"last_seen,omitempty"`
+}
+
+// ProvidersResponse lists the peers of a provider.
+type ProvidersResponse struct {
+	Peers []PeerResponse `json:"peers"`
+}
+
+// FingerprintResponse is the peer a fingerprint is bound to.
+type FingerprintResponse struct {
+	PeerID   peer.ID    `json:"peer_id"`
+	Record   []byte     `json:"record,omitempty"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+// ServerIDResponse is the peer ID of the server host.
+type ServerIDResponse struct {
+	PeerID peer.ID `json:"peer_id"`
+}
+
+// registerV2Handler registers the v2 API handlers to router.
+func (a *APIService) registerV2Handler() {
+	v2 := a.router.Group("/", a.authV2())
+	v2.GET(constant.V2PeersUrl+":id", a.getPeerV2)
+	v2.POST(constant.V2ProvidersUrl+":cid", a.registerV2)
+	v2.GET(constant.V2ProvidersUrl+":cid", a.getProvidersV2)
+	v2.GET(constant.V2FingerprintsUrl+":fingerprint", a.getFingerprintV2)
+	v2.DELETE(constant.V2FingerprintsUrl+":fingerprint", a.unregisterV2)
+	v2.GET(constant.V2ServerIDUrl, a.getServerIDV2)
+	v2.GET(constant.V2WatchUrl, a.Watch)
+}
+
+// authV2 is Auth answering with a v2 error.
+func (a *APIService) authV2() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		n, id, err := a.verify(c)
+		if err != nil {
+			log.Debugf("Refused request from %s: %v", c.ClientIP(), err)
+			abortV2(c, CodeUnauthorized, err)
+			return
+		}
+		c.Set(credentialKey, id)
+		c.Set(networkKey, n)
+		c.Next()
+	}
+}
+
+// abortV2 responds with the error of code.
+func abortV2(c *gin.Context, code string, err error) {
+	c.AbortWithStatusJSON(codeStatus[code], ErrorResponse{
+		Error: &APIError{Code: code, Message: err.Error()},
+	})
+}
+
+// failV2 responds with the code of an error of the table.
+func failV2(c *gin.Context, err error) {
+	for code, target := range codeErrors {
+		if errors.Is(err, target) {
+			abortV2(c, code, err)
+			return
+		}
+	}
+	log.Errorf("API %s %s failed: %v", c.Request.Method, c.Request.URL.Path, err)
+	abortV2(c, CodeInternal, err)
+}
+
+func (a *APIService) getPeerV2(c *gin.Context) {
+	id, err := peer.Decode(c.Param("id"))
+	if err != nil {
+		abortV2(c, CodeBadRequest, err)
+		return
+	}
+	tab := a.peerTable(c, id)
+	pi, err := tab.Find(id)
+	if err != nil {
+		failV2(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, PeerResponse{
+		Peer:     pi,
+		LastSeen: lastSeen(tab, id),
+	})
+}
+
+func (a *APIService) registerV2(c *gin.Context) {
+	var req RegisterRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortV2(c, CodeBadRequest, err)
+		return
+	}
+	if req.PeerID == "" {
+		abortV2(c, CodeBadRequest, errors.New("no peer_id"))
+		return
+	}
+	if req.TTL < 0 {
+		abortV2(c, CodeBadRequest, errors.New("negative ttl"))
+		return
+	}
+
+	observed, err := a.observedIP(c)
+	if err != nil {
+		failV2(c, err)
+		return
+	}
+	var addrs []ma.Multiaddr
+	for _, s := range req.Addrs {
+		addr, err := ma.NewMultiaddr(s)
+		if err != nil {
+			abortV2(c, CodeBadRequest, fmt.Errorf("addr %q: %w", s, err))
+			return
+		}
+		addrs = append(addrs, addr)
+	}
+	pi := peer.AddrInfo{ID: req.PeerID, Addrs: observedAddrs(addrs, observed)}
+
+	ttl := time.Duration(req.TTL) * time.Second
+	err = a.table(c).Provide(c.Param("cid"), pi, req.Fingerprint, req.Record, ttl)
+	if errors.Is(err, ErrFingerprintOwned) {
+		log.Warnf("Refused rebind of fingerprint %s to %s, pending admin approval", req.Fingerprint, pi.ID)
+	}
+	if err != nil {
+		failV2(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, RegisterResponse{
+		Peer:     pi,
+		Expires:  time.Now().Add(clampTTL(ttl)),
+		Observed: observedMultiaddr(observed),
+	})
+}
+
+func (a *APIService) getProvidersV2(c *gin.Context) {
+	cid := c.Param("cid")
+	tab := a.providerTable(c, cid)
+	pmap, err := tab.FindProvider(cid)
+	if err != nil {
+		// An empty provider is no error.
+		pmap = nil
+	}
+	peers := make([]PeerResponse, 0, len(pmap))
+	for _, pi := range pmap {
+		peers = append(peers, PeerResponse{
+			Peer:     pi,
+			LastSeen: lastSeen(tab, pi.ID),
+		})
+	}
+	c.JSON(http.StatusOK, ProvidersResponse{
+		Peers: peers,
+	})
+}
+
+func (a *APIService) getFingerprintV2(c *gin.Context) {
+	fingerprint := c.Param("fingerprint")
+	tab := a.table(c)
+	id := tab.FindPeerID(fingerprint)
+	if id == "" {
+		failV2(c, fmt.Errorf("fingerprint %s: %w", fingerprint, ErrNotFound))
+		return
+	}
+	c.JSON(http.StatusOK, FingerprintResponse{
+		PeerID:   id,
+		Record:   tab.Record(fingerprint),
+		LastSeen: lastSeen(tab, id),
+	})
+}
+
+func (a *APIService) unregisterV2(c *gin.Context) {
+	var req UnregisterRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortV2(c, CodeBadRequest, err)
+		return
+	}
+	fingerprint := c.Param("fingerprint")
+	tab := a.table(c)
+	if tab.FindPeerID(fingerprint) == "" {
+		failV2(c, fmt.Errorf("fingerprint %s: %w", fingerprint, ErrNotFound))
+		return
+	}
+	if err := tab.Delete(fingerprint, req.Record); err != nil {
+		failV2(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (a *APIService) getServerIDV2(c *gin.Context) {
+	if a.serverID == "" {
+		failV2(c, fmt.Errorf("server id: %w", ErrNotFound))
+		return
+	}
+	c.JSON(http.StatusOK, ServerIDResponse{
+		PeerID: a.serverID,
+	})
+}
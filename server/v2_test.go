@@ -0,0 +1,97 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lp2p/p2pvpn/common/auth"
+	"github.com/lp2p/p2pvpn/constant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestV2(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	a := NewAPIService(gin.New(), NewRouteTable(), "", "secret")
+	serverID, _ := newTestPeer(t)
+	a.SetServerID(serverID)
+	a.RegisterHandler()
+
+	call := func(method, path string, body, v interface{}) int {
+		var data []byte
+		if body != nil {
+			var err error
+			data, err = json.Marshal(body)
+			require.NoError(t, err)
+		}
+		req := httptest.NewRequest(method, path, bytes.NewReader(data))
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("Content-Type", "application/json")
+		require.NoError(t, auth.Sign(req, auth.Credential{Secret: "secret"}))
+		w := httptest.NewRecorder()
+		a.router.ServeHTTP(w, req)
+		if v != nil {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), v))
+		}
+		return w.Code
+	}
+
+	alice, alicePriv := newTestPeer(t)
+	mallory, malloryPriv := newTestPeer(t)
+	register := func(req RegisterRequest) (int, *APIError) {
+		var resp ErrorResponse
+		code := call(http.MethodPost, constant.V2ProvidersUrl+"cid", req, &resp)
+		return code, resp.Error
+	}
+
+	code, _ := register(RegisterRequest{
+		PeerID:      alice,
+		Addrs:       []string{"/ip4/127.0.0.1/tcp/4001"},
+		Fingerprint: "laptop",
+		Record:      seal(t, "laptop", alicePriv),
+	})
+	assert.Equal(t, http.StatusOK, code)
+
+	code, apiErr := register(RegisterRequest{
+		PeerID:      mallory,
+		Fingerprint: "laptop",
+		Record:      seal(t, "laptop", malloryPriv),
+	})
+	assert.Equal(t, http.StatusConflict, code)
+	assert.Equal(t, CodeFingerprintOwned, apiErr.Code)
+	assert.True(t, errors.Is(apiErr, ErrFingerprintOwned))
+
+	code, apiErr = register(RegisterRequest{PeerID: alice, Addrs: []string{"nope"}})
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, CodeBadRequest, apiErr.Code)
+
+	var fp FingerprintResponse
+	assert.Equal(t, http.StatusOK, call(http.MethodGet, constant.V2FingerprintsUrl+"laptop", nil, &fp))
+	assert.Equal(t, alice, fp.PeerID)
+	assert.NotEmpty(t, fp.Record)
+
+	var peerResp PeerResponse
+	assert.Equal(t, http.StatusOK, call(http.MethodGet, constant.V2PeersUrl+alice.String(), nil, &peerResp))
+	assert.Equal(t, "/ip4/192.0.2.1/tcp/4001", peerResp.Peer.Addrs[0].String())
+
+	var errResp ErrorResponse
+	assert.Equal(t, http.StatusNotFound, call(http.MethodGet, constant.V2FingerprintsUrl+"nobody", nil, &errResp))
+	assert.Equal(t, CodeNotFound, errResp.Error.Code)
+
+	// v1 stays served, also under its prefix.
+	var idResp IDResp
+	assert.Equal(t, http.StatusOK, call(http.MethodGet, constant.V1Url+constant.FingerprintsUrl+"laptop", nil, &idResp))
+	assert.Equal(t, alice, idResp.PeerID)
+
+	assert.Equal(t, http.StatusNoContent, call(http.MethodDelete, constant.V2FingerprintsUrl+"laptop",
+		UnregisterRequest{Record: seal(t, "laptop", alicePriv)}, nil))
+
+	var idV2 ServerIDResponse
+	assert.Equal(t, http.StatusOK, call(http.MethodGet, constant.V2ServerIDUrl, nil, &idV2))
+	assert.Equal(t, serverID, idV2.PeerID)
+}
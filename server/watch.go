@@ -0,0 +1,51 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// watchBuffer is how many events a watcher may fall behind.
+	watchBuffer = 64
+
+	// WatchKeepAlive is how often an idle watch stream sends a comment, so
+	// both ends notice a dead connection.
+	WatchKeepAlive = 15 * time.Second
+)
+
+// Watch streams the events of the route table as server-sent events, the
+// event name is the Event.Type and the data its JSON encoding.
+func (a *APIService) Watch(c *gin.Context) {
+	events, cancel := a.table(c).Subscribe(watchBuffer)
+	defer cancel()
+
+	ticker := time.NewTicker(WatchKeepAlive)
+	defer ticker.Stop()
+
+	// Send the headers now, clients wait for them before reading events.
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	ctx := c.Request.Context()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return false
+			}
+			c.SSEvent(string(e.Type), e)
+			return true
+		case <-ticker.C:
+			_, err := io.WriteString(w, ": keep-alive\n\n")
+			return err == nil
+		case <-ctx.Done():
+			return false
+		}
+	})
+}
@@ -0,0 +1,568 @@
+package stack
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// maxRcvBuf is bounded by the 16-bit window field, we don't negotiate
+	// window scaling.
+	maxRcvBuf = 1<<16 - 1
+	maxSndBuf = 256 * 1024
+
+	defaultMSS    = 536
+	initialRTO    = 200 * time.Millisecond
+	maxRTO        = 10 * time.Second
+	maxRetries    = 8
+	maxOutOfOrder = 64
+	lingerTimeout = time.Minute
+)
+
+var (
+	errReset   = errors.New("connection reset by peer")
+	errTimeout = errors.New("connection timed out")
+	errLinger  = errors.New("connection linger timeout")
+)
+
+type state int
+
+const (
+	stateSynReceived state = iota
+	stateEstablished
+	stateClosed
+)
+
+// endpoint is the stack side of a TCP connection, it implements net.Conn.
+type endpoint struct {
+	s          *Stack
+	id         tuple
+	localAddr  *net.TCPAddr
+	remoteAddr *net.TCPAddr
+
+	mx     sync.Mutex
+	cond   *sync.Cond
+	state  state
+	err    error
+	closed bool
+
+	// Send sequence space, sndBuf holds the data from sndUna onwards.
+	iss     uint32
+	sndUna  uint32
+	sndNxt  uint32
+	sndMax  uint32
+	sndWnd  uint32
+	sndBuf  []byte
+	finSeq  uint32
+	mss     int
+	rto     time.Duration
+	retries int
+	timer   *time.Timer
+	armed   bool
+	linger  *time.Timer
+
+	// Receive sequence space, ooo holds the segments received ahead of
+	// rcvNxt sorted by sequence number.
+	rcvNxt  uint32
+	rcvWnd  uint32
+	rcvBuf  []byte
+	finRcvd bool
+	ooo     []oooSegment
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	rdTimer       *time.Timer
+	wdTimer       *time.Timer
+}
+
+func newEndpoint(s *Stack, id tuple, syn *segment) *endpoint {
+	ep := &endpoint{
+		s:          s,
+		id:         id,
+		localAddr:  &net.TCPAddr{IP: syn.dst, Port: int(syn.dstPort)},
+		remoteAddr: &net.TCPAddr{IP: syn.src, Port: int(syn.srcPort)},
+		state:      stateSynReceived,
+		iss:        randomISS(),
+		sndWnd:     uint32(syn.window),
+		rcvNxt:     syn.seq + 1,
+		rto:        initialRTO,
+	}
+	ep.cond = sync.NewCond(&ep.mx)
+	ep.sndUna = ep.iss
+	ep.sndNxt = ep.iss + 1
+	ep.sndMax = ep.sndNxt
+
+	hdrLen := ipv4HeaderLen + tcpHeaderLen
+	if syn.dst.To4() == nil {
+		hdrLen = ipv6HeaderLen + tcpHeaderLen
+	}
+	ep.mss = s.mtu - hdrLen
+	peerMSS := int(syn.mss)
+	if peerMSS == 0 {
+		peerMSS = defaultMSS
+	}
+	if peerMSS < ep.mss {
+		ep.mss = peerMSS
+	}
+	return ep
+}
+
+func (ep *endpoint) input(seg *segment) {
+	ep.mx.Lock()
+	defer ep.mx.Unlock()
+
+	if ep.state == stateClosed {
+		return
+	}
+	if seg.flags&flagRST != 0 {
+		ep.abortLocked(errReset, false)
+		return
+	}
+	if seg.flags&flagSYN != 0 {
+		// Our SYN-ACK may have been lost, answer the retransmitted SYN again.
+		if ep.state == stateSynReceived && seg.seq+1 == ep.rcvNxt {
+			ep.sendSynAck()
+			ep.armTimer()
+		}
+		return
+	}
+	if seg.flags&flagACK == 0 {
+		return
+	}
+
+	if ep.state == stateSynReceived {
+		if seg.ack != ep.iss+1 {
+			ep.s.reset(seg)
+			return
+		}
+		ep.state = stateEstablished
+		go ep.s.handler(ep)
+	}
+
+	ep.processAck(seg)
+	if len(seg.payload) > 0 || seg.flags&flagFIN != 0 {
+		ep.receive(seg)
+	}
+	ep.output(false)
+	ep.checkDone()
+}
+
+func (ep *endpoint) processAck(seg *segment) {
+	if seqGT(seg.ack, ep.sndUna) && seqLEQ(seg.ack, ep.sndMax) {
+		acked := int(seg.ack - ep.sndUna)
+		if acked > len(ep.sndBuf) {
+			// The SYN or FIN was acknowledged.
+			acked = len(ep.sndBuf)
+		}
+		ep.sndBuf = ep.sndBuf[acked:]
+		ep.sndUna = seg.ack
+		if seqLT(ep.sndNxt, ep.sndUna) {
+			ep.sndNxt = ep.sndUna
+		}
+		ep.rto = initialRTO
+		ep.stopTimer()
+		ep.cond.Broadcast()
+	}
+	if seqGEQ(seg.ack, ep.sndUna) {
+		ep.sndWnd = uint32(seg.window)
+		ep.retries = 0
+	}
+}
+
+// oooSegment is a segment received ahead of rcvNxt.
+type oooSegment struct {
+	seq     uint32
+	payload []byte
+	fin     bool
+}
+
+func (ep *endpoint) receive(seg *segment) {
+	seq, payload := seg.seq, seg.payload
+	fin := seg.flags&flagFIN != 0
+
+	if ep.finRcvd {
+		ep.sendAck()
+		return
+	}
+	if seqGT(seq, ep.rcvNxt) {
+		// Segments ahead of a lost one wait for it, our duplicate ack
+		// makes the peer retransmit only what is missing.
+		ep.enqueue(seq, payload, fin)
+		ep.sendAck()
+		return
+	}
+	if !ep.deliver(seq, payload, fin) {
+		ep.sendAck()
+		return
+	}
+	for len(ep.ooo) > 0 && !ep.finRcvd && seqLEQ(ep.ooo[0].seq, ep.rcvNxt) {
+		next := ep.ooo[0]
+		ep.ooo = ep.ooo[1:]
+		ep.deliver(next.seq, next.payload, next.fin)
+	}
+	if ep.finRcvd {
+		ep.ooo = nil
+	}
+	ep.cond.Broadcast()
+	ep.sendAck()
+}
+
+// deliver appends the part of payload from rcvNxt onwards to the receive
+// buffer, seq must not be after rcvNxt. It reports whether rcvNxt moved.
+func (ep *endpoint) deliver(seq uint32, payload []byte, fin bool) bool {
+	if off := ep.rcvNxt - seq; off > 0 {
+		if off > uint32(len(payload)) || off == uint32(len(payload)) && !fin {
+			return false
+		}
+		payload = payload[off:]
+	}
+
+	if free := maxRcvBuf - len(ep.rcvBuf); len(payload) > free {
+		payload, fin = payload[:free], false
+	}
+	// Data arriving after Close is acknowledged and discarded.
+	if !ep.closed {
+		ep.rcvBuf = append(ep.rcvBuf, payload...)
+	}
+	ep.rcvNxt += uint32(len(payload))
+	if fin {
+		ep.rcvNxt++
+		ep.finRcvd = true
+	}
+	return len(payload) > 0 || fin
+}
+
+// enqueue keeps a segment received ahead of rcvNxt until the gap is filled.
+// Segments beyond the receive window or past maxOutOfOrder are dropped. The
+// payload is copied, it points into the packet buffer of the stack.
+func (ep *endpoint) enqueue(seq uint32, payload []byte, fin bool) {
+	if len(payload) == 0 && !fin {
+		return
+	}
+	if seqGT(seq+uint32(len(payload)), ep.rcvNxt+ep.window()) {
+		return
+	}
+	i := 0
+	for i < len(ep.ooo) && seqLT(ep.ooo[i].seq, seq) {
+		i++
+	}
+	if i < len(ep.ooo) && ep.ooo[i].seq == seq {
+		if len(ep.ooo[i].payload) >= len(payload) && !fin {
+			return
+		}
+		ep.ooo[i] = oooSegment{seq: seq, payload: append([]byte(nil), payload...), fin: fin}
+		return
+	}
+	if len(ep.ooo) >= maxOutOfOrder {
+		return
+	}
+	ep.ooo = append(ep.ooo, oooSegment{})
+	copy(ep.ooo[i+1:], ep.ooo[i:])
+	ep.ooo[i] = oooSegment{seq: seq, payload: append([]byte(nil), payload...), fin: fin}
+}
+
+// output sends as much queued data as the peer's window allows, followed by
+// a FIN once Close was called and all data was sent. probe allows sending a
+// single byte into a zero window.
+func (ep *endpoint) output(probe bool) {
+	if ep.state != stateEstablished {
+		return
+	}
+
+	for {
+		off := int(ep.sndNxt - ep.sndUna)
+		if off >= len(ep.sndBuf) {
+			break
+		}
+		wnd := int(ep.sndWnd)
+		if wnd == 0 && probe {
+			wnd = 1
+		}
+		if off >= wnd {
+			break
+		}
+		n := len(ep.sndBuf) - off
+		if n > ep.mss {
+			n = ep.mss
+		}
+		if n > wnd-off {
+			n = wnd - off
+		}
+		ep.send(flagACK|flagPSH, ep.sndNxt, nil, ep.sndBuf[off:off+n])
+		ep.sndNxt += uint32(n)
+		probe = false
+	}
+
+	if ep.closed && ep.sndNxt == ep.finSeq {
+		ep.send(flagFIN|flagACK, ep.sndNxt, nil, nil)
+		ep.sndNxt++
+	}
+	if seqGT(ep.sndNxt, ep.sndMax) {
+		ep.sndMax = ep.sndNxt
+	}
+
+	unsent := int(ep.sndNxt-ep.sndUna) < len(ep.sndBuf)
+	if ep.sndNxt != ep.sndUna || unsent && ep.sndWnd == 0 {
+		ep.armTimer()
+	}
+}
+
+// checkDone releases the endpoint once both sides have closed.
+func (ep *endpoint) checkDone() {
+	if ep.closed && ep.finRcvd && ep.sndUna == ep.finSeq+1 {
+		ep.finish()
+	}
+}
+
+func (ep *endpoint) finish() {
+	ep.state = stateClosed
+	ep.stopTimer()
+	if ep.linger != nil {
+		ep.linger.Stop()
+	}
+	ep.cond.Broadcast()
+	ep.s.remove(ep)
+}
+
+func (ep *endpoint) abort(err error) {
+	ep.mx.Lock()
+	defer ep.mx.Unlock()
+	ep.abortLocked(err, true)
+}
+
+func (ep *endpoint) abortLocked(err error, rst bool) {
+	if ep.state == stateClosed {
+		return
+	}
+	if rst {
+		ep.send(flagRST|flagACK, ep.sndNxt, nil, nil)
+	}
+	ep.err = err
+	ep.finish()
+}
+
+func (ep *endpoint) armTimer() {
+	if ep.armed {
+		return
+	}
+	ep.armed = true
+	if ep.timer == nil {
+		ep.timer = time.AfterFunc(ep.rto, ep.onTimeout)
+	} else {
+		ep.timer.Reset(ep.rto)
+	}
+}
+
+func (ep *endpoint) stopTimer() {
+	if ep.armed {
+		ep.armed = false
+		ep.timer.Stop()
+	}
+}
+
+// onTimeout retransmits everything from the oldest unacknowledged byte.
+func (ep *endpoint) onTimeout() {
+	ep.mx.Lock()
+	defer ep.mx.Unlock()
+
+	ep.armed = false
+	if ep.state == stateClosed {
+		return
+	}
+
+	ep.retries++
+	if ep.retries > maxRetries {
+		ep.abortLocked(errTimeout, true)
+		return
+	}
+	if ep.rto *= 2; ep.rto > maxRTO {
+		ep.rto = maxRTO
+	}
+
+	if ep.state == stateSynReceived {
+		ep.sendSynAck()
+		ep.armTimer()
+		return
+	}
+	ep.sndNxt = ep.sndUna
+	ep.output(true)
+}
+
+func (ep *endpoint) sendSynAck() {
+	ep.send(flagSYN|flagACK, ep.iss, mssOption(uint16(ep.mss)), nil)
+}
+
+func (ep *endpoint) sendAck() {
+	ep.send(flagACK, ep.sndNxt, nil, nil)
+}
+
+func (ep *endpoint) send(flags uint8, seq uint32, opts, payload []byte) {
+	ep.rcvWnd = ep.window()
+	ep.s.write(buildPacket(ep.localAddr.IP, ep.remoteAddr.IP,
+		uint16(ep.localAddr.Port), uint16(ep.remoteAddr.Port),
+		seq, ep.rcvNxt, flags, uint16(ep.rcvWnd), opts, payload))
+}
+
+func (ep *endpoint) window() uint32 {
+	return uint32(maxRcvBuf - len(ep.rcvBuf))
+}
+
+// Read implements net.Conn.
+func (ep *endpoint) Read(b []byte) (int, error) {
+	ep.mx.Lock()
+	defer ep.mx.Unlock()
+
+	for len(ep.rcvBuf) == 0 {
+		switch {
+		case ep.closed:
+			return 0, net.ErrClosed
+		case ep.err != nil:
+			return 0, ep.err
+		case ep.finRcvd:
+			return 0, io.EOF
+		case deadlineExceeded(ep.readDeadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		ep.cond.Wait()
+	}
+
+	n := copy(b, ep.rcvBuf)
+	ep.rcvBuf = ep.rcvBuf[:copy(ep.rcvBuf, ep.rcvBuf[n:])]
+
+	// Tell the peer once enough room is available again.
+	if ep.state != stateClosed && ep.window() >= ep.rcvWnd+uint32(ep.mss) {
+		ep.sendAck()
+	}
+	return n, nil
+}
+
+// Write implements net.Conn.
+func (ep *endpoint) Write(b []byte) (int, error) {
+	ep.mx.Lock()
+	defer ep.mx.Unlock()
+
+	n := 0
+	for n < len(b) {
+		if err := ep.writeErr(); err != nil {
+			return n, err
+		}
+		free := maxSndBuf - len(ep.sndBuf)
+		if free <= 0 {
+			ep.cond.Wait()
+			continue
+		}
+		if free > len(b)-n {
+			free = len(b) - n
+		}
+		ep.sndBuf = append(ep.sndBuf, b[n:n+free]...)
+		n += free
+		ep.output(false)
+	}
+	return n, nil
+}
+
+func (ep *endpoint) writeErr() error {
+	switch {
+	case ep.closed:
+		return net.ErrClosed
+	case ep.err != nil:
+		return ep.err
+	case deadlineExceeded(ep.writeDeadline):
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// Close implements net.Conn, it sends a FIN after all queued data.
+func (ep *endpoint) Close() error {
+	ep.mx.Lock()
+	defer ep.mx.Unlock()
+
+	if ep.closed {
+		return nil
+	}
+	ep.closed = true
+	ep.rcvBuf = nil
+	ep.cond.Broadcast()
+	if ep.state == stateClosed {
+		return nil
+	}
+
+	ep.finSeq = ep.sndUna + uint32(len(ep.sndBuf))
+	ep.output(false)
+	ep.linger = time.AfterFunc(lingerTimeout, func() {
+		ep.abort(errLinger)
+	})
+	ep.checkDone()
+	return nil
+}
+
+// LocalAddr implements net.Conn, it is the original destination.
+func (ep *endpoint) LocalAddr() net.Addr {
+	return ep.localAddr
+}
+
+// RemoteAddr implements net.Conn.
+func (ep *endpoint) RemoteAddr() net.Addr {
+	return ep.remoteAddr
+}
+
+// SetDeadline implements net.Conn.
+func (ep *endpoint) SetDeadline(t time.Time) error {
+	_ = ep.SetReadDeadline(t)
+	return ep.SetWriteDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn.
+func (ep *endpoint) SetReadDeadline(t time.Time) error {
+	ep.mx.Lock()
+	defer ep.mx.Unlock()
+	ep.readDeadline = t
+	ep.rdTimer = resetDeadline(ep.rdTimer, t, ep.cond)
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn.
+func (ep *endpoint) SetWriteDeadline(t time.Time) error {
+	ep.mx.Lock()
+	defer ep.mx.Unlock()
+	ep.writeDeadline = t
+	ep.wdTimer = resetDeadline(ep.wdTimer, t, ep.cond)
+	return nil
+}
+
+// resetDeadline wakes up the waiters of cond when t is reached.
+func resetDeadline(timer *time.Timer, t time.Time, cond *sync.Cond) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	if t.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), func() {
+		cond.L.Lock()
+		cond.Broadcast()
+		cond.L.Unlock()
+	})
+}
+
+func deadlineExceeded(t time.Time) bool {
+	return !t.IsZero() && !time.Now().Before(t)
+}
+
+func randomISS() uint32 {
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	return binary.BigEndian.Uint32(b[:])
+}
+
+func seqLT(a, b uint32) bool  { return int32(a-b) < 0 }
+func seqGT(a, b uint32) bool  { return int32(a-b) > 0 }
+func seqLEQ(a, b uint32) bool { return int32(a-b) <= 0 }
+func seqGEQ(a, b uint32) bool { return int32(a-b) >= 0 }
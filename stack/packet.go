@@ -0,0 +1,202 @@
+package stack
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+const (
+	protocolTCP = 6
+
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	tcpHeaderLen  = 20
+)
+
+// TCP header flags.
+const (
+	flagFIN = 1 << 0
+	flagSYN = 1 << 1
+	flagRST = 1 << 2
+	flagPSH = 1 << 3
+	flagACK = 1 << 4
+)
+
+// TCP option kinds.
+const (
+	optionEnd = 0
+	optionNop = 1
+	optionMSS = 2
+)
+
+// segment is a parsed TCP segment along with its IP addresses.
+type segment struct {
+	src, dst         net.IP
+	srcPort, dstPort uint16
+	seq, ack         uint32
+	flags            uint8
+	window           uint16
+	mss              uint16
+	payload          []byte
+}
+
+// parsePacket parses an IPv4 or IPv6 packet carrying a TCP segment.
+// Fragments, extension headers and other transport protocols are ignored.
+func parsePacket(b []byte) (*segment, bool) {
+	if len(b) < 1 {
+		return nil, false
+	}
+
+	var src, dst net.IP
+	var payload []byte
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < ipv4HeaderLen {
+			return nil, false
+		}
+		hdrLen := int(b[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(b[2:4]))
+		if hdrLen < ipv4HeaderLen || total < hdrLen || total > len(b) {
+			return nil, false
+		}
+		// More fragments flag or non-zero fragment offset.
+		if binary.BigEndian.Uint16(b[6:8])&0x3fff != 0 {
+			return nil, false
+		}
+		if b[9] != protocolTCP {
+			return nil, false
+		}
+		src, dst = net.IP(b[12:16]), net.IP(b[16:20])
+		payload = b[hdrLen:total]
+	case 6:
+		if len(b) < ipv6HeaderLen {
+			return nil, false
+		}
+		total := ipv6HeaderLen + int(binary.BigEndian.Uint16(b[4:6]))
+		if total > len(b) || b[6] != protocolTCP {
+			return nil, false
+		}
+		src, dst = net.IP(b[8:24]), net.IP(b[24:40])
+		payload = b[ipv6HeaderLen:total]
+	default:
+		return nil, false
+	}
+
+	if len(payload) < tcpHeaderLen {
+		return nil, false
+	}
+	dataOff := int(payload[12]>>4) * 4
+	if dataOff < tcpHeaderLen || dataOff > len(payload) {
+		return nil, false
+	}
+
+	seg := &segment{
+		src:     append(net.IP(nil), src...),
+		dst:     append(net.IP(nil), dst...),
+		srcPort: binary.BigEndian.Uint16(payload[0:2]),
+		dstPort: binary.BigEndian.Uint16(payload[2:4]),
+		seq:     binary.BigEndian.Uint32(payload[4:8]),
+		ack:     binary.BigEndian.Uint32(payload[8:12]),
+		flags:   payload[13],
+		window:  binary.BigEndian.Uint16(payload[14:16]),
+		payload: payload[dataOff:],
+	}
+	seg.mss = parseMSS(payload[tcpHeaderLen:dataOff])
+	return seg, true
+}
+
+// parseMSS returns the MSS option value, or 0 if it is absent.
+func parseMSS(opts []byte) uint16 {
+	for len(opts) > 0 {
+		switch opts[0] {
+		case optionEnd:
+			return 0
+		case optionNop:
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || int(opts[1]) < 2 || int(opts[1]) > len(opts) {
+			return 0
+		}
+		if opts[0] == optionMSS && opts[1] == 4 {
+			return binary.BigEndian.Uint16(opts[2:4])
+		}
+		opts = opts[opts[1]:]
+	}
+	return 0
+}
+
+// buildPacket assembles an IP packet carrying a TCP segment from src to dst.
+func buildPacket(src, dst net.IP, srcPort, dstPort uint16, seq, ack uint32,
+	flags uint8, window uint16, opts, payload []byte) []byte {
+	tcpLen := tcpHeaderLen + len(opts) + len(payload)
+
+	var b, tcp []byte
+	var pseudo uint32
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		b = make([]byte, ipv4HeaderLen+tcpLen)
+		b[0] = 0x45
+		binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+		binary.BigEndian.PutUint16(b[6:8], 0x4000) // Don't fragment.
+		b[8] = 64
+		b[9] = protocolTCP
+		copy(b[12:16], src4)
+		copy(b[16:20], dst4)
+		binary.BigEndian.PutUint16(b[10:12], fold(checksum(0, b[:ipv4HeaderLen])))
+
+		pseudo = checksum(0, b[12:20])
+		tcp = b[ipv4HeaderLen:]
+	} else {
+		b = make([]byte, ipv6HeaderLen+tcpLen)
+		b[0] = 0x60
+		binary.BigEndian.PutUint16(b[4:6], uint16(tcpLen))
+		b[6] = protocolTCP
+		b[7] = 64
+		copy(b[8:24], src.To16())
+		copy(b[24:40], dst.To16())
+
+		pseudo = checksum(0, b[8:40])
+		tcp = b[ipv6HeaderLen:]
+	}
+	pseudo += protocolTCP + uint32(tcpLen)
+
+	binary.BigEndian.PutUint16(tcp[0:2], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:4], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:8], seq)
+	binary.BigEndian.PutUint32(tcp[8:12], ack)
+	tcp[12] = uint8((tcpHeaderLen+len(opts))/4) << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:16], window)
+	copy(tcp[tcpHeaderLen:], opts)
+	copy(tcp[tcpHeaderLen+len(opts):], payload)
+	binary.BigEndian.PutUint16(tcp[16:18], fold(checksum(pseudo, tcp)))
+
+	return b
+}
+
+// mssOption encodes a TCP MSS option.
+func mssOption(mss uint16) []byte {
+	opt := []byte{optionMSS, 4, 0, 0}
+	binary.BigEndian.PutUint16(opt[2:], mss)
+	return opt
+}
+
+// checksum adds b to the one's complement sum.
+func checksum(sum uint32, b []byte) uint32 {
+	n := len(b)
+	for i := 0; i+1 < n; i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if n%2 == 1 {
+		sum += uint32(b[n-1]) << 8
+	}
+	return sum
+}
+
+// fold folds the one's complement sum into a 16-bit checksum.
+func fold(sum uint32) uint16 {
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
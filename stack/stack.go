@@ -0,0 +1,156 @@
+// Package stack implements a minimal userspace TCP/IP stack for TUN devices.
+//
+// The peer of every connection is the local kernel, so the stack only plays
+// the passive side of TCP: it accepts connections, delivers data in order and
+// retransmits its own unacknowledged data. It does not do window scaling,
+// selective acknowledgement or congestion control.
+package stack
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/lp2p/p2pvpn/log"
+)
+
+// Handler is called in its own goroutine for every accepted connection.
+// conn.LocalAddr returns the original destination of the connection.
+type Handler func(conn net.Conn)
+
+// tuple identifies a TCP connection.
+type tuple struct {
+	localIP, remoteIP     [16]byte
+	localPort, remotePort uint16
+}
+
+// Stack terminates TCP connections carried in raw IP packets.
+type Stack struct {
+	dev     io.ReadWriter
+	mtu     int
+	handler Handler
+
+	mx        sync.Mutex
+	endpoints map[tuple]*endpoint
+	closed    bool
+
+	wmx sync.Mutex
+}
+
+// New creates a Stack reading and writing IP packets from dev. Every Read
+// of dev must return exactly one packet.
+func New(dev io.ReadWriter, mtu int, handler Handler) *Stack {
+	return &Stack{
+		dev:       dev,
+		mtu:       mtu,
+		handler:   handler,
+		endpoints: make(map[tuple]*endpoint),
+	}
+}
+
+// Serve reads packets from the device until it fails or the stack is closed.
+func (s *Stack) Serve() error {
+	buf := make([]byte, s.mtu)
+	for {
+		n, err := s.dev.Read(buf)
+		if err != nil {
+			s.mx.Lock()
+			closed := s.closed
+			s.mx.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		seg, ok := parsePacket(buf[:n])
+		if !ok {
+			continue
+		}
+		s.input(seg)
+	}
+}
+
+// Close resets all connections. The device is left to the caller.
+func (s *Stack) Close() error {
+	s.mx.Lock()
+	s.closed = true
+	eps := make([]*endpoint, 0, len(s.endpoints))
+	for _, ep := range s.endpoints {
+		eps = append(eps, ep)
+	}
+	s.mx.Unlock()
+
+	for _, ep := range eps {
+		ep.abort(errors.New("stack closed"))
+	}
+	return nil
+}
+
+func (s *Stack) input(seg *segment) {
+	id := tuple{localPort: seg.dstPort, remotePort: seg.srcPort}
+	copy(id.localIP[:], seg.dst.To16())
+	copy(id.remoteIP[:], seg.src.To16())
+
+	s.mx.Lock()
+	if s.closed {
+		s.mx.Unlock()
+		return
+	}
+	ep, ok := s.endpoints[id]
+	if !ok && seg.flags&(flagSYN|flagACK|flagRST) == flagSYN {
+		ep = newEndpoint(s, id, seg)
+		s.endpoints[id] = ep
+	}
+	s.mx.Unlock()
+
+	if ep == nil {
+		s.reset(seg)
+		return
+	}
+	ep.input(seg)
+}
+
+// reset answers a segment that belongs to no connection.
+func (s *Stack) reset(seg *segment) {
+	if seg.flags&flagRST != 0 {
+		return
+	}
+	if seg.flags&flagACK != 0 {
+		s.write(buildPacket(seg.dst, seg.src, seg.dstPort, seg.srcPort,
+			seg.ack, 0, flagRST, 0, nil, nil))
+		return
+	}
+	ack := seg.seq + seqLen(seg)
+	s.write(buildPacket(seg.dst, seg.src, seg.dstPort, seg.srcPort,
+		0, ack, flagRST|flagACK, 0, nil, nil))
+}
+
+func (s *Stack) remove(ep *endpoint) {
+	s.mx.Lock()
+	if s.endpoints[ep.id] == ep {
+		delete(s.endpoints, ep.id)
+	}
+	s.mx.Unlock()
+}
+
+func (s *Stack) write(pkt []byte) {
+	s.wmx.Lock()
+	defer s.wmx.Unlock()
+	if _, err := s.dev.Write(pkt); err != nil {
+		log.Debugf("STACK: write packet failed: %v", err)
+	}
+}
+
+// seqLen returns the sequence space occupied by seg.
+func seqLen(seg *segment) uint32 {
+	n := uint32(len(seg.payload))
+	if seg.flags&flagSYN != 0 {
+		n++
+	}
+	if seg.flags&flagFIN != 0 {
+		n++
+	}
+	return n
+}
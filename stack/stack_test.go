@@ -0,0 +1,178 @@
+package stack
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memDevice is an in-memory packet source, each Read returns one packet.
+type memDevice struct {
+	in  chan []byte
+	out chan []byte
+}
+
+func newMemDevice() *memDevice {
+	return &memDevice{
+		in:  make(chan []byte, 16),
+		out: make(chan []byte, 16),
+	}
+}
+
+func (d *memDevice) Read(b []byte) (int, error) {
+	pkt, ok := <-d.in
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(b, pkt), nil
+}
+
+func (d *memDevice) Write(b []byte) (int, error) {
+	d.out <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func (d *memDevice) next(t *testing.T) *segment {
+	select {
+	case pkt := <-d.out:
+		seg, ok := parsePacket(pkt)
+		require.True(t, ok, "stack wrote an invalid packet")
+		return seg
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for packet")
+	}
+	return nil
+}
+
+var (
+	clientIP = net.IPv4(10, 0, 0, 1)
+	serverIP = net.IPv4(10, 0, 0, 2)
+)
+
+func clientPacket(seq, ack uint32, flags uint8, payload []byte) []byte {
+	return buildPacket(clientIP, serverIP, 40000, 80, seq, ack, flags, 65535, mssOption(1460), payload)
+}
+
+func TestStackEcho(t *testing.T) {
+	dev := newMemDevice()
+	accepted := make(chan net.Addr, 1)
+	s := New(dev, 1500, func(conn net.Conn) {
+		defer conn.Close()
+		accepted <- conn.LocalAddr()
+		_, _ = io.Copy(conn, conn)
+	})
+	go s.Serve()
+	defer close(dev.in)
+
+	// Three-way handshake.
+	dev.in <- clientPacket(1000, 0, flagSYN, nil)
+	synAck := dev.next(t)
+	assert.Equal(t, uint8(flagSYN|flagACK), synAck.flags)
+	assert.Equal(t, uint32(1001), synAck.ack)
+	assert.Equal(t, uint16(1460), synAck.mss)
+	iss := synAck.seq
+
+	dev.in <- clientPacket(1001, iss+1, flagACK, nil)
+	select {
+	case addr := <-accepted:
+		assert.Equal(t, "10.0.0.2:80", addr.String())
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler was not called")
+	}
+
+	// Data is acknowledged and echoed back.
+	dev.in <- clientPacket(1001, iss+1, flagACK|flagPSH, []byte("hello"))
+	var echoed []byte
+	for len(echoed) < 5 {
+		seg := dev.next(t)
+		assert.Equal(t, uint32(1006), seg.ack)
+		echoed = append(echoed, seg.payload...)
+	}
+	assert.Equal(t, "hello", string(echoed))
+
+	// Closing our side makes the handler close too.
+	dev.in <- clientPacket(1006, iss+6, flagACK|flagFIN, nil)
+	for {
+		seg := dev.next(t)
+		if seg.flags&flagFIN != 0 {
+			assert.Equal(t, iss+6, seg.seq)
+			assert.Equal(t, uint32(1007), seg.ack)
+			break
+		}
+	}
+	dev.in <- clientPacket(1007, iss+7, flagACK, nil)
+
+	assert.Eventually(t, func() bool {
+		s.mx.Lock()
+		defer s.mx.Unlock()
+		return len(s.endpoints) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestStackResetUnknown(t *testing.T) {
+	dev := newMemDevice()
+	s := New(dev, 1500, func(conn net.Conn) { conn.Close() })
+	go s.Serve()
+	defer close(dev.in)
+
+	dev.in <- clientPacket(1000, 5000, flagACK, []byte("stray"))
+	seg := dev.next(t)
+	assert.Equal(t, uint8(flagRST), seg.flags)
+	assert.Equal(t, uint32(5000), seg.seq)
+}
+
+func TestStackRetransmit(t *testing.T) {
+	dev := newMemDevice()
+	s := New(dev, 1500, func(conn net.Conn) {
+		_, _ = conn.Write([]byte("data"))
+	})
+	go s.Serve()
+	defer close(dev.in)
+
+	dev.in <- clientPacket(1000, 0, flagSYN, nil)
+	iss := dev.next(t).seq
+	dev.in <- clientPacket(1001, iss+1, flagACK, nil)
+
+	first := dev.next(t)
+	assert.Equal(t, "data", string(first.payload))
+	// Without an ack the same data is sent again.
+	again := dev.next(t)
+	assert.Equal(t, first.seq, again.seq)
+	assert.Equal(t, "data", string(again.payload))
+}
+
+func TestStackOutOfOrder(t *testing.T) {
+	dev := newMemDevice()
+	received := make(chan []byte, 1)
+	s := New(dev, 1500, func(conn net.Conn) {
+		b, _ := io.ReadAll(conn)
+		received <- b
+		conn.Close()
+	})
+	go s.Serve()
+	defer close(dev.in)
+
+	dev.in <- clientPacket(1000, 0, flagSYN, nil)
+	iss := dev.next(t).seq
+	dev.in <- clientPacket(1001, iss+1, flagACK, nil)
+
+	// The segments after a lost one are kept, only a duplicate ack is sent.
+	dev.in <- clientPacket(1004, iss+1, flagACK, []byte("def"))
+	assert.Equal(t, uint32(1001), dev.next(t).ack)
+	dev.in <- clientPacket(1007, iss+1, flagACK|flagFIN, []byte("ghi"))
+	assert.Equal(t, uint32(1001), dev.next(t).ack)
+
+	// Filling the gap delivers everything up to the FIN.
+	dev.in <- clientPacket(1001, iss+1, flagACK, []byte("abc"))
+	assert.Equal(t, uint32(1011), dev.next(t).ack)
+	select {
+	case b := <-received:
+		assert.Equal(t, "abcdefghi", string(b))
+	case <-time.After(2 * time.Second):
+		t.Fatal("data was not delivered")
+	}
+}
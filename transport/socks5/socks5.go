@@ -2,6 +2,7 @@ package socks5
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"encoding/binary"
 	"errors"
 	"io"
@@ -100,13 +101,46 @@ const (
 // Auth errors used to return a specific "Auth failed" error
 var ErrAuth = errors.New("auth failed")
 
+// SOCKS authentication methods as defined in RFC 1928 section 3.
+const (
+	MethodNoAuth       = 0
+	MethodUserPass     = 2
+	MethodNoAcceptable = 0xff
+)
+
 type User struct {
-	Username string
-	Password string
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// Authenticator verifies username/password credentials.
+type Authenticator interface {
+	Verify(username, password string) bool
+}
+
+type userAuthenticator map[string]string
+
+// NewAuthenticator creates an Authenticator accepting users,
+// it returns nil if there is no user.
+func NewAuthenticator(users []User) Authenticator {
+	if len(users) == 0 {
+		return nil
+	}
+	a := make(userAuthenticator, len(users))
+	for _, u := range users {
+		a[u.Username] = u.Password
+	}
+	return a
+}
+
+func (a userAuthenticator) Verify(username, password string) bool {
+	expected, ok := a[username]
+	return ok && subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
 }
 
 // ServerHandshake fast-tracks SOCKS initialization to get target address to connect on server side.
-func ServerHandshake(rw net.Conn) (addr Addr, command Command, err error) {
+// A non-nil authenticator requires the client to pass RFC 1929 username/password authentication.
+func ServerHandshake(rw net.Conn, authenticator Authenticator) (addr Addr, command Command, err error) {
 	// Read RFC 1928 for request and reply structure and sizes.
 	buf := make([]byte, MaxAddrLen)
 	// read VER, NMETHODS, METHODS
@@ -118,8 +152,12 @@ func ServerHandshake(rw net.Conn) (addr Addr, command Command, err error) {
 		return
 	}
 
-	// write VER METHOD
-	if _, err = rw.Write([]byte{5, 0}); err != nil {
+	if authenticator == nil {
+		// write VER METHOD
+		if _, err = rw.Write([]byte{5, MethodNoAuth}); err != nil {
+			return
+		}
+	} else if err = serverAuth(rw, buf, buf[:nmethods], authenticator); err != nil {
 		return
 	}
 
@@ -153,6 +191,44 @@ func ServerHandshake(rw net.Conn) (addr Addr, command Command, err error) {
 	return
 }
 
+// serverAuth negotiates username/password authentication, see RFC 1929.
+func serverAuth(rw io.ReadWriter, buf, methods []byte, authenticator Authenticator) error {
+	if bytes.IndexByte(methods, MethodUserPass) < 0 {
+		_, _ = rw.Write([]byte{5, MethodNoAcceptable})
+		return ErrAuth
+	}
+	// write VER METHOD
+	if _, err := rw.Write([]byte{5, MethodUserPass}); err != nil {
+		return err
+	}
+
+	// read VER ULEN UNAME PLEN PASSWD
+	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != 1 {
+		return ErrAuth
+	}
+	ulen := int(buf[1])
+	if _, err := io.ReadFull(rw, buf[:ulen+1]); err != nil {
+		return err
+	}
+	username := string(buf[:ulen])
+	plen := int(buf[ulen])
+	if _, err := io.ReadFull(rw, buf[:plen]); err != nil {
+		return err
+	}
+	password := string(buf[:plen])
+
+	// write VER STATUS
+	if !authenticator.Verify(username, password) {
+		_, _ = rw.Write([]byte{1, 1})
+		return ErrAuth
+	}
+	_, err := rw.Write([]byte{1, 0})
+	return err
+}
+
 // ClientHandshake fast-tracks SOCKS initialization to get target address to connect on client side.
 func ClientHandshake(rw io.ReadWriter, addr Addr, command Command, user *User) (Addr, error) {
 	buf := make([]byte, MaxAddrLen)
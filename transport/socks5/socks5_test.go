@@ -0,0 +1,75 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// handshakeResult is the outcome of both sides of a handshake.
+type handshakeResult struct {
+	// addr and serverErr are returned by ServerHandshake.
+	addr      Addr
+	serverErr error
+	// clientErr is returned by ClientHandshake.
+	clientErr error
+}
+
+// handshake runs ServerHandshake against ClientHandshake over TCP.
+func handshake(t *testing.T, auth Authenticator, user *User) handshakeResult {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	ch := make(chan handshakeResult, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			ch <- handshakeResult{serverErr: err}
+			return
+		}
+		defer conn.Close()
+		addr, _, err := ServerHandshake(conn, auth)
+		ch <- handshakeResult{addr: addr, serverErr: err}
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, clientErr := ClientHandshake(conn, ParseAddr("peer:80"), CmdConnect, user)
+	r := <-ch
+	r.clientErr = clientErr
+	return r
+}
+
+func TestServerHandshakeNoAuth(t *testing.T) {
+	r := handshake(t, nil, nil)
+	assert.NoError(t, r.serverErr)
+	assert.NoError(t, r.clientErr)
+	assert.Equal(t, "peer:80", r.addr.String())
+}
+
+func TestServerHandshakeAuth(t *testing.T) {
+	auth := NewAuthenticator([]User{{Username: "alice", Password: "secret"}})
+
+	r := handshake(t, auth, &User{Username: "alice", Password: "secret"})
+	assert.NoError(t, r.serverErr)
+	assert.NoError(t, r.clientErr)
+	assert.Equal(t, "peer:80", r.addr.String())
+
+	r = handshake(t, auth, &User{Username: "alice", Password: "wrong"})
+	assert.ErrorIs(t, r.serverErr, ErrAuth)
+	assert.Error(t, r.clientErr)
+
+	// Clients without credentials get "no acceptable methods".
+	r = handshake(t, auth, nil)
+	assert.ErrorIs(t, r.serverErr, ErrAuth)
+	assert.Error(t, r.clientErr)
+}
+
+func TestNewAuthenticatorEmpty(t *testing.T) {
+	assert.Nil(t, NewAuthenticator(nil))
+}
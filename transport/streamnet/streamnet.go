@@ -0,0 +1,108 @@
+// Package streamnet makes libp2p streams of one protocol usable as net.Conn
+// and net.Listener, so servers and clients of the net package work over
+// libp2p.
+package streamnet
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// Conn is a stream as a net.Conn. Its addresses are the IP addresses of
+// the underlying connection, or unspecified ones over relays.
+type Conn struct {
+	network.Stream
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return netAddr(c.Stream.Conn().LocalMultiaddr())
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return netAddr(c.Stream.Conn().RemoteMultiaddr())
+}
+
+// RemotePeer returns the authenticated peer at the other end.
+func (c *Conn) RemotePeer() peer.ID {
+	return c.Stream.Conn().RemotePeer()
+}
+
+func netAddr(m ma.Multiaddr) net.Addr {
+	if m != nil {
+		if addr, err := manet.ToNetAddr(m); err == nil {
+			return addr
+		}
+	}
+	return &net.TCPAddr{IP: net.IPv4zero}
+}
+
+// Dial opens a stream of protocol pid to peer id.
+func Dial(ctx context.Context, h host.Host, id peer.ID, pid protocol.ID) (*Conn, error) {
+	s, err := h.NewStream(ctx, id, pid)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Stream: s}, nil
+}
+
+// Listener accepts the streams of one protocol of a host.
+type Listener struct {
+	h       host.Host
+	pid     protocol.ID
+	streams chan network.Stream
+	once    sync.Once
+	done    chan struct{}
+}
+
+// Listen handles the streams of protocol pid of h, until the listener is
+// closed.
+func Listen(h host.Host, pid protocol.ID) *Listener {
+	l := &Listener{
+		h:       h,
+		pid:     pid,
+		streams: make(chan network.Stream),
+		done:    make(chan struct{}),
+	}
+	h.SetStreamHandler(pid, func(s network.Stream) {
+		select {
+		case l.streams <- s:
+		case <-l.done:
+			_ = s.Reset()
+		}
+	})
+	return l
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case s := <-l.streams:
+		return &Conn{Stream: s}, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops handling the streams, the accepted ones stay open.
+func (l *Listener) Close() error {
+	l.once.Do(func() {
+		l.h.RemoveStreamHandler(l.pid)
+		close(l.done)
+	})
+	return nil
+}
+
+// Addr returns the first listen address of the host.
+func (l *Listener) Addr() net.Addr {
+	if addrs := l.h.Addrs(); len(addrs) > 0 {
+		return netAddr(addrs[0])
+	}
+	return &net.TCPAddr{IP: net.IPv4zero}
+}
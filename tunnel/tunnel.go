@@ -6,6 +6,7 @@ import (
 
 var (
 	tcpQueue = make(chan context.ConnContext)
+	udpQueue = make(chan context.PacketConnContext)
 )
 
 func init() {
@@ -17,11 +18,21 @@ func Add(ctx context.ConnContext) {
 	tcpQueue <- ctx
 }
 
+// AddPacket adds UDP association to queue
+func AddPacket(ctx context.PacketConnContext) {
+	udpQueue <- ctx
+}
+
 // Relay exports internal relay function.
 var Relay = relay
 
 func process() {
-	for c := range tcpQueue {
-		go handleTCPConn(c)
+	for {
+		select {
+		case c := <-tcpQueue:
+			go handleTCPConn(c)
+		case c := <-udpQueue:
+			go handleUDPConn(c)
+		}
 	}
 }
@@ -0,0 +1,164 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lp2p/p2pvpn/common/pool"
+	"github.com/lp2p/p2pvpn/context"
+	"github.com/lp2p/p2pvpn/log"
+	"github.com/lp2p/p2pvpn/transport/socks5"
+)
+
+const (
+	// UDPSessionTimeout is how long a UDP association lives without traffic.
+	UDPSessionTimeout = 60 * time.Second
+
+	// MaxUDPFrameLen is the maximum size of a UDP frame, so a frame always
+	// fits in a pool buffer.
+	MaxUDPFrameLen = 64 * 1024
+
+	// MaxUDPPayloadLen is the largest datagram a frame can carry.
+	MaxUDPPayloadLen = MaxUDPFrameLen - socks5.MaxAddrLen - 2
+
+	// maxUDPTargets bounds the destinations remembered per session, the
+	// caches start over when it is reached.
+	maxUDPTargets = 256
+)
+
+var errUDPFrameTooLarge = errors.New("udp frame too large")
+
+// WriteUDPFrame writes a datagram to a stream.
+// Frame format: ATYP DST.ADDR DST.PORT LEN(2) DATA.
+func WriteUDPFrame(w io.Writer, addr socks5.Addr, payload []byte) error {
+	if len(payload) > MaxUDPPayloadLen {
+		return errUDPFrameTooLarge
+	}
+
+	buf := pool.Get(len(addr) + 2 + len(payload))
+	defer pool.Put(buf)
+
+	n := copy(buf, addr)
+	binary.BigEndian.PutUint16(buf[n:], uint16(len(payload)))
+	copy(buf[n+2:], payload)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadUDPFrame reads a datagram from a stream, buf must hold at least
+// MaxUDPFrameLen bytes. The returned slices are backed by buf.
+func ReadUDPFrame(r io.Reader, buf []byte) (socks5.Addr, []byte, error) {
+	if len(buf) < MaxUDPFrameLen {
+		return nil, nil, io.ErrShortBuffer
+	}
+
+	addr, err := socks5.ReadAddr(r, buf)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	n := len(addr)
+	if _, err := io.ReadFull(r, buf[n:n+2]); err != nil {
+		return nil, nil, err
+	}
+	size := int(binary.BigEndian.Uint16(buf[n : n+2]))
+	if size > MaxUDPPayloadLen {
+		return nil, nil, errUDPFrameTooLarge
+	}
+
+	payload := buf[n+2 : n+2+size]
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+	return addr, payload, nil
+}
+
+// handleUDPConn sends the datagrams framed on pc.Conn through a local UDP
+// socket, and frames the replies back.
+func handleUDPConn(pc context.PacketConnContext) {
+	conn := pc.Conn
+	defer conn.Close()
+
+	udpConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		log.Errorf("TUNNEL: listen udp failed: %v", err)
+		return
+	}
+	defer udpConn.Close()
+
+	// targets maps resolved addresses back to the requested ones, so
+	// replies look like they come from the address the client asked for.
+	// mx guards it, it is reset along with resolved when either is full.
+	var mx sync.Mutex
+	targets := make(map[string]socks5.Addr)
+
+	go func() {
+		buf := pool.Get(MaxUDPFrameLen)
+		defer pool.Put(buf)
+
+		for {
+			n, from, err := udpConn.ReadFromUDP(buf[:MaxUDPPayloadLen])
+			if err != nil {
+				return
+			}
+
+			mx.Lock()
+			addr := targets[from.String()]
+			mx.Unlock()
+			if addr == nil {
+				continue
+			}
+
+			_ = conn.SetReadDeadline(time.Now().Add(UDPSessionTimeout))
+			if err := WriteUDPFrame(conn, addr, buf[:n]); err != nil {
+				_ = udpConn.Close()
+				return
+			}
+		}
+	}()
+
+	// resolved caches the destinations of the session. Failures are not
+	// cached, a later datagram tries again.
+	resolved := make(map[string]*net.UDPAddr)
+
+	buf := pool.Get(MaxUDPFrameLen)
+	defer pool.Put(buf)
+
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(UDPSessionTimeout))
+		addr, payload, err := ReadUDPFrame(conn, buf)
+		if err != nil {
+			return
+		}
+
+		udpAddr, ok := resolved[addr.String()]
+		if !ok {
+			host, port := addr.ToHostPort()
+			udpAddr, err = pc.Resolve(host, port)
+			if err != nil {
+				log.Warnf("TUNNEL: resolve udp %s failed: %v", addr, err)
+				continue
+			}
+
+			mx.Lock()
+			if len(resolved) >= maxUDPTargets || len(targets) >= maxUDPTargets {
+				resolved = make(map[string]*net.UDPAddr)
+				targets = make(map[string]socks5.Addr)
+			}
+			resolved[addr.String()] = udpAddr
+			if _, ok := targets[udpAddr.String()]; !ok {
+				targets[udpAddr.String()] = append(socks5.Addr(nil), addr...)
+			}
+			mx.Unlock()
+		}
+
+		if _, err := udpConn.WriteToUDP(payload, udpAddr); err != nil {
+			log.Debugf("TUNNEL: write udp %s failed: %v", udpAddr, err)
+		}
+	}
+}